@@ -0,0 +1,139 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/unit-io/unitd/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Timeout for the HTTP authentication callback if the timeout is not configured.
+	defaultAuthTimeout = 5 * time.Second
+)
+
+// Authentication errors
+var (
+	errAuthFailed  = errors.New("authentication failed")
+	errUnknownAuth = errors.New("unknown authenticator type")
+)
+
+// Authenticator authenticates the username and password provided by the client during connect.
+type Authenticator interface {
+	// Authenticate returns the contract the user is mapped to, or zero if the user is not mapped to a contract.
+	Authenticate(username, password []byte) (contract uint32, err error)
+}
+
+// newAuthenticator creates the authenticator chosen in the configuration, it returns nil if authentication is not configured.
+func newAuthenticator(cfg config.AuthConfig) (Authenticator, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "htpasswd":
+		return newHtpasswdAuth(cfg.File, cfg.Contracts)
+	case "http":
+		timeout := defaultAuthTimeout
+		if cfg.Timeout != "" {
+			dur, err := time.ParseDuration(cfg.Timeout)
+			if err != nil {
+				return nil, err
+			}
+			timeout = dur
+		}
+		return &httpAuth{url: cfg.URL, client: &http.Client{Timeout: timeout}}, nil
+	default:
+		return nil, errUnknownAuth
+	}
+}
+
+// htpasswdAuth authenticates users from a htpasswd style file with bcrypt hashed passwords.
+type htpasswdAuth struct {
+	users     map[string][]byte
+	contracts map[string]uint32
+}
+
+func newHtpasswdAuth(path string, contracts map[string]uint32) (*htpasswdAuth, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	a := &htpasswdAuth{
+		users:     make(map[string][]byte),
+		contracts: contracts,
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		a.users[parts[0]] = []byte(parts[1])
+	}
+	return a, scanner.Err()
+}
+
+// Authenticate implements Authenticator.Authenticate
+func (a *htpasswdAuth) Authenticate(username, password []byte) (uint32, error) {
+	hash, ok := a.users[string(username)]
+	if !ok {
+		return 0, errAuthFailed
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, password); err != nil {
+		return 0, errAuthFailed
+	}
+	return a.contracts[string(username)], nil
+}
+
+// httpAuth authenticates users by calling an HTTP endpoint. The endpoint receives the username
+// and password as JSON and must respond with status 200 to accept the user. It can map the user
+// to a contract by responding with a JSON body {"contract": <contract>}.
+type httpAuth struct {
+	url    string
+	client *http.Client
+}
+
+type authRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type authResponse struct {
+	Contract uint32 `json:"contract,omitempty"`
+}
+
+// Authenticate implements Authenticator.Authenticate
+func (a *httpAuth) Authenticate(username, password []byte) (uint32, error) {
+	body, err := json.Marshal(&authRequest{Username: string(username), Password: string(password)})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, errAuthFailed
+	}
+
+	var r authResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil && err != io.EOF {
+		return 0, err
+	}
+	return r.Contract, nil
+}
@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/unit-io/unitd/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(file, []byte("# users\nalice:"+string(hash)+"\n"), 0600))
+
+	auth, err := newAuthenticator(config.AuthConfig{Type: "htpasswd", File: file, Contracts: map[string]uint32{"alice": 42}})
+	assert.NoError(t, err)
+
+	contract, err := auth.Authenticate([]byte("alice"), []byte("secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(42), contract)
+
+	_, err = auth.Authenticate([]byte("alice"), []byte("wrong"))
+	assert.Equal(t, errAuthFailed, err)
+
+	_, err = auth.Authenticate([]byte("bob"), []byte("secret"))
+	assert.Equal(t, errAuthFailed, err)
+}
+
+func TestHTTPAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req authRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case req.Username == "alice" && req.Password == "secret":
+			json.NewEncoder(w).Encode(&authResponse{Contract: 42})
+		case req.Username == "bob" && req.Password == "secret":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	auth, err := newAuthenticator(config.AuthConfig{Type: "http", URL: srv.URL, Timeout: "1s"})
+	assert.NoError(t, err)
+
+	contract, err := auth.Authenticate([]byte("alice"), []byte("secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(42), contract)
+
+	contract, err = auth.Authenticate([]byte("bob"), []byte("secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), contract)
+
+	_, err = auth.Authenticate([]byte("alice"), []byte("wrong"))
+	assert.Equal(t, errAuthFailed, err)
+}
+
+func TestNoAuth(t *testing.T) {
+	auth, err := newAuthenticator(config.AuthConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, auth)
+
+	_, err = newAuthenticator(config.AuthConfig{Type: "ldap"})
+	assert.Equal(t, errUnknownAuth, err)
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/rpc"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -17,6 +18,8 @@ import (
 	rh "github.com/unit-io/unitd/pkg/hash"
 	"github.com/unit-io/unitd/pkg/log"
 	"github.com/unit-io/unitd/pkg/uid"
+	"github.com/unit-io/unitd/store"
+	"github.com/unit-io/unitd/types"
 )
 
 const (
@@ -24,6 +27,8 @@ const (
 	defaultClusterReconnect = 200 * time.Millisecond
 	// Number of replicas in ringhash
 	clusterHashReplicas = 20
+	// Maximum number of requests kept to resend to a node once it is reconnected
+	maxMissedRequests = 1024
 )
 
 type clusterNodeConfig struct {
@@ -58,10 +63,19 @@ type ClusterNode struct {
 	// A number of times this node has failed in a row
 	failCount int
 
+	// Requests the node missed while not connected, those are resent once the node is reconnected
+	missed []missedRequest
+
 	// Channel for shutting down the runner; buffered, 1
 	done chan bool
 }
 
+// missedRequest is a request to resend to a node.
+type missedRequest struct {
+	proc string
+	msg  *ClusterReq
+}
+
 // ClusterSess is a basic info on a remote session where the message was created.
 type ClusterSess struct {
 	// IP address of the client. For long polling this is the IP of the last poll
@@ -72,6 +86,9 @@ type ClusterSess struct {
 
 	// Client ID
 	ClientID uid.ID
+
+	// User name provided by the client during connect
+	Username string
 }
 
 // ClusterReq is a Proxy to Master request message.
@@ -95,6 +112,26 @@ type ClusterReq struct {
 	Conn *ClusterSess
 	// True if the original session has disconnected
 	ConnGone bool
+
+	// Persistent session to take over and whether the client requested a clean session
+	Session      uint64
+	CleanSession bool
+
+	// Key revoked by the contract of the originating session
+	RevokedKey []byte
+
+	// Secondary client Id revoked by the contract of the originating session
+	RevokedClientID uid.ID
+
+	// Presence event of the originating session and the topic of the event or of the presence query
+	PresenceEvent string
+	PresenceTopic []byte
+}
+
+// ClusterSession is the state of a persistent session taken over from a remote node.
+type ClusterSession struct {
+	Subscriptions []store.SessionSubscription
+	Messages      []message.Message
 }
 
 // ClusterResp is a Master to Proxy response message.
@@ -138,6 +175,7 @@ func (n *ClusterNode) reconnect() {
 			n.reconnecting = false
 			n.lock.Unlock()
 			log.Info("cluster.reconnect", "connection established "+n.name)
+			go n.resend()
 			return
 		} else if count == 0 {
 			reconnTicker = time.NewTicker(defaultClusterReconnect)
@@ -186,6 +224,49 @@ func (n *ClusterNode) call(proc string, msg, resp interface{}) error {
 	return nil
 }
 
+// callOrResend calls the node, the request is resent once the node is reconnected if the call fails.
+func (n *ClusterNode) callOrResend(proc string, msg *ClusterReq) error {
+	var unused bool
+	err := n.call(proc, msg, &unused)
+	if err == nil {
+		return nil
+	}
+
+	n.lock.Lock()
+	if len(n.missed) >= maxMissedRequests {
+		log.ErrLogger.Error().Str("context", "cluster.callOrResend").Str("node", n.name).Msg("too many missed requests, dropping the oldest request")
+		n.missed = n.missed[1:]
+	}
+	n.missed = append(n.missed, missedRequest{proc: proc, msg: msg})
+	connected := n.connected
+	n.lock.Unlock()
+	// The node is reconnected while the request was being queued.
+	if connected {
+		go n.resend()
+	}
+	return err
+}
+
+// resend resends the requests the node missed while it was not connected.
+func (n *ClusterNode) resend() {
+	n.lock.Lock()
+	missed := n.missed
+	n.missed = nil
+	n.lock.Unlock()
+
+	for i, req := range missed {
+		var unused bool
+		if err := n.call(req.proc, req.msg, &unused); err != nil {
+			// Keep the requests not resent until the node is reconnected again.
+			n.lock.Lock()
+			n.missed = append(missed[i:], n.missed...)
+			n.lock.Unlock()
+			log.ErrLogger.Err(err).Str("context", "cluster.resend").Str("node", n.name).Msg("unable to resend request")
+			return
+		}
+	}
+}
+
 func (n *ClusterNode) callAsync(proc string, msg, resp interface{}, done chan *rpc.Call) *rpc.Call {
 	if done != nil && cap(done) == 0 {
 		log.Fatal("cluster.callAsync", "RPC done channel is unbuffered", nil)
@@ -294,6 +375,7 @@ func (c *Cluster) Master(msg *ClusterReq, rejected *bool) error {
 		}
 		// Update session params which may have changed since the last call.
 		conn.connid = msg.Conn.ConnID
+		conn.username = msg.Conn.Username
 
 		switch msg.Type {
 		case message.SUBSCRIBE:
@@ -311,6 +393,168 @@ func (c *Cluster) Master(msg *ClusterReq, rejected *bool) error {
 	return nil
 }
 
+// Takeover closes the connection of the persistent session as the client has reconnected to a remote node.
+// The session state is moved to the remote node unless the client requested a clean session.
+// Called by a remote node.
+func (c *Cluster) Takeover(msg *ClusterReq, resp *ClusterSession) error {
+	conn := Globals.ConnCache.GetSession(msg.Session)
+	if conn == nil {
+		return nil
+	}
+	log.Info("cluster.Takeover", "session takeover request received from node "+msg.Node)
+
+	conn.takenOver(msg.CleanSession)
+	if msg.CleanSession {
+		return nil
+	}
+	resp.Subscriptions, resp.Messages = takeSession(uint32(msg.Session>>32), uint32(msg.Session))
+	return nil
+}
+
+// takeover requests the cluster nodes to close the connection of the persistent session. The session state
+// taken over is stored in the local session store to restore the session.
+func (c *Cluster) takeover(conn *Conn, clean bool) {
+	if c == nil {
+		return
+	}
+
+	req := &ClusterReq{
+		Node:         c.thisNodeName,
+		Session:      conn.sessionKey(),
+		CleanSession: clean,
+		Conn: &ClusterSess{
+			ConnID:   conn.connid,
+			ClientID: conn.clientid}}
+	for _, n := range c.nodes {
+		var resp ClusterSession
+		if err := n.call("Cluster.Takeover", req, &resp); err != nil {
+			log.ErrLogger.Err(err).Str("context", "cluster.takeover").Str("node", n.name).Msg("unable to take over session")
+			continue
+		}
+		for _, sub := range resp.Subscriptions {
+			if err := store.Session.PutSubscription(conn.clientid.Contract(), conn.sessid, sub, takeoverExpiry); err != nil {
+				log.ErrLogger.Err(err).Str("context", "cluster.takeover").Msg("unable to store session subscription")
+			}
+		}
+		for i := range resp.Messages {
+			if err := store.Session.Enqueue(conn.clientid.Contract(), conn.sessid, &resp.Messages[i], takeoverExpiry); err != nil {
+				log.ErrLogger.Err(err).Str("context", "cluster.takeover").Msg("unable to queue session message")
+			}
+		}
+	}
+}
+
+// Revoke revokes the key of the contract as the key was revoked on a remote node.
+// Called by a remote node.
+func (c *Cluster) Revoke(msg *ClusterReq, unused *bool) error {
+	log.Info("cluster.Revoke", "key revocation received from node "+msg.Node)
+
+	return Globals.Service.revokeKey(msg.Conn.ClientID.Contract(), msg.RevokedKey)
+}
+
+// revoke sends the key revoked by the contract of the connection to the cluster nodes.
+func (c *Cluster) revoke(conn *Conn, key []byte) {
+	if c == nil {
+		return
+	}
+
+	req := &ClusterReq{
+		Node:       c.thisNodeName,
+		RevokedKey: key,
+		Conn: &ClusterSess{
+			ConnID:   conn.connid,
+			ClientID: conn.clientid}}
+	for _, n := range c.nodes {
+		// The revocation is resent once the node is reconnected.
+		if err := n.callOrResend("Cluster.Revoke", req); err != nil {
+			log.ErrLogger.Err(err).Str("context", "cluster.revoke").Str("node", n.name).Msg("unable to revoke key")
+		}
+	}
+}
+
+// RevokeClientID revokes the client Id of the contract as the client Id was revoked on a remote node.
+// Called by a remote node.
+func (c *Cluster) RevokeClientID(msg *ClusterReq, unused *bool) error {
+	log.Info("cluster.RevokeClientID", "client Id revocation received from node "+msg.Node)
+
+	return Globals.Service.putRevokedClientID(msg.Conn.ClientID.Contract(), msg.RevokedClientID)
+}
+
+// revokeClientID sends the client Id revoked by the contract of the connection to the cluster nodes.
+func (c *Cluster) revokeClientID(conn *Conn, id uid.ID) {
+	if c == nil {
+		return
+	}
+
+	req := &ClusterReq{
+		Node:            c.thisNodeName,
+		RevokedClientID: id,
+		Conn: &ClusterSess{
+			ConnID:   conn.connid,
+			ClientID: conn.clientid}}
+	for _, n := range c.nodes {
+		// The revocation is resent once the node is reconnected.
+		if err := n.callOrResend("Cluster.RevokeClientID", req); err != nil {
+			log.ErrLogger.Err(err).Str("context", "cluster.revokeClientID").Str("node", n.name).Msg("unable to revoke client Id")
+		}
+	}
+}
+
+// Presence sends the presence event of a connection on a remote node to the presence subscribers of the topic.
+// Called by a remote node.
+func (c *Cluster) Presence(msg *ClusterReq, unused *bool) error {
+	Globals.Service.notifyPresence(msg.Conn.ClientID.Contract(), msg.PresenceEvent, msg.PresenceTopic, presenceInfo(msg.Conn.ConnID, msg.Conn.Username))
+	return nil
+}
+
+// notifyPresence sends the presence event of the connection to the node that owns the contract.
+func (c *Cluster) notifyPresence(conn *Conn, event string, topic []byte) error {
+	n := c.nodeForContract(contractKey(conn.clientid.Contract()))
+	if n == nil {
+		return errors.New("cluster.notifyPresence: attempt to route to non-existent node")
+	}
+
+	var unused bool
+	return n.call("Cluster.Presence", &ClusterReq{
+		Node:          c.thisNodeName,
+		PresenceEvent: event,
+		PresenceTopic: topic,
+		Conn: &ClusterSess{
+			ConnID:   conn.connid,
+			ClientID: conn.clientid,
+			Username: conn.username}}, &unused)
+}
+
+// WhoIs returns the connections subscribed to the topic on this node.
+// Called by a remote node.
+func (c *Cluster) WhoIs(msg *ClusterReq, who *[]types.PresenceInfo) error {
+	*who = Globals.Service.whoIs(msg.Conn.ClientID.Contract(), msg.PresenceTopic)
+	return nil
+}
+
+// whoIs returns the connections subscribed to the topic on the cluster nodes.
+func (c *Cluster) whoIs(conn *Conn, topic []byte) (who []types.PresenceInfo) {
+	if c == nil {
+		return nil
+	}
+
+	req := &ClusterReq{
+		Node:          c.thisNodeName,
+		PresenceTopic: topic,
+		Conn: &ClusterSess{
+			ConnID:   conn.connid,
+			ClientID: conn.clientid}}
+	for _, n := range c.nodes {
+		var remote []types.PresenceInfo
+		if err := n.call("Cluster.WhoIs", req, &remote); err != nil {
+			log.ErrLogger.Err(err).Str("context", "cluster.whoIs").Str("node", n.name).Msg("unable to get subscribers")
+			continue
+		}
+		who = append(who, remote...)
+	}
+	return who
+}
+
 // Dispatch receives messages from the master node addressed to a specific local connection.
 func (Cluster) Proxy(resp *ClusterResp, unused *bool) error {
 	log.Info("cluster.Proxy", "response from Master for connection "+string(resp.FromConnID))
@@ -319,6 +563,19 @@ func (Cluster) Proxy(resp *ClusterResp, unused *bool) error {
 	// Find appropriate connection, send the message to it
 
 	if conn := Globals.ConnCache.Get(resp.FromConnID); conn != nil {
+		if resp.MsgPub != nil {
+			// Publish is encoded by the connection as the line protocol of the connection is not known to the master.
+			// The topic is sent in the MQTT-standard form if the connection uses the MQTT-standard topics.
+			if conn.mqttTopics {
+				resp.MsgPub.Topic = security.ToMQTT(resp.MsgPub.Topic)
+			}
+			select {
+			case conn.pub <- resp.MsgPub:
+			case <-time.After(time.Microsecond * 50):
+				log.Error("cluster.Proxy", "Proxy: timeout")
+			}
+			return nil
+		}
 		if !conn.SendRawBytes(resp.Msg) {
 			log.Error("cluster.Proxy", "Proxy: timeout")
 		}
@@ -329,6 +586,11 @@ func (Cluster) Proxy(resp *ClusterResp, unused *bool) error {
 	return nil
 }
 
+// contractKey returns the name of the contract to find the cluster node which owns the contract.
+func contractKey(contract uint32) string {
+	return strconv.FormatUint(uint64(contract), 10)
+}
+
 // Given contract name, find appropriate cluster node to route message to
 func (c *Cluster) nodeForContract(contract string) *ClusterNode {
 	key := c.ring.Get(contract)
@@ -356,7 +618,7 @@ func (c *Cluster) isRemoteContract(contract string) bool {
 // Forward client message to the Master (cluster node which owns the topic)
 func (c *Cluster) routeToContract(msg lp.Packet, topic *security.Topic, msgType uint8, m *message.Message, conn *Conn) error {
 	// Find the cluster node which owns the topic, then forward to it.
-	n := c.nodeForContract(string(conn.clientid.Contract()))
+	n := c.nodeForContract(contractKey(conn.clientid.Contract()))
 	if n == nil {
 		return errors.New("cluster.routeToContract: attempt to route to non-existent node")
 	}
@@ -395,7 +657,8 @@ func (c *Cluster) routeToContract(msg lp.Packet, topic *security.Topic, msgType
 			Conn: &ClusterSess{
 				//RemoteAddr: conn.(),
 				ConnID:   conn.connid,
-				ClientID: conn.clientid}})
+				ClientID: conn.clientid,
+				Username: conn.username}})
 }
 
 // Session terminated at origin. Inform remote Master nodes that the session is gone.
@@ -520,6 +783,14 @@ func (c *Conn) rpcWriteLoop() {
 				log.Error("conn.writeRPC", err.Error())
 				return
 			}
+		case pub := <-c.pub:
+			// Forward the message published to the remote session.
+			err := c.clnode.call("Cluster.Proxy", &ClusterResp{Type: message.PUBLISH, MsgPub: pub, FromConnID: c.connid}, &unused)
+			c.acked()
+			if err != nil {
+				log.Error("conn.writeRPC", err.Error())
+				return
+			}
 		case msg := <-c.stop:
 			// Shutdown is requested, don't care if the message is delivered
 			if msg != nil {
@@ -0,0 +1,19 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallOrResend(t *testing.T) {
+	n := &ClusterNode{name: "node"}
+	req1, req2 := &ClusterReq{RevokedKey: []byte("k1")}, &ClusterReq{RevokedKey: []byte("k2")}
+	assert.Error(t, n.callOrResend("Cluster.Revoke", req1))
+	assert.Error(t, n.callOrResend("Cluster.Revoke", req2))
+	assert.Equal(t, 2, len(n.missed))
+
+	// The requests are kept in order until the node is reconnected.
+	n.resend()
+	assert.Equal(t, []missedRequest{{"Cluster.Revoke", req1}, {"Cluster.Revoke", req2}}, n.missed)
+}
@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"net"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lp "github.com/unit-io/unitd/lineprotocol"
@@ -32,35 +34,51 @@ type Conn struct {
 	recv               chan lp.Packet
 	pub                chan *lp.Publish
 	stop               chan interface{}
+	listener           string         // The name of the listener that accepted the connection.
 	insecure           bool           // The insecure flag provided by client will not perform key validation and permissions check on the topic.
+	mqttTopics         bool           // The connection uses the MQTT-standard topics with the '/' separator and the '+' and '#' wildcards.
 	username           string         // The username provided by the client during connect.
+	will               *lp.Publish    // The will message to publish if the connection is closed without a disconnect.
+	keepalive          time.Duration  // The keepalive negotiated during connect.
+	pending            int64          // The number of messages sent to the connection and pending acknowledgement.
+	sessid             uint32         // The persistent session of the connection, zero if the client Id was not provided.
+	sessionExpiry      time.Duration  // The session is persisted for the session expiry after the connection is closed.
+	version            uint8          // The protocol version provided by the client during connect.
 	message.MessageIds                // local identifier of messages
 	clientid           uid.ID         // The clientid provided by client during connect or new Id assigned.
+	quota              *contractQuota // The quota of the contract, set once the connection is counted against the quota.
 	connid             uid.LID        // The locally unique id of the connection.
 	service            *Service       // The service for this connection.
 	subs               *message.Stats // The subscriptions for this connection.
+	replay             replayQueue    // The live messages held while the history is replayed to the connection.
 	// Reference to the cluster node where the connection has originated. Set only for cluster RPC sessions
 	clnode *ClusterNode
 	// Cluster nodes to inform when disconnected
 	nodes map[string]bool
 
 	// Close.
-	closeW sync.WaitGroup
-	closeC chan struct{}
+	closeW      sync.WaitGroup
+	closeC      chan struct{}
+	disconnectC chan uint8    // The reason code of the disconnect to write before the connection is closed.
+	done        chan struct{} // closed once the connection is closed.
 }
 
 func (s *Service) newConn(t net.Conn, proto lp.Proto) *Conn {
 	var lineProto lp.ProtoAdapter
+	var listener string
 	switch proto {
 	case lp.MQTT:
 		lineProto = &mqtt.LineProto{}
+		listener = "listen"
 	case lp.GRPC:
 		lineProto = &grpc.LineProto{}
+		listener = "grpc_listen"
 	}
 
 	c := &Conn{
 		proto:      lineProto,
 		socket:     t,
+		listener:   listener,
 		MessageIds: message.NewMessageIds(),
 		send:       make(chan lp.Packet, 1), // buffered
 		recv:       make(chan lp.Packet),
@@ -69,8 +87,11 @@ func (s *Service) newConn(t net.Conn, proto lp.Proto) *Conn {
 		connid:     uid.NewLID(),
 		service:    s,
 		subs:       message.NewStats(),
+		keepalive:  defaultKeepAlive,
 		// Close
-		closeC: make(chan struct{}),
+		closeC:      make(chan struct{}),
+		disconnectC: make(chan uint8, 1),
+		done:        make(chan struct{}),
 	}
 
 	// Increment the connection counter
@@ -112,25 +133,97 @@ func (c *Conn) Type() message.SubscriberType {
 
 // Send forwards the message to the underlying client.
 func (c *Conn) SendMessage(msg *message.Message) bool {
+	return c.sendMessage(msg, time.Microsecond*50)
+}
+
+// sendMessage forwards the message to the underlying client, waiting at most the timeout for the
+// write loop, or until the connection is closed if the timeout is zero.
+func (c *Conn) sendMessage(msg *message.Message, timeout time.Duration) bool {
+	// The topic is sent in the MQTT-standard form if the connection uses the MQTT-standard topics.
+	if c.mqttTopics {
+		m := *msg
+		m.Topic = security.ToMQTT(msg.Topic)
+		msg = &m
+	}
 	m := lp.Publish{
 		FixedHeader: lp.FixedHeader{
-			Qos: msg.Qos,
+			Qos:    msg.Qos,
+			Retain: msg.Retain,
 		},
 		MessageID: msg.MessageID, // The ID of the message
 		Topic:     msg.Topic,     // The topic for this message.
 		Payload:   msg.Payload,   // The payload for this message.
 	}
+	if msg.Properties != nil {
+		m.Properties = *msg.Properties
+	}
 
 	// Acknowledge the publication
-	select {
-	case c.pub <- &m:
-	case <-time.After(time.Microsecond * 50):
-		return false
+	if timeout > 0 {
+		select {
+		case c.pub <- &m:
+		case <-time.After(timeout):
+			return false
+		}
+	} else {
+		select {
+		case c.pub <- &m:
+		case <-c.closeC:
+			return false
+		}
+	}
+
+	// Track the pending messages, the messages to a cluster connection are pending until forwarded to the remote node.
+	if c.clnode != nil || msg.Qos != 0 {
+		atomic.AddInt64(&c.pending, 1)
+	}
+	// The messages are resent to the client until acknowledged.
+	if c.clnode == nil && msg.Qos != 0 {
+		c.MessageIds.Track(c.inboundID(msg.MessageID), *msg)
 	}
 
 	return true
 }
 
+// deliver sends a copy of the message to the subscriber at the minimum of the publish qos and the
+// subscription qos. The message id is assigned from the message ids of the subscriber.
+func (c *Conn) deliver(m *message.Message, qos uint8) bool {
+	if c.hold(m, qos) {
+		return true
+	}
+	return c.deliverNow(m, qos)
+}
+
+// deliverNow sends the message to the subscriber without holding it for the replay in progress.
+func (c *Conn) deliverNow(m *message.Message, qos uint8) bool {
+	return c.SendMessage(c.outgoing(m, qos))
+}
+
+// outgoing returns the copy of the message sent to the subscriber at the minimum of the qos, the
+// message id is assigned from the message ids of the subscriber.
+func (c *Conn) outgoing(m *message.Message, qos uint8) *message.Message {
+	msg := *m
+	if msg.Qos > qos {
+		msg.Qos = qos
+	}
+	msg.MessageID = 0
+	if msg.Qos != 0 {
+		mID := c.MessageIds.NextID(lp.PUBLISH)
+		msg.MessageID = c.outboundID(mID)
+	}
+	return &msg
+}
+
+// acked marks a pending message as acknowledged.
+func (c *Conn) acked() {
+	for {
+		pending := atomic.LoadInt64(&c.pending)
+		if pending <= 0 || atomic.CompareAndSwapInt64(&c.pending, pending, pending-1) {
+			return
+		}
+	}
+}
+
 // Send forwards raw bytes to the underlying client.
 func (c *Conn) SendRawBytes(buf []byte) bool {
 	if c == nil {
@@ -151,13 +244,17 @@ func (c *Conn) SendRawBytes(buf []byte) bool {
 	return true
 }
 
-// Subscribe subscribes to a particular topic.
-func (c *Conn) subscribe(msg lp.Subscribe, topic *security.Topic) (err error) {
+// Subscribe subscribes to a particular topic, the MQTT 5 subscription options are stored with the qos.
+func (c *Conn) subscribe(msg lp.Subscribe, topic *security.Topic, qos, options uint8, group []byte) (err error) {
 	c.Lock()
 	defer c.Unlock()
 
+	if group != nil {
+		return c.subscribeShared(msg, topic, qos, options, group)
+	}
+
 	key := string(topic.Key)
-	if exists := c.subs.Exist(key); exists && !msg.IsForwarded && Globals.Cluster.isRemoteContract(string(c.clientid.Contract())) {
+	if exists := c.subs.Exist(key); exists && !msg.IsForwarded && Globals.Cluster.isRemoteContract(contractKey(c.clientid.Contract())) {
 		// The contract is handled by a remote node. Forward message to it.
 		if err := Globals.Cluster.routeToContract(&msg, topic, message.SUBSCRIBE, &message.Message{}, c); err != nil {
 			log.ErrLogger.Err(err).Str("context", "conn.subscribe").Int64("connid", int64(c.connid)).Msg("unable to subscribe to remote topic")
@@ -169,10 +266,10 @@ func (c *Conn) subscribe(msg lp.Subscribe, topic *security.Topic) (err error) {
 		if err != nil {
 			log.ErrLogger.Err(err).Str("context", "conn.subscribe")
 		}
-		if first := c.subs.Increment(topic.Topic[:topic.Size], key, messageId); first {
+		if first := c.subs.Increment(key, message.Stat{ID: messageId, Topic: topic.Topic[:topic.Size], Key: topic.Key, Qos: qos, Options: options}); first {
 			// Subscribe the subscriber
 			payload := make([]byte, 5)
-			payload[0] = msg.Qos
+			payload[0] = qos | options
 			binary.LittleEndian.PutUint32(payload[1:5], uint32(c.connid))
 			if err = store.Subscription.Put(c.clientid.Contract(), messageId, topic.Topic, payload); err != nil {
 				log.ErrLogger.Err(err).Str("context", "conn.subscribe").Str("topic", string(topic.Topic[:topic.Size])).Int64("connid", int64(c.connid)).Msg("unable to subscribe to topic") // Unable to subscribe
@@ -180,19 +277,67 @@ func (c *Conn) subscribe(msg lp.Subscribe, topic *security.Topic) (err error) {
 			}
 			// Increment the subscription counter
 			c.service.meter.Subscriptions.Inc(1)
+			c.quota.subscribed(1)
+			c.notifyPresence(presenceJoin, topic.Topic[:topic.Size])
 		}
 	}
 	return nil
 }
 
+// subscribeShared subscribes to a shared subscription group. The member of the group to deliver a message
+// is selected on the node that owns the contract, so the subscription is always forwarded to the owner node.
+func (c *Conn) subscribeShared(msg lp.Subscribe, topic *security.Topic, qos, options uint8, group []byte) (err error) {
+	groupID := shareGroupID(group, topic)
+	key := string(groupID) + "/" + string(topic.Key)
+	if !msg.IsForwarded && Globals.Cluster.isRemoteContract(contractKey(c.clientid.Contract())) {
+		// The contract is handled by a remote node. Forward message to it.
+		if err := Globals.Cluster.routeToContract(&msg, topic, message.SUBSCRIBE, &message.Message{}, c); err != nil {
+			log.ErrLogger.Err(err).Str("context", "conn.subscribeShared").Int64("connid", int64(c.connid)).Msg("unable to subscribe to remote shared topic")
+			return err
+		}
+		// Track the subscription to forward the unsubscribe.
+		c.subs.Increment(key, message.Stat{Topic: topic.Topic[:topic.Size], Key: topic.Key, Qos: qos, Options: options, Group: groupID})
+		return nil
+	}
+
+	if !c.service.shares.Join(shareKey(c.clientid.Contract(), groupID), uint32(c.connid), c.service.config.MaxSubscriberCount) {
+		return types.ErrGroupFull
+	}
+	messageId, err := store.Subscription.NewID()
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.subscribeShared")
+	}
+	if first := c.subs.Increment(key, message.Stat{ID: messageId, Topic: topic.Topic[:topic.Size], Key: topic.Key, Qos: qos, Options: options, Group: groupID}); first {
+		// Subscribe the subscriber, the payload carries the group to select one member of the group on publish.
+		payload := make([]byte, 5+len(groupID))
+		payload[0] = qos | options
+		binary.LittleEndian.PutUint32(payload[1:5], uint32(c.connid))
+		copy(payload[5:], groupID)
+		if err = store.Subscription.Put(c.clientid.Contract(), messageId, topic.Topic, payload); err != nil {
+			log.ErrLogger.Err(err).Str("context", "conn.subscribeShared").Str("topic", string(topic.Topic[:topic.Size])).Int64("connid", int64(c.connid)).Msg("unable to subscribe to shared topic") // Unable to subscribe
+			return err
+		}
+		// Increment the subscription counter
+		c.service.meter.Subscriptions.Inc(1)
+		c.quota.subscribed(1)
+		c.notifyPresence(presenceJoin, topic.Topic[:topic.Size])
+	}
+	return nil
+}
+
 // Unsubscribe unsubscribes this client from a particular topic.
-func (c *Conn) unsubscribe(msg lp.Unsubscribe, topic *security.Topic) (err error) {
+func (c *Conn) unsubscribe(msg lp.Unsubscribe, topic *security.Topic, group []byte) (err error) {
 	c.Lock()
 	defer c.Unlock()
 
 	key := string(topic.Key)
+	if group != nil {
+		groupID := shareGroupID(group, topic)
+		key = string(groupID) + "/" + key
+		c.service.shares.Leave(shareKey(c.clientid.Contract(), groupID), uint32(c.connid))
+	}
 	// Remove the subscription from stats and if there's no more subscriptions, notify everyone.
-	if last, messageId := c.subs.Decrement(topic.Topic[:topic.Size], key); last {
+	if last, messageId := c.subs.Decrement(topic.Topic[:topic.Size], key); last && messageId != nil {
 		// Unsubscribe the subscriber
 		if err = store.Subscription.Delete(c.clientid.Contract(), messageId, topic.Topic[:topic.Size]); err != nil {
 			log.ErrLogger.Err(err).Str("context", "conn.unsubscribe").Str("topic", string(topic.Topic[:topic.Size])).Int64("connid", int64(c.connid)).Msg("unable to unsubscribe to topic") // Unable to subscribe
@@ -200,8 +345,10 @@ func (c *Conn) unsubscribe(msg lp.Unsubscribe, topic *security.Topic) (err error
 		}
 		// Decrement the subscription counter
 		c.service.meter.Subscriptions.Dec(1)
+		c.quota.subscribed(-1)
+		c.notifyPresence(presenceLeave, topic.Topic[:topic.Size])
 	}
-	if !msg.IsForwarded && Globals.Cluster.isRemoteContract(string(c.clientid.Contract())) {
+	if !msg.IsForwarded && Globals.Cluster.isRemoteContract(contractKey(c.clientid.Contract())) {
 		// The topic is handled by a remote node. Forward message to it.
 		if err := Globals.Cluster.routeToContract(&msg, topic, message.UNSUBSCRIBE, &message.Message{}, c); err != nil {
 			log.ErrLogger.Err(err).Str("context", "conn.unsubscribe").Int64("connid", int64(c.connid)).Msg("unable to unsubscribe to remote topic")
@@ -212,7 +359,7 @@ func (c *Conn) unsubscribe(msg lp.Unsubscribe, topic *security.Topic) (err error
 }
 
 // Publish publishes a message to everyone and returns the number of outgoing bytes written.
-func (c *Conn) publish(msg lp.Publish, messageID uint16, topic *security.Topic, payload []byte) (err error) {
+func (c *Conn) publish(msg lp.Publish, topic *security.Topic, payload []byte, published time.Time) (err error) {
 	c.service.meter.InMsgs.Inc(1)
 	c.service.meter.InBytes.Inc(int64(len(payload)))
 	// subscription count
@@ -223,30 +370,58 @@ func (c *Conn) publish(msg lp.Publish, messageID uint16, topic *security.Topic,
 		log.ErrLogger.Err(err).Str("context", "conn.publish")
 	}
 	m := &message.Message{
-		MessageID: messageID,
-		Topic:     topic.Topic[:topic.Size],
-		Payload:   payload,
+		Topic:      topic.Topic[:topic.Size],
+		Payload:    payload,
+		Qos:        msg.Qos,
+		TTL:        int64(c.service.messageTTL(topic, msg.Properties).Seconds()),
+		Retain:     msg.Retain,
+		Published:  published.UnixNano(),
+		Properties: publishProperties(msg.Properties),
 	}
+	// The message is delivered with the retain flag cleared unless the subscriber requested the retain as published.
+	live := *m
+	live.Retain = false
+	// Shared subscriptions are grouped to deliver the message to one member of the group.
+	var groups map[string][][]byte
 	for _, connid := range conns {
-		qos := connid[0]
+		if offline(connid) {
+			c.enqueue(m, connid)
+			continue
+		}
+		if len(connid) > 5 {
+			if groups == nil {
+				groups = make(map[string][][]byte)
+			}
+			groups[string(connid[5:])] = append(groups[string(connid[5:])], connid)
+			continue
+		}
+		qos, options := connid[0]&0x03, connid[0]&^0x03
 		lid := uid.LID(binary.LittleEndian.Uint32(connid[1:5]))
 		sub := Globals.ConnCache.Get(lid)
 		if sub != nil {
-			if qos != 0 && m.MessageID == 0 {
-				mID := c.MessageIds.NextID(lp.PUBLISH)
-				m.MessageID = c.outboundID(mID)
-				m.Qos = qos
+			// The messages are not delivered to the publisher subscribed with the no local option.
+			if options&message.SubNoLocal != 0 && sub.connid == c.connid {
+				continue
+			}
+			delivered := &live
+			if options&message.SubRetainAsPublished != 0 {
+				delivered = m
 			}
-			if !sub.SendMessage(m) {
+			if !sub.deliver(delivered, qos) {
 				log.ErrLogger.Err(err).Str("context", "conn.publish")
 			}
 			msgCount++
 		}
 	}
+	for groupID, members := range groups {
+		if c.publishShared(m, groupID, members) {
+			msgCount++
+		}
+	}
 	c.service.meter.OutMsgs.Inc(int64(msgCount))
 	c.service.meter.OutBytes.Inc(m.Size() * int64(msgCount))
 
-	if !msg.IsForwarded && Globals.Cluster.isRemoteContract(string(c.clientid.Contract())) {
+	if !msg.IsForwarded && Globals.Cluster.isRemoteContract(contractKey(c.clientid.Contract())) {
 		if err = Globals.Cluster.routeToContract(&msg, topic, message.PUBLISH, m, c); err != nil {
 			log.ErrLogger.Err(err).Str("context", "conn.publish").Int64("connid", int64(c.connid)).Msg("unable to publish to remote topic")
 		}
@@ -254,6 +429,103 @@ func (c *Conn) publish(msg lp.Publish, messageID uint16, topic *security.Topic,
 	return err
 }
 
+// publishShared delivers the message to one member of the shared subscription group. The members
+// are tried in the order of the selection strategy until the message is delivered to a member.
+func (c *Conn) publishShared(m *message.Message, groupID string, members [][]byte) bool {
+	start := c.service.shares.Next(shareKey(c.clientid.Contract(), []byte(groupID)), len(members))
+	order := make([]*Conn, 0, len(members))
+	qoss := make(map[*Conn]uint8, len(members))
+	for i := range members {
+		member := members[(start+i)%len(members)]
+		if sub := Globals.ConnCache.Get(uid.LID(binary.LittleEndian.Uint32(member[1:5]))); sub != nil {
+			order = append(order, sub)
+			qoss[sub] = member[0]
+		}
+	}
+	live := *m
+	live.Retain = false
+	if c.service.config.SharedSubscription == "least_loaded" {
+		sort.SliceStable(order, func(i, j int) bool {
+			return atomic.LoadInt64(&order[i].pending) < atomic.LoadInt64(&order[j].pending)
+		})
+	}
+
+	for _, sub := range order {
+		delivered := &live
+		if qoss[sub]&message.SubRetainAsPublished != 0 {
+			delivered = m
+		}
+		if sub.deliver(delivered, qoss[sub]&0x03) {
+			return true
+		}
+	}
+	log.ErrLogger.Error().Str("context", "conn.publishShared").Str("group", groupID).Msg("unable to deliver message to shared subscription group")
+	return false
+}
+
+// publishProperties returns the MQTT 5 properties of the publish forwarded to the subscribers, nil if the publish has none.
+func publishProperties(p lp.Properties) *lp.Properties {
+	if p.PayloadFormat == nil && p.MessageExpiry == 0 && p.ContentType == nil && p.ResponseTopic == nil &&
+		p.CorrelationData == nil && len(p.UserProperties) == 0 {
+		return nil
+	}
+	return &lp.Properties{
+		PayloadFormat:   p.PayloadFormat,
+		MessageExpiry:   p.MessageExpiry,
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		UserProperties:  p.UserProperties,
+	}
+}
+
+// subOptions returns the MQTT 5 subscription options stored with the qos of the subscription.
+func subOptions(sub lp.TopicQOSTuple) uint8 {
+	var options uint8
+	if sub.NoLocal {
+		options |= message.SubNoLocal
+	}
+	if sub.RetainAsPublished {
+		options |= message.SubRetainAsPublished
+	}
+	return options
+}
+
+// shareGroupID returns the identifier of the shared subscription group, a group is identified by the group name and the topic.
+func shareGroupID(group []byte, topic *security.Topic) []byte {
+	groupID := make([]byte, 0, len(group)+1+topic.Size)
+	groupID = append(groupID, group...)
+	groupID = append(groupID, '/')
+	return append(groupID, topic.Topic[:topic.Size]...)
+}
+
+// shareKey returns the key of the shared subscription group for the contract.
+func shareKey(contract uint32, groupID []byte) string {
+	return strconv.FormatUint(uint64(contract), 10) + "/" + string(groupID)
+}
+
+// publishWill publishes the will message provided by the client during connect.
+func (c *Conn) publishWill() {
+	will := *c.will
+	c.will = nil
+
+	topic := security.ParseKey(will.Topic)
+	published := time.Now()
+	props := publishProperties(will.Properties)
+	if err := store.Message.Put(c.clientid.Contract(), topic.Topic[:topic.Size], will.Qos, will.Payload, props, c.service.messageTTL(topic, will.Properties), published); err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.publishWill").Int64("connid", int64(c.connid)).Msg("unable to store will message")
+	}
+	if will.Retain {
+		if err := store.Retained.Put(c.clientid.Contract(), topic.Topic[:topic.Size], will.Qos, will.Payload, props); err != nil {
+			log.ErrLogger.Err(err).Str("context", "conn.publishWill").Int64("connid", int64(c.connid)).Msg("unable to retain will message")
+		}
+	}
+
+	if err := c.publish(will, topic, will.Payload, published); err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.publishWill").Int64("connid", int64(c.connid)).Msg("unable to publish will message")
+	}
+}
+
 // sendClientID generate unique client and send it to new client
 func (c *Conn) sendClientID(clientidentifier string) {
 	c.SendMessage(&message.Message{
@@ -275,8 +547,15 @@ func (c *Conn) notifyError(err *types.Error, messageID uint16) {
 
 func (c *Conn) unsubAll() {
 	for _, stat := range c.subs.All() {
-		store.Subscription.Delete(c.clientid.Contract(), stat.ID, stat.Topic)
+		if stat.Group != nil {
+			c.service.shares.Leave(shareKey(c.clientid.Contract(), stat.Group), uint32(c.connid))
+		}
+		if stat.ID != nil {
+			store.Subscription.Delete(c.clientid.Contract(), stat.ID, stat.Topic)
+			c.notifyPresence(presenceLeave, stat.Topic)
+		}
 	}
+	c.service.presence.unsubscribeAll(c)
 }
 
 func (c *Conn) inboundID(id uint16) message.MID {
@@ -314,18 +593,44 @@ func (c *Conn) close() error {
 	// Signal all goroutines.
 	close(c.closeC)
 	c.closeW.Wait()
+	// Publish the will message as the connection is closed without a disconnect.
+	if c.will != nil {
+		c.publishWill()
+	}
+
 	// Unsubscribe from everything, no need to lock since each Unsubscribe is
 	// already locked. Locking the 'Close()' would result in a deadlock.
 	// Don't close clustered connection, their servers are not being shut down.
+	expiry := c.expiry()
 	if c.clnode == nil {
 		for _, stat := range c.subs.All() {
+			if stat.Group != nil {
+				c.service.shares.Leave(shareKey(c.clientid.Contract(), stat.Group), uint32(c.connid))
+			}
+			if stat.ID == nil {
+				// The subscription is handled by a remote node.
+				continue
+			}
 			store.Subscription.Delete(c.clientid.Contract(), stat.ID, stat.Topic)
 			// Decrement the subscription counter
 			c.service.meter.Subscriptions.Dec(1)
+			c.quota.subscribed(-1)
+			c.notifyPresence(presenceLeave, stat.Topic)
+			// Keep the subscription in the persistent session, the shared subscriptions are not kept
+			// in the session so the messages are delivered to other members of the group.
+			if c.sessid != 0 && expiry > 0 && stat.Group == nil {
+				c.storeSession(stat, expiry)
+			}
 		}
 	}
 
+	c.quota.disconnect()
+	c.service.presence.unsubscribeAll(c)
 	Globals.ConnCache.Delete(c.connid)
+	if c.sessid != 0 {
+		Globals.ConnCache.DeleteSession(c.sessionKey(), c)
+	}
+	defer close(c.done)
 	defer log.ConnLogger.Info().Str("context", "conn.close").Int64("connid", int64(c.connid)).Msg("conn closed")
 	Globals.Cluster.connGone(c)
 	close(c.send)
@@ -8,12 +8,14 @@ import (
 
 type ConnCache struct {
 	sync.RWMutex
-	m map[uid.LID]*Conn
+	m        map[uid.LID]*Conn
+	sessions map[uint64]*Conn // index of connections by the persistent session.
 }
 
 func NewConnCache() *ConnCache {
 	cache := &ConnCache{
-		m: make(map[uid.LID]*Conn),
+		m:        make(map[uid.LID]*Conn),
+		sessions: make(map[uint64]*Conn),
 	}
 
 	return cache
@@ -36,8 +38,45 @@ func (cc *ConnCache) Get(connid uid.LID) *Conn {
 	return nil
 }
 
+// All returns the connections in the cache.
+func (cc *ConnCache) All() []*Conn {
+	cc.RLock()
+	defer cc.RUnlock()
+	conns := make([]*Conn, 0, len(cc.m))
+	for _, conn := range cc.m {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
 func (cc *ConnCache) Delete(connid uid.LID) {
 	cc.Lock()
 	defer cc.Unlock()
 	delete(cc.m, connid)
 }
+
+// AddSession indexes the connection by the persistent session. It returns the connection
+// previously indexed for the session, if any.
+func (cc *ConnCache) AddSession(key uint64, conn *Conn) *Conn {
+	cc.Lock()
+	defer cc.Unlock()
+	old := cc.sessions[key]
+	cc.sessions[key] = conn
+	return old
+}
+
+// GetSession fetches a connection from cache by the persistent session.
+func (cc *ConnCache) GetSession(key uint64) *Conn {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.sessions[key]
+}
+
+// DeleteSession removes the session index if it belongs to the connection.
+func (cc *ConnCache) DeleteSession(key uint64, conn *Conn) {
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.sessions[key] == conn {
+		delete(cc.sessions, key)
+	}
+}
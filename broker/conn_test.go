@@ -0,0 +1,446 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/unit-io/unitd/config"
+	adapter "github.com/unit-io/unitd/db"
+	lp "github.com/unit-io/unitd/lineprotocol"
+	"github.com/unit-io/unitd/lineprotocol/mqtt"
+	"github.com/unit-io/unitd/message"
+	"github.com/unit-io/unitd/message/security"
+	"github.com/unit-io/unitd/pkg/crypto"
+	"github.com/unit-io/unitd/pkg/stats"
+	"github.com/unit-io/unitd/pkg/uid"
+	"github.com/unit-io/unitd/store"
+	"github.com/unit-io/unitd/types"
+)
+
+func newTestConn() *Conn {
+	c := &Conn{
+		connid:     uid.NewLID(),
+		MessageIds: message.NewMessageIds(),
+		pub:        make(chan *lp.Publish, 10),
+	}
+	c.MessageIds.Reset(message.MID(c.connid))
+	return c
+}
+
+func TestDeliverQos(t *testing.T) {
+	for pubQos := uint8(0); pubQos <= 2; pubQos++ {
+		for subQos := uint8(0); subQos <= 2; subQos++ {
+			sub := newTestConn()
+			m := &message.Message{Topic: []byte("a/b"), Payload: []byte("hi"), Qos: pubQos}
+			assert.True(t, sub.deliver(m, subQos))
+
+			pkt := <-sub.pub
+			want := pubQos
+			if subQos < want {
+				want = subQos
+			}
+			assert.Equal(t, want, pkt.Qos, "publish qos %d, subscription qos %d", pubQos, subQos)
+			if want == 0 {
+				assert.Equal(t, uint16(0), pkt.MessageID)
+			} else {
+				assert.NotEqual(t, uint16(0), pkt.MessageID)
+				assert.Equal(t, uint8(lp.PUBLISH), sub.MessageIds.GetType(sub.inboundID(pkt.MessageID)))
+			}
+			// The message published is not modified for the subscriber.
+			assert.Equal(t, pubQos, m.Qos)
+			assert.Equal(t, uint16(0), m.MessageID)
+		}
+	}
+}
+
+func TestDeliverMessageID(t *testing.T) {
+	m := &message.Message{Topic: []byte("a/b"), Payload: []byte("hi"), Qos: 1}
+	sub1, sub2 := newTestConn(), newTestConn()
+
+	assert.True(t, sub1.deliver(m, 1))
+	assert.True(t, sub1.deliver(m, 2))
+	assert.True(t, sub2.deliver(m, 1))
+
+	pkt1, pkt2, pkt3 := <-sub1.pub, <-sub1.pub, <-sub2.pub
+	assert.NotEqual(t, pkt1.MessageID, pkt2.MessageID)
+	// Each subscriber assigns the message ids from its own message ids.
+	assert.Equal(t, pkt1.MessageID, pkt3.MessageID)
+	sub1.MessageIds.FreeID(sub1.inboundID(pkt1.MessageID))
+	assert.Equal(t, uint8(lp.PUBLISH), sub2.MessageIds.GetType(sub2.inboundID(pkt3.MessageID)))
+}
+
+func TestDeliverProperties(t *testing.T) {
+	pub := lp.Properties{
+		MessageExpiry:          30,
+		ContentType:            []byte("text/plain"),
+		ResponseTopic:          []byte("a.reply"),
+		CorrelationData:        []byte{1},
+		UserProperties:         []lp.UserProperty{{Key: []byte("k"), Value: []byte("v")}},
+		TopicAlias:             3,
+		SubscriptionIdentifier: []uint32{5},
+	}
+	props := publishProperties(pub)
+	// Only the properties of the message are forwarded to the subscribers.
+	assert.Equal(t, &lp.Properties{
+		MessageExpiry:   30,
+		ContentType:     []byte("text/plain"),
+		ResponseTopic:   []byte("a.reply"),
+		CorrelationData: []byte{1},
+		UserProperties:  []lp.UserProperty{{Key: []byte("k"), Value: []byte("v")}},
+	}, props)
+	assert.Nil(t, publishProperties(lp.Properties{TopicAlias: 3}))
+
+	sub := newTestConn()
+	assert.True(t, sub.deliver(&message.Message{Topic: []byte("a.b"), Payload: []byte("hi"), Properties: props}, 0))
+	assert.Equal(t, *props, (<-sub.pub).Properties)
+
+	// The message expiry interval takes precedence over the ttl of the topic.
+	s := &Service{config: &config.Config{}}
+	assert.Equal(t, 30*time.Second, s.messageTTL(security.ParseKey([]byte("KEY/a.b?ttl=1m")), pub))
+	assert.Equal(t, time.Minute, s.messageTTL(security.ParseKey([]byte("KEY/a.b?ttl=1m")), lp.Properties{}))
+
+	assert.Equal(t, uint8(message.SubNoLocal|message.SubRetainAsPublished), subOptions(lp.TopicQOSTuple{Qos: 1, NoLocal: true, RetainAsPublished: true}))
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := &Service{config: &config.Config{MinKeepAlive: 10, MaxKeepAlive: 60}}
+	tests := []struct {
+		requested uint16
+		want      time.Duration
+	}{
+		{0, 0}, // The keepalive is disabled.
+		{5, 10 * time.Second},
+		{30, 30 * time.Second},
+		{120, time.Minute},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, s.keepAlive(tt.requested), "keepalive %d", tt.requested)
+	}
+	// The default keepalive is the maximum keepalive if the maximum is not configured.
+	s.config.MaxKeepAlive = 0
+	assert.Equal(t, defaultKeepAlive, s.keepAlive(3600))
+
+	// The MQTT 5 client is informed of the keepalive clamped.
+	c := &Conn{version: 5, keepalive: time.Minute}
+	assert.Nil(t, c.serverKeepAlive(60))
+	assert.Equal(t, uint16(60), *c.serverKeepAlive(120))
+	c.version = 4
+	assert.Nil(t, c.serverKeepAlive(120))
+}
+
+func TestDisconnect(t *testing.T) {
+	server, client := net.Pipe()
+	c := &Conn{
+		proto:       &mqtt.LineProto{},
+		socket:      server,
+		version:     5,
+		send:        make(chan lp.Packet, 1),
+		pub:         make(chan *lp.Publish),
+		closeC:      make(chan struct{}),
+		disconnectC: make(chan uint8, 1),
+		service:     &Service{config: &config.Config{}},
+	}
+	go c.writeLoop(context.Background())
+
+	c.disconnect(0x8E)
+	c.disconnect(0x87)
+	// The disconnect is written by the write loop and the connection is closed after.
+	b, err := ioutil.ReadAll(client)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xE0, 0x00}, b)
+}
+
+func TestReplayBeforeLive(t *testing.T) {
+	sub := newTestConn()
+	sub.startReplay([]byte("a.*"))
+	// The live messages to the topic replayed are held while the history is replayed.
+	assert.True(t, sub.deliver(&message.Message{Topic: []byte("a.b"), Payload: []byte("2"), Published: 2}, 0))
+	assert.True(t, sub.deliver(&message.Message{Topic: []byte("a.b"), Payload: []byte("3"), Published: 3}, 0))
+	assert.Equal(t, 0, len(sub.pub))
+	assert.True(t, sub.deliver(&message.Message{Topic: []byte("c"), Payload: []byte("c"), Published: 3}, 0))
+	assert.Equal(t, "c", string((<-sub.pub).Payload))
+
+	sub.endReplay([]byte("a.*"), []message.Message{
+		{Topic: []byte("a.b"), Payload: []byte("1"), Published: 1},
+		{Topic: []byte("a.b"), Payload: []byte("2"), Published: 2},
+	}, 0)
+	// The message published during the replay is delivered once.
+	for _, want := range []string{"1", "2", "3"} {
+		assert.Equal(t, want, string((<-sub.pub).Payload))
+	}
+	assert.Equal(t, 0, len(sub.pub))
+
+	assert.True(t, sub.deliver(&message.Message{Topic: []byte("a.b"), Payload: []byte("4"), Published: 4}, 0))
+	assert.Equal(t, "4", string((<-sub.pub).Payload))
+}
+
+func TestDeliverQueued(t *testing.T) {
+	c := newTestConn()
+	c.mqttTopics = true
+	c.deliverQueued([]message.Message{
+		{Topic: []byte("a.b"), Payload: []byte("1"), Qos: 1},
+		{Topic: []byte("a.c"), Payload: []byte("2"), Qos: 2},
+	})
+	// The queued messages are sent with the MQTT-standard topic and resent until acknowledged.
+	for _, want := range []string{"a/b", "a/c"} {
+		pub := <-c.pub
+		assert.Equal(t, want, string(pub.Topic))
+		assert.NotEqual(t, uint16(0), pub.MessageID)
+	}
+	resend, _ := c.MessageIds.Retry(0, 0)
+	assert.Equal(t, 2, len(resend))
+}
+
+func TestReplayHeldLimit(t *testing.T) {
+	sub := newTestConn()
+	sub.startReplay([]byte("a..."))
+	sub.replay.held = make([]heldMessage, maxHeld)
+	// The live messages are delivered as published once the limit is reached.
+	assert.True(t, sub.deliver(&message.Message{Topic: []byte("a.b"), Payload: []byte("1"), Published: 1}, 0))
+	assert.Equal(t, "1", string((<-sub.pub).Payload))
+	assert.Equal(t, maxHeld, len(sub.replay.held))
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		sub, topic string
+		match      bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.b", "a.b.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.*.c", "a.b.c", true},
+		{"a...", "a.b.c", true},
+		{"a...", "b.c", false},
+		{"...", "a.b", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, matchTopic([]byte(tt.sub), []byte(tt.topic)), tt.sub+" "+tt.topic)
+	}
+}
+
+func TestClientIdRevoked(t *testing.T) {
+	ring := crypto.NewKeyring(0)
+	assert.NoError(t, ring.Add("key", make([]byte, 32), 0))
+	if Globals.ConnCache == nil {
+		Globals.ConnCache = NewConnCache()
+	}
+	s := &Service{
+		Keyring:    ring,
+		cache:      new(sync.Map),
+		revokedIDs: newRevocations(func(contract uint32) ([][]byte, error) { return nil, nil }, nil, nil),
+	}
+	c := &Conn{service: s}
+
+	primary, err := uid.NewClientID(1)
+	assert.NoError(t, err)
+	primary.SetContract(7)
+	id, err := uid.NewSecondaryClientID(primary)
+	assert.NoError(t, err)
+	cid := id.Encode(ring)
+
+	// The client Id is cached once connected.
+	clientid, cerr := c.onConnect([]byte(cid), 0)
+	assert.Nil(t, cerr)
+	assert.Equal(t, id, clientid)
+
+	s.clientIDRevoked(7, id)
+	// The client Id is refused with and without the key identifier and with trailing characters.
+	for _, presented := range []string{cid, cid[:52], cid + "X", cid[:52] + "X"} {
+		_, cerr := c.onConnect([]byte(presented), 0)
+		assert.Equal(t, types.ErrClientIdRevoked, cerr, presented)
+		// The client Id is refused once cached by another encoding.
+		s.cache.Store(crypto.SignatureToUint32([]byte(presented[crypto.EpochSize:crypto.MessageOffset])), id)
+		_, cerr = c.onConnect([]byte(presented), 0)
+		assert.Equal(t, types.ErrClientIdRevoked, cerr, presented)
+		s.cache.Delete(crypto.SignatureToUint32([]byte(presented[crypto.EpochSize:crypto.MessageOffset])))
+	}
+}
+
+func TestKeyGenWithoutParent(t *testing.T) {
+	primary, err := uid.NewClientID(1)
+	assert.NoError(t, err)
+	id, err := uid.NewSecondaryClientID(primary)
+	assert.NoError(t, err)
+
+	// The secondary client Id generates a key by extending a parent key.
+	c := &Conn{clientid: id, service: &Service{}}
+	resp, ok := c.onKeyGen([]byte(`{"topic":"a.b","type":"rw"}`))
+	assert.False(t, ok)
+	assert.Equal(t, types.ErrExtendForbidden, resp)
+}
+
+func TestRevokedKeySpelling(t *testing.T) {
+	s := &Service{
+		revoked: newRevocations(func(contract uint32) ([][]byte, error) { return nil, nil }, revocationExpiry, canonicalKey),
+		shares:  message.NewShares(),
+	}
+	primary, err := uid.NewClientID(1)
+	assert.NoError(t, err)
+	primary.SetContract(7)
+	c := newTestConn()
+	c.service, c.clientid, c.subs = s, primary, message.NewStats()
+
+	key, err := security.GenerateKey(7, []byte("a.b.c"), security.AllowReadWrite, time.Time{}, nil)
+	assert.NoError(t, err)
+	// The last character of the key has unused bits, the key is spelled with another last character.
+	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdef"
+	other := key[:len(key)-1] + string(chars[strings.IndexByte(chars, key[len(key)-1])^1])
+	assert.NotEqual(t, key, other)
+	c.subs.Increment("sub", message.Stat{Topic: []byte("a.b.c"), Key: []byte(other)})
+
+	s.revoked.add(7, canonicalKey([]byte(key)))
+	_, cerr := c.authorize(security.ParseKey([]byte(other+"/a.b.c")), security.AllowRead)
+	assert.Equal(t, types.ErrKeyRevoked, cerr)
+
+	// The subscription made with the other spelling is terminated.
+	c.revokeKey(canonicalKey([]byte(other)))
+	assert.False(t, c.subs.Exist("sub"))
+}
+
+// memAdapter stores the entries of the topics in memory, the topic options are not part of the key.
+type memAdapter struct {
+	adapter.Adapter
+	sync.Mutex
+	entries map[string][][]byte
+	nextID  int
+}
+
+func memKey(contract uint32, topic []byte) string {
+	if i := bytes.IndexByte(topic, '?'); i >= 0 {
+		topic = topic[:i]
+	}
+	return strconv.FormatUint(uint64(contract), 10) + "/" + string(topic)
+}
+
+func (a *memAdapter) Put(contract uint32, topic, payload []byte) error {
+	return a.PutWithID(contract, nil, topic, payload)
+}
+
+func (a *memAdapter) PutWithID(contract uint32, messageId, topic, payload []byte) error {
+	a.Lock()
+	defer a.Unlock()
+	key := memKey(contract, topic)
+	a.entries[key] = append(a.entries[key], payload)
+	return nil
+}
+
+func (a *memAdapter) Get(contract uint32, topic []byte, limit int) ([][]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+	return a.entries[memKey(contract, topic)], nil
+}
+
+func (a *memAdapter) NewID() ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.nextID++
+	return []byte(strconv.Itoa(a.nextID)), nil
+}
+
+func (a *memAdapter) Delete(contract uint32, messageId, topic []byte) error {
+	return nil
+}
+
+// newWillConn returns the connection of the client with the will message to the topic "a.b", and the
+// subscriber to the topic. The connection reads the packets written to the client end of the pipe.
+func newWillConn(t *testing.T, keepalive time.Duration) (*Conn, *Conn, net.Conn) {
+	prev := store.SetAdapter(&memAdapter{entries: make(map[string][][]byte)})
+	t.Cleanup(func() { store.SetAdapter(prev) })
+	if Globals.ConnCache == nil {
+		Globals.ConnCache = NewConnCache()
+	}
+
+	clientid, err := uid.NewClientID(1)
+	assert.NoError(t, err)
+	clientid.SetContract(7)
+	s := &Service{
+		config:   &config.Config{},
+		shares:   message.NewShares(),
+		presence: newPresence(),
+		meter:    NewMeter(),
+		stats:    stats.New(&stats.Config{Addr: "localhost:8094", Size: 50}),
+	}
+	server, client := net.Pipe()
+	c := &Conn{
+		proto:       &mqtt.LineProto{},
+		socket:      server,
+		send:        make(chan lp.Packet, 1),
+		pub:         make(chan *lp.Publish),
+		closeC:      make(chan struct{}),
+		disconnectC: make(chan uint8, 1),
+		done:        make(chan struct{}),
+		connid:      uid.NewLID(),
+		clientid:    clientid,
+		service:     s,
+		subs:        message.NewStats(),
+		MessageIds:  message.NewMessageIds(),
+		keepalive:   keepalive,
+		will:        &lp.Publish{Topic: []byte("KEY/a.b"), Payload: []byte("gone")},
+	}
+
+	sub := newTestConn()
+	Globals.ConnCache.Add(sub)
+	t.Cleanup(func() { Globals.ConnCache.Delete(sub.connid) })
+	payload := make([]byte, 5)
+	binary.LittleEndian.PutUint32(payload[1:5], uint32(sub.connid))
+	assert.NoError(t, store.Subscription.Put(7, nil, []byte("a.b"), payload))
+	return c, sub, client
+}
+
+func TestWillOnConnectionDrop(t *testing.T) {
+	c, sub, client := newWillConn(t, time.Minute)
+	go c.readLoop()
+	client.Close()
+	<-c.done
+
+	assert.Equal(t, 1, len(sub.pub))
+	pub := <-sub.pub
+	assert.Equal(t, "a.b", string(pub.Topic))
+	assert.Equal(t, "gone", string(pub.Payload))
+	// The will message is stored with the history of the topic.
+	msgs, err := store.Message.Get(7, []byte("a.b"), time.Time{}, time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(msgs))
+}
+
+func TestWillOnKeepAliveExpiry(t *testing.T) {
+	c, sub, client := newWillConn(t, 20*time.Millisecond)
+	defer client.Close()
+	go c.readLoop()
+
+	// The connection is closed once no packet is received within one and a half times the keepalive.
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("keepalive not expired")
+	}
+	assert.Equal(t, 1, len(sub.pub))
+	assert.Equal(t, "gone", string((<-sub.pub).Payload))
+}
+
+func TestWillDiscardedOnDisconnect(t *testing.T) {
+	c, sub, client := newWillConn(t, time.Minute)
+	go c.readLoop()
+	_, err := client.Write([]byte{0xE0, 0x00})
+	assert.NoError(t, err)
+	client.Close()
+	<-c.done
+
+	assert.Nil(t, c.will)
+	assert.Equal(t, 0, len(sub.pub))
+	msgs, err := store.Message.Get(7, []byte("a.b"), time.Time{}, time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(msgs))
+}
@@ -4,12 +4,16 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
 	"time"
 
 	lp "github.com/unit-io/unitd/lineprotocol"
 	"github.com/unit-io/unitd/message"
 	"github.com/unit-io/unitd/message/security"
 	"github.com/unit-io/unitd/pkg/crypto"
+	"github.com/unit-io/unitd/pkg/hash"
 	"github.com/unit-io/unitd/pkg/log"
 	"github.com/unit-io/unitd/pkg/stats"
 	"github.com/unit-io/unitd/pkg/uid"
@@ -18,8 +22,27 @@ import (
 )
 
 const (
-	requestClientId = 2682859131 // hash("clientid")
-	requestKeygen   = 812942072  // hash("keygen")
+	requestClientId       = 2682859131 // hash("clientid")
+	requestClientIdList   = 2948993994 // hash("clientid/list")
+	requestClientIdRevoke = 3645911154 // hash("clientid/revoke")
+	requestKeygen         = 812942072  // hash("keygen")
+	requestPresence       = 750047006  // hash("presence")
+	requestRevoke         = 3850395170 // hash("keyrevoke")
+
+	// Keepalive used until the client connects or if the keepalive is not configured.
+	defaultKeepAlive = 120 * time.Second
+
+	// Session expiry interval if the max session expiry is not configured.
+	defaultSessionExpiry = 24 * time.Hour
+
+	// Maximum time-to-live of a message if the max message ttl is not configured.
+	defaultMaxMessageTTL = 24 * time.Hour
+
+	// Interval to resend the messages not acknowledged if the retry interval is not configured.
+	defaultRetryInterval = 20 * time.Second
+
+	// Time to write the disconnect to the client before the connection is closed.
+	disconnectTimeout = time.Second
 )
 
 func (c *Conn) readLoop() error {
@@ -31,12 +54,27 @@ func (c *Conn) readLoop() error {
 	reader := bufio.NewReaderSize(c.socket, 65536)
 
 	for {
-		// Set read/write deadlines so we can close dangling connections
-		c.socket.SetDeadline(time.Now().Add(time.Second * 120))
+		// Set read/write deadlines so we can close dangling connections. The client is disconnected if no
+		// packet is received within one and a half times the keepalive, unless the keepalive is disabled.
+		if c.keepalive == 0 {
+			c.socket.SetDeadline(time.Time{})
+		} else {
+			c.socket.SetDeadline(time.Now().Add(c.keepalive * 3 / 2))
+		}
 
 		// Decode an incoming packet
 		pkt, err := lp.ReadPacket(c.proto, reader)
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.ConnLogger.Info().Str("context", "conn.readLoop").Int64("connid", int64(c.connid)).Msg("keepalive expired")
+			}
+			if err == lp.ErrMalformedPacket {
+				log.ConnLogger.Info().Str("context", "conn.readLoop").Int64("connid", int64(c.connid)).Msg("malformed packet")
+				// The MQTT 5 client is notified with the reason malformed packet, the data following
+				// the malformed packet is discarded until the disconnect is written.
+				c.disconnect(0x81)
+				io.Copy(ioutil.Discard, reader)
+			}
 			return err
 		}
 
@@ -66,16 +104,68 @@ func (c *Conn) handler(pkt lp.Packet) error {
 		packet := *pkt.(*lp.Connect)
 
 		c.insecure = packet.InsecureFlag
+		c.mqttTopics = c.service.mqttTopics(c.listener, packet.Properties)
+		c.version = packet.Version
 		c.username = string(packet.Username)
-		clientid, err := c.onConnect(packet.ClientID)
+		c.keepalive = c.service.keepAlive(packet.KeepAlive)
+		contract, err := c.onAuth(packet)
+		if err != nil {
+			status = err.Status
+			return c.refuse(0x04, err) // Bad user name or password
+		}
+
+		// Copy the client Id to identify the session as the client Id is decoded in place.
+		sessionID := append([]byte(nil), packet.ClientID...)
+		clientid, err := c.onConnect(packet.ClientID, contract)
 		if err != nil {
 			status = err.Status
 			c.notifyError(err, 0)
-			c.sendClientID(clientid.Encode(c.service.MAC))
+			if clientid == nil {
+				return c.refuse(0x05, err) // Unauthorized
+			}
+			c.sendClientID(clientid.Encode(c.service.Keyring))
 			returnCode = 0x05 // Unauthorized
 		}
 
 		c.clientid = clientid
+
+		// Refuse the insecure flag if it is not allowed by the server policy.
+		if c.insecure && !c.service.allowInsecure(c.listener, clientid.Contract()) {
+			status = types.ErrForbidden.Status
+			log.ConnLogger.Warn().Str("context", "conn.audit").Int64("connid", int64(c.connid)).Str("listener", c.listener).Uint32("contract", clientid.Contract()).Str("username", c.username).Str("remote", c.socket.RemoteAddr().String()).Msg("insecure connect refused")
+			return c.refuse(0x05, types.ErrForbidden) // Not authorized
+		}
+
+		// Close the existing connection of the client to move the session state to this connection, the session
+		// is identified by the client Id provided by the client.
+		if returnCode == 0x00 && len(sessionID) > 0 {
+			c.sessid = hash.WithSalt(sessionID, c.clientid.Contract())
+			c.sessionExpiry = c.service.sessionExpiry(packet)
+			c.takeover(packet.CleanSessFlag)
+		}
+
+		// Refuse the connection if the contract has the maximum connections of its quota. The connection
+		// taken over is closed and no longer counted against the quota.
+		quota := c.service.quotas.get(clientid.Contract())
+		if !quota.connect() {
+			status = types.ErrTooManyRequests.Status
+			return c.refuse(0x03, types.ErrTooManyRequests) // Server unavailable
+		}
+		c.quota = quota
+
+		// Store the will message, it is published if the connection is closed without a disconnect.
+		if returnCode == 0x00 && packet.WillFlag {
+			var err *types.Error
+			if packet.WillTopic, err = c.internalTopic(packet.WillTopic); err == nil {
+				err = c.onWill(packet)
+			}
+			if err != nil {
+				status = err.Status
+				c.notifyError(err, 0)
+				returnCode = 0x05 // Unauthorized
+			}
+		}
+
 		c.MessageIds.Reset(message.MID(c.connid))
 		// Take care of any messages in the store
 		if !packet.CleanSessFlag {
@@ -83,11 +173,29 @@ func (c *Conn) handler(pkt lp.Packet) error {
 		} else {
 			// contract is used as blockId and key prefix
 			store.Log.Reset(c.clientid.Contract())
+			store.Log.ResetInbound(c.clientid.Contract(), c.inboundSession(sessionID))
+		}
+
+		// Restore the persistent session taken over.
+		var sessionPresent bool
+		if returnCode == 0x00 && c.sessid != 0 {
+			if packet.CleanSessFlag {
+				c.cleanSession()
+			} else {
+				sessionPresent = c.restoreSession()
+			}
 		}
+
 		// Write the ack
-		connack := &lp.Connack{ReturnCode: returnCode, ConnID: uint32(c.connid)}
+		connack := &lp.Connack{ReturnCode: returnCode, ConnID: uint32(c.connid), SessionPresent: sessionPresent}
+		connack.Properties.ServerKeepAlive = c.serverKeepAlive(packet.KeepAlive)
 		c.send <- connack
 
+		// Deliver the messages queued while the client was offline.
+		if sessionPresent {
+			c.resumeSession()
+		}
+
 	// An attempt to subscribe to a topic.
 	case lp.SUBSCRIBE:
 		packet := *pkt.(*lp.Subscribe)
@@ -96,9 +204,18 @@ func (c *Conn) handler(pkt lp.Packet) error {
 			Qos:       make([]uint8, 0, len(packet.Subscriptions)),
 		}
 
+		// Translate the MQTT-standard topics, the packet is forwarded to the cluster with the translated topics.
+		subs := packet.Subscriptions
+		translated, errs := c.internalTopics(subs)
+		packet.Subscriptions = translated
+
 		// Subscribe for each subscription
-		for _, sub := range packet.Subscriptions {
-			if err := c.onSubscribe(packet, sub.Topic); err != nil {
+		for i, sub := range subs {
+			err := errs[i]
+			if err == nil {
+				err = c.onSubscribe(packet, sub)
+			}
+			if err != nil {
 				status = err.Status
 				ack.Qos = append(ack.Qos, 0x80) // 0x80 indicate subscription failure
 				c.notifyError(err, packet.MessageID)
@@ -117,14 +234,29 @@ func (c *Conn) handler(pkt lp.Packet) error {
 	// An attempt to unsubscribe from a topic.
 	case lp.UNSUBSCRIBE:
 		packet := *pkt.(*lp.Unsubscribe)
-		ack := &lp.Unsuback{MessageID: packet.MessageID}
+		ack := &lp.Unsuback{
+			MessageID:   packet.MessageID,
+			ReasonCodes: make([]uint8, 0, len(packet.Subscriptions)),
+		}
+
+		// Translate the MQTT-standard topics, the packet is forwarded to the cluster with the translated topics.
+		subs := packet.Subscriptions
+		translated, errs := c.internalTopics(subs)
+		packet.Subscriptions = translated
 
 		// Unsubscribe from each subscription
-		for _, sub := range packet.Subscriptions {
-			if err := c.onUnsubscribe(packet, sub.Topic); err != nil {
+		for i, sub := range subs {
+			err := errs[i]
+			if err == nil {
+				err = c.onUnsubscribe(packet, sub.Topic)
+			}
+			if err != nil {
 				status = err.Status
+				ack.ReasonCodes = append(ack.ReasonCodes, 0x80) // 0x80 indicate unsubscribe failure
 				c.notifyError(err, packet.MessageID)
+				continue
 			}
+			ack.ReasonCodes = append(ack.ReasonCodes, 0x00)
 		}
 
 		c.send <- ack
@@ -135,16 +267,34 @@ func (c *Conn) handler(pkt lp.Packet) error {
 		c.send <- resp
 
 	case lp.DISCONNECT:
+		// Discard the will message on a clean disconnect.
+		c.will = nil
 
 	case lp.PUBLISH:
 		packet := *pkt.(*lp.Publish)
-		if err := c.onPublish(packet, packet.MessageID, packet.Topic, packet.Payload); err != nil {
+		// The QoS 2 message is delivered once, a duplicate received before the message is released is only acknowledged.
+		if packet.Qos == 2 && !store.Log.Received(c.clientid.Contract(), c.inboundSession(nil), packet.MessageID) {
+			c.ack(packet)
+			break
+		}
+		topic, err := c.internalTopic(packet.Topic)
+		if err == nil {
+			packet.Topic = topic
+			err = c.onPublish(packet, packet.MessageID, packet.Topic, packet.Payload)
+		}
+		if err != nil {
 			status = err.Status
 			c.notifyError(err, packet.MessageID)
+			// The message is not acknowledged, the client resends the message.
+			if packet.Qos == 2 {
+				store.Log.Released(c.clientid.Contract(), c.inboundSession(nil), packet.MessageID)
+			}
 		}
 
 	case lp.PUBREC:
 		packet := *pkt.(*lp.Pubrec)
+		// The publish is received by the client, it is not resent.
+		c.MessageIds.Release(c.inboundID(packet.MessageID))
 		pubrel := &lp.Pubrel{
 			FixedHeader: lp.FixedHeader{
 				Qos: packet.Qos,
@@ -158,10 +308,13 @@ func (c *Conn) handler(pkt lp.Packet) error {
 		c.storeOutbound(pkt)
 
 		packet := *pkt.(*lp.Pubrel)
+		store.Log.Released(c.clientid.Contract(), c.inboundSession(nil), packet.MessageID)
 		pubcomp := &lp.Pubcomp{MessageID: packet.MessageID}
 		c.send <- pubcomp
 
-	case lp.PUBCOMP:
+	case lp.PUBACK, lp.PUBCOMP:
+		c.MessageIds.FreeID(c.inboundID(pkt.Info().MessageID))
+		c.acked()
 	}
 
 	return nil
@@ -172,12 +325,17 @@ func (c *Conn) writeLoop(ctx context.Context) {
 	c.closeW.Add(1)
 	defer c.closeW.Done()
 
+	retry := time.NewTicker(c.service.retryInterval())
+	defer retry.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-c.closeC:
 			return
+		case <-retry.C:
+			c.retry()
 		case msg, ok := <-c.pub:
 			if !ok {
 				// Channel closed.
@@ -200,78 +358,284 @@ func (c *Conn) writeLoop(ctx context.Context) {
 				return
 			}
 			c.socket.Write(m.Bytes())
+		case reasonCode := <-c.disconnectC:
+			if m, err := lp.Encode(c.proto, &lp.Disconnect{ReasonCode: reasonCode}); err == nil {
+				c.socket.Write(m.Bytes())
+			}
+			c.socket.Close()
+			return
+		}
+	}
+}
+
+// disconnect closes the connection, the MQTT 5 client is notified with the reason code. The disconnect
+// is written by the write loop so that it is not interleaved with the packets being written.
+func (c *Conn) disconnect(reasonCode uint8) {
+	if c.version != 5 {
+		c.socket.Close()
+		return
+	}
+	select {
+	case c.disconnectC <- reasonCode:
+		// The connection is closed even if the write loop has stopped.
+		time.AfterFunc(disconnectTimeout, func() { c.socket.Close() })
+	default:
+		// The disconnect is already pending.
+	}
+}
+
+// retry resends the messages not acknowledged within the retry interval with the dup flag set.
+func (c *Conn) retry() {
+	msgs, dropped := c.MessageIds.Retry(c.service.retryInterval(), c.service.config.MaxRetryAttempts)
+	for i := 0; i < dropped; i++ {
+		c.acked()
+	}
+	if dropped > 0 {
+		log.ConnLogger.Info().Str("context", "conn.retry").Int64("connid", int64(c.connid)).Int("dropped", dropped).Msg("max retry attempts reached")
+	}
+	for _, msg := range msgs {
+		pub := &lp.Publish{
+			FixedHeader: lp.FixedHeader{
+				Dup:    true,
+				Qos:    msg.Qos,
+				Retain: msg.Retain,
+			},
+			MessageID: msg.MessageID,
+			Topic:     msg.Topic,
+			Payload:   msg.Payload,
+		}
+		if msg.Properties != nil {
+			pub.Properties = *msg.Properties
 		}
+		m, err := lp.Encode(c.proto, pub)
+		if err != nil {
+			log.Error("conn.retry", err.Error())
+			continue
+		}
+		c.socket.Write(m.Bytes())
+	}
+}
+
+// serverKeepAlive returns the keepalive of the connection in seconds to inform the MQTT 5 client of the
+// keepalive clamped by the server, nil if the keepalive requested by the client is used.
+func (c *Conn) serverKeepAlive(requested uint16) *uint16 {
+	if c.version != 5 || c.keepalive == time.Duration(requested)*time.Second {
+		return nil
 	}
+	keepalive := uint16(c.keepalive / time.Second)
+	return &keepalive
 }
 
-// onConnect is a handler for Connect events.
-func (c *Conn) onConnect(clientID []byte) (uid.ID, *types.Error) {
+// refuse writes a connack with the return code to refuse the connection. It returns
+// the error so the connection is closed once the connack is written.
+func (c *Conn) refuse(returnCode uint8, err *types.Error) error {
+	connack := &lp.Connack{ReturnCode: returnCode, ConnID: uint32(c.connid)}
+	m, encErr := lp.Encode(c.proto, connack)
+	if encErr != nil {
+		log.Error("conn.refuse", encErr.Error())
+		return err
+	}
+	c.socket.Write(m.Bytes())
+	return err
+}
+
+// onAuth authenticates the username and password provided during connect. It returns the
+// contract the user is mapped to, or zero if the user is not mapped to a contract.
+func (c *Conn) onAuth(pkt lp.Connect) (uint32, *types.Error) {
+	if c.service.auth == nil {
+		return 0, nil
+	}
+
+	contract, err := c.service.auth.Authenticate(pkt.Username, pkt.Password)
+	if err != nil {
+		log.ConnLogger.Info().Str("context", "conn.onAuth").Int64("connid", int64(c.connid)).Str("username", string(pkt.Username)).Msg(err.Error())
+		return 0, types.ErrBadToken
+	}
+	return contract, nil
+}
+
+// onConnect is a handler for Connect events. The contract is the contract the user is mapped
+// to during authentication, the client Id must belong to the contract if it is not zero.
+func (c *Conn) onConnect(clientID []byte, contract uint32) (uid.ID, *types.Error) {
 	start := time.Now()
 	defer log.ErrLogger.Debug().Str("context", "conn.onConnect").Int64("duration", time.Since(start).Nanoseconds()).Msg("")
 	var clientid = uid.ID{}
-	if clientID != nil && len(clientID) > c.service.MAC.Overhead() {
-		if contract, ok := c.service.cache.Load(crypto.SignatureToUint32(clientID[crypto.EpochSize:crypto.MessageOffset])); ok {
-			clientid, err := uid.CachedClientID(contract.(uint32))
-			if err != nil {
+	if clientID != nil && len(clientID) > c.service.Keyring.Overhead() {
+		if cached, ok := c.service.cache.Load(crypto.SignatureToUint32(clientID[crypto.EpochSize:crypto.MessageOffset])); ok {
+			clientid := append(uid.ID(nil), cached.(uid.ID)...)
+			if contract != 0 && contract != clientid.Contract() {
 				return nil, types.ErrUnauthorized
 			}
+			if c.service.revokedIDs.revoked(clientid.Contract(), clientid) {
+				return nil, types.ErrClientIdRevoked
+			}
 			return clientid, nil
 		}
 	}
 
-	clientid, err := uid.Decode(clientID, c.service.MAC)
+	clientid, err := uid.Decode(clientID, c.service.Keyring)
 
 	if err != nil {
 		clientid, err = uid.NewClientID(1)
 		if err != nil {
 			return nil, types.ErrUnauthorized
 		}
+		// Assign the contract the user is mapped to.
+		if contract != 0 {
+			clientid.SetContract(contract)
+		}
 
 		return clientid, types.ErrInvalidClientId
 	}
 
+	if contract != 0 && contract != clientid.Contract() {
+		return nil, types.ErrUnauthorized
+	}
+
 	//do not cache primary client Id
 	if !clientid.IsPrimary() {
-		cid := []byte(clientid.Encode(c.service.MAC))
-		c.service.cache.LoadOrStore(crypto.SignatureToUint32(cid[crypto.EpochSize:crypto.MessageOffset]), clientid.Contract())
+		// The revoked client Ids are checked decoded as the client Id is accepted in more than one encoding.
+		if c.service.revokedIDs.revoked(clientid.Contract(), clientid) {
+			return nil, types.ErrClientIdRevoked
+		}
+		cid := []byte(clientid.Encode(c.service.Keyring))
+		c.service.cache.LoadOrStore(crypto.SignatureToUint32(cid[crypto.EpochSize:crypto.MessageOffset]), append(uid.ID(nil), clientid...))
 	}
 
 	return clientid, nil
 }
 
+// onWill is a handler for the will message provided with the Connect.
+func (c *Conn) onWill(pkt lp.Connect) *types.Error {
+	if len(pkt.WillTopic) == 0 {
+		return types.ErrBadRequest
+	}
+
+	//Parse the key
+	topic := security.ParseKey(pkt.WillTopic)
+	if topic.TopicType == security.TopicInvalid {
+		return types.ErrBadRequest
+	}
+
+	if !c.insecure {
+		wildcard, err := c.onSecureRequest(topic)
+		if err != nil {
+			return err
+		}
+		if wildcard {
+			return types.ErrForbidden
+		}
+	}
+
+	c.will = &lp.Publish{
+		FixedHeader: lp.FixedHeader{
+			Qos:    pkt.WillQOS,
+			Retain: pkt.WillRetainFlag,
+		},
+		Topic:      pkt.WillTopic,
+		Payload:    pkt.WillMessage,
+		Properties: pkt.WillProperties,
+	}
+	return nil
+}
+
 // onSubscribe is a handler for Subscribe events.
-func (c *Conn) onSubscribe(pkt lp.Subscribe, msgTopic []byte) *types.Error {
+func (c *Conn) onSubscribe(pkt lp.Subscribe, sub lp.TopicQOSTuple) *types.Error {
 	start := time.Now()
 	defer log.ErrLogger.Debug().Str("context", "conn.onSubscribe").Int64("duration", time.Since(start).Nanoseconds()).Msg("")
 
+	msgTopic, qos, options := sub.Topic, sub.Qos, subOptions(sub)
+
+	// Parse the shared subscription group, only this subscription is forwarded to the owner of a shared subscription.
+	group, keyTopic, ok := message.SplitShare(msgTopic)
+	if !ok {
+		return types.ErrBadRequest
+	}
+	if group != nil {
+		pkt.Subscriptions = []lp.TopicQOSTuple{sub}
+	}
+
 	//Parse the key
-	topic := security.ParseKey(msgTopic)
+	topic := security.ParseKey(keyTopic)
 	if topic.TopicType == security.TopicInvalid {
 		return types.ErrBadRequest
 	}
 
+	// Check whether the key is 'unitd' which means it's a presence subscription
+	if len(topic.Key) == 5 && string(topic.Key) == "unitd" {
+		if group != nil {
+			return types.ErrBadRequest
+		}
+		pkt.Subscriptions = []lp.TopicQOSTuple{sub}
+		return c.onPresenceSubscribe(pkt, msgTopic, topic)
+	}
+
+	// The history requested with the topic options requires the history permission.
+	since, until, limit, history := topic.Last()
 	if !c.insecure {
-		if _, err := c.onSecureRequest(topic); err != nil {
+		required := security.AllowRead
+		if history {
+			required |= security.AllowHistory
+		}
+		if _, err := c.authorize(topic, required); err != nil {
 			return err
 		}
 	}
 
+	// Check the subscriptions quota of the contract.
+	if !c.quota.allowSubscribe() {
+		return types.ErrTooManyRequests
+	}
+
 	// persist outbound
 	c.storeOutbound(&pkt)
 
-	c.subscribe(pkt, topic)
+	// The live messages are held until the history is replayed, the retained messages are not delivered to the shared subscriptions.
+	replay := history && group == nil
+	if replay {
+		c.startReplay(topic.Topic[:topic.Size])
+	}
+	exists := c.subs.Exist(string(topic.Key))
+	if err := c.subscribe(pkt, topic, qos, options, group); err != nil {
+		if replay {
+			c.endReplay(topic.Topic[:topic.Size], nil, qos)
+		}
+		if err, ok := err.(*types.Error); ok {
+			return err
+		}
+		return types.ErrServerError
+	}
+
+	// Retained messages are not delivered to the shared subscriptions.
+	if group != nil {
+		return nil
+	}
+
+	// Replay the history requested with the topic options, the retained messages are delivered otherwise.
+	if replay {
+		msgs, err := store.Message.Get(c.clientid.Contract(), topic.Topic[:topic.Size], since, until, limit)
+		if err != nil {
+			c.endReplay(topic.Topic[:topic.Size], nil, qos)
+			log.Error("conn.OnSubscribe", "query history messages"+err.Error())
+			return types.ErrServerError
+		}
+		c.endReplay(topic.Topic[:topic.Size], msgs, qos)
+		return nil
+	}
 
-	// if t0, t1, limit, ok := topic.Last(); ok {
-	msgs, err := store.Message.Get(c.clientid.Contract(), topic.Topic)
+	// The MQTT 5 client requests the retained messages only for a new subscription or no retained messages.
+	if sub.RetainHandling == 2 || (sub.RetainHandling == 1 && exists) {
+		return nil
+	}
+	msgs, err := store.Retained.Get(c.clientid.Contract(), topic.Topic[:topic.Size])
 	if err != nil {
-		log.Error("conn.OnSubscribe", "query last messages"+err.Error())
+		log.Error("conn.OnSubscribe", "query retained messages"+err.Error())
 		return types.ErrServerError
 	}
 
-	// Range over the messages in the channel and forward them
-	for _, m := range msgs {
-		msg := m // Copy message
-		c.SendMessage(&msg)
+	// Range over the messages and forward them
+	for i := range msgs {
+		c.deliver(&msgs[i], qos)
 	}
 
 	return nil
@@ -284,12 +648,27 @@ func (c *Conn) onUnsubscribe(pkt lp.Unsubscribe, msgTopic []byte) *types.Error {
 	start := time.Now()
 	defer log.ErrLogger.Debug().Str("context", "conn.onUnsubscribe").Int64("duration", time.Since(start).Nanoseconds()).Msg("")
 
+	// Parse the shared subscription group
+	group, keyTopic, ok := message.SplitShare(msgTopic)
+	if !ok {
+		return types.ErrBadRequest
+	}
+	if group != nil {
+		pkt.Subscriptions = []lp.TopicQOSTuple{{Topic: msgTopic}}
+	}
+
 	//Parse the key
-	topic := security.ParseKey(msgTopic)
+	topic := security.ParseKey(keyTopic)
 	if topic.TopicType == security.TopicInvalid {
 		return types.ErrBadRequest
 	}
 
+	// Check whether the key is 'unitd' which means it's a presence subscription
+	if len(topic.Key) == 5 && string(topic.Key) == "unitd" {
+		pkt.Subscriptions = []lp.TopicQOSTuple{{Topic: msgTopic}}
+		return c.onPresenceUnsubscribe(pkt, topic)
+	}
+
 	if !c.insecure {
 		if _, err := c.onSecureRequest(topic); err != nil {
 			return err
@@ -299,7 +678,7 @@ func (c *Conn) onUnsubscribe(pkt lp.Unsubscribe, msgTopic []byte) *types.Error {
 	// persist outbound
 	c.storeOutbound(&pkt)
 
-	c.unsubscribe(pkt, topic)
+	c.unsubscribe(pkt, topic, group)
 
 	return nil
 }
@@ -315,6 +694,11 @@ func (c *Conn) onPublish(pkt lp.Publish, messageID uint16, msgTopic []byte, payl
 		return types.ErrBadRequest
 	}
 
+	// Check the publish rate of the contract, the API requests are also rate limited.
+	if !c.quota.publish(len(payload)) {
+		return types.ErrTooManyRequests
+	}
+
 	// Check whether the key is 'unitd' which means it's an API request
 	if len(topic.Key) == 5 && string(topic.Key) == "unitd" {
 		c.onUnitdRequest(topic, payload)
@@ -331,17 +715,37 @@ func (c *Conn) onPublish(pkt lp.Publish, messageID uint16, msgTopic []byte, payl
 		}
 	}
 
-	err := store.Message.Put(c.clientid.Contract(), topic.Topic, payload)
+	// Check the stored bytes quota of the contract, the payload of a message without ttl is released
+	// from the quota after the maximum message ttl.
+	ttl := c.service.messageTTL(topic, pkt.Properties)
+	storedTTL := ttl
+	if storedTTL == 0 {
+		storedTTL = c.service.maxMessageTTL()
+	}
+	if !c.quota.store(len(payload), storedTTL) {
+		return types.ErrTooManyRequests
+	}
+	published := time.Now()
+	props := publishProperties(pkt.Properties)
+	err := store.Message.Put(c.clientid.Contract(), topic.Topic[:topic.Size], pkt.Qos, payload, props, ttl, published)
 	if err != nil {
 		log.Error("conn.onPublish", "store message "+err.Error())
 		return types.ErrServerError
 	}
 
+	// Retain the message, an empty payload clears the retained message for the topic.
+	if pkt.Retain {
+		if err := store.Retained.Put(c.clientid.Contract(), topic.Topic[:topic.Size], pkt.Qos, payload, props); err != nil {
+			log.Error("conn.onPublish", "retain message "+err.Error())
+			return types.ErrServerError
+		}
+	}
+
 	// persist outbound
 	c.storeOutbound(&pkt)
 
 	// Iterate through all subscribers and send them the message
-	c.publish(pkt, messageID, topic, payload)
+	c.publish(pkt, topic, payload, published)
 
 	// acknowledge a packet
 	return c.ack(pkt)
@@ -369,6 +773,18 @@ func (c *Conn) ack(pkt lp.Publish) *types.Error {
 	return nil
 }
 
+// inboundSession returns the session to record the inbound QoS 2 messages. The messages of a client
+// connected with a client Id are recorded for the client Id so duplicates are detected across reconnects.
+func (c *Conn) inboundSession(clientID []byte) uint32 {
+	switch {
+	case c.sessid != 0:
+		return c.sessid
+	case len(clientID) > 0:
+		return hash.WithSalt(clientID, c.clientid.Contract())
+	}
+	return uint32(c.connid)
+}
+
 // Load all stored messages and resend them to ensure QOS > 1,2 even after an application crash.
 func (c *Conn) resume() {
 	// contract is used as blockId and key prefix
@@ -400,14 +816,27 @@ func (c *Conn) resume() {
 }
 
 func (c *Conn) onSecureRequest(topic *security.Topic) (bool, *types.Error) {
+	return c.authorize(topic, security.AllowRead)
+}
+
+// authorize checks whether the key of the topic has the permission for the topic.
+func (c *Conn) authorize(topic *security.Topic, permission uint32) (bool, *types.Error) {
 	// Attempt to decode the key
 	key, err := security.DecodeKey(topic.Key)
+	if err == security.ErrKeyExpired {
+		return false, types.ErrKeyExpired
+	}
 	if err != nil {
 		return false, types.ErrBadRequest
 	}
 
-	// Check if the key has the permission to read the topic
-	if !key.HasPermission(security.AllowRead) {
+	// Check if the key has been revoked
+	if c.service.revoked.revoked(c.clientid.Contract(), topic.Key) {
+		return false, types.ErrKeyRevoked
+	}
+
+	// Check if the key has the permission required
+	if !key.HasPermission(permission) {
 		return false, types.ErrUnauthorized
 	}
 
@@ -441,9 +870,21 @@ func (c *Conn) onUnitdRequest(topic *security.Topic, payload []byte) (ok bool) {
 	case requestClientId:
 		resp, ok = c.onClientIdRequest()
 		return
+	case requestClientIdList:
+		resp, ok = c.onClientIdList()
+		return
+	case requestClientIdRevoke:
+		resp, ok = c.onClientIdRevoke(payload)
+		return
 	case requestKeygen:
 		resp, ok = c.onKeyGen(payload)
 		return
+	case requestPresence:
+		resp, ok = c.onPresenceQuery(payload)
+		return
+	case requestRevoke:
+		resp, ok = c.onKeyRevoke(payload)
+		return
 	default:
 		return
 	}
@@ -459,7 +900,11 @@ func (c *Conn) onClientIdRequest() (interface{}, bool) {
 	if err != nil {
 		return types.ErrBadRequest, false
 	}
-	cid := clientid.Encode(c.service.MAC)
+	cid := clientid.Encode(c.service.Keyring)
+	if err := store.ClientId.Put(c.clientid.Contract(), clientid, []byte(cid)); err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.onClientIdRequest").Int64("connid", int64(c.connid)).Msg("unable to record client Id")
+		return types.ErrServerError, false
+	}
 	return &types.ClientIdResponse{
 		Status:   200,
 		ClientId: cid,
@@ -467,6 +912,61 @@ func (c *Conn) onClientIdRequest() (interface{}, bool) {
 
 }
 
+// onClientIdList is a handler that returns the secondary client Ids of the contract.
+func (c *Conn) onClientIdList() (interface{}, bool) {
+	if !c.clientid.IsPrimary() {
+		return types.ErrClientIdForbidden, false
+	}
+
+	clientIDs, err := store.ClientId.Get(c.clientid.Contract())
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.onClientIdList").Int64("connid", int64(c.connid)).Msg("unable to list client Ids")
+		return types.ErrServerError, false
+	}
+	cids := make([]string, 0, len(clientIDs))
+	for _, cid := range clientIDs {
+		cids = append(cids, string(cid))
+	}
+	return &types.ClientIdListResponse{
+		Status:    200,
+		ClientIds: cids,
+	}, true
+}
+
+// onClientIdRevoke is a handler that revokes the secondary client Id of the contract.
+func (c *Conn) onClientIdRevoke(payload []byte) (interface{}, bool) {
+	if !c.clientid.IsPrimary() {
+		return types.ErrClientIdForbidden, false
+	}
+
+	// Deserialize the payload.
+	msg := types.ClientIdRevokeRequest{}
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.ClientId == "" {
+		return types.ErrBadRequest, false
+	}
+
+	// The client Id is decoded in place.
+	id, err := uid.Decode([]byte(msg.ClientId), c.service.Keyring)
+	if err != nil || id.Contract() != c.clientid.Contract() {
+		return types.ErrNotFound, false
+	}
+	ok, err := c.service.revokeClientID(c.clientid.Contract(), id)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.onClientIdRevoke").Int64("connid", int64(c.connid)).Msg("unable to revoke client Id")
+		return types.ErrServerError, false
+	}
+	if !ok {
+		return types.ErrNotFound, false
+	}
+	Globals.Cluster.revokeClientID(c, id)
+
+	// Success, return the response
+	return &types.ClientIdRevokeResponse{
+		Status:   200,
+		ClientId: msg.ClientId,
+	}, true
+}
+
 // onKeyGen processes a keygen request.
 func (c *Conn) onKeyGen(payload []byte) (interface{}, bool) {
 	// Deserialize the payload.
@@ -475,12 +975,45 @@ func (c *Conn) onKeyGen(payload []byte) (interface{}, bool) {
 		return types.ErrBadRequest, false
 	}
 
+	// The key expires after the ttl requested.
+	var notAfter time.Time
+	if msg.TTL != "" {
+		ttl, err := time.ParseDuration(msg.TTL)
+		if err != nil || ttl <= 0 {
+			return types.ErrBadRequest, false
+		}
+		notAfter = time.Now().Add(ttl)
+	}
+
+	// The parent key must be valid and not revoked.
+	var parent security.Key
+	if msg.Key != "" {
+		key, err := security.DecodeKey([]byte(msg.Key))
+		if err == security.ErrKeyExpired {
+			return types.ErrKeyExpired, false
+		}
+		if err != nil {
+			return types.ErrBadRequest, false
+		}
+		if c.service.revoked.revoked(c.clientid.Contract(), []byte(msg.Key)) {
+			return types.ErrKeyRevoked, false
+		}
+		parent = key
+	} else if !c.clientid.IsPrimary() {
+		// Only the primary client Id generates a key without the parent key, others extend a parent key.
+		return types.ErrExtendForbidden, false
+	}
+
 	// Use the cipher to generate the key
-	key, err := security.GenerateKey(c.clientid.Contract(), []byte(msg.Topic), msg.Access())
+	key, err := security.GenerateKey(c.clientid.Contract(), []byte(msg.Topic), msg.Access(), notAfter, parent)
 	if err != nil {
 		switch err {
 		case security.ErrTargetTooLong:
 			return types.ErrTargetTooLong, false
+		case security.ErrKeyExpired:
+			return types.ErrKeyExpired, false
+		case security.ErrNotExtendable, security.ErrNotSubTopic, security.ErrNotGranted:
+			return types.ErrExtendForbidden, false
 		default:
 			return types.ErrServerError, false
 		}
@@ -493,3 +1026,34 @@ func (c *Conn) onKeyGen(payload []byte) (interface{}, bool) {
 		Topic:  msg.Topic,
 	}, true
 }
+
+// onKeyRevoke processes a key revocation request.
+func (c *Conn) onKeyRevoke(payload []byte) (interface{}, bool) {
+	if !c.clientid.IsPrimary() {
+		return types.ErrRevokeForbidden, false
+	}
+
+	// Deserialize the payload.
+	msg := types.KeyRevokeRequest{}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return types.ErrBadRequest, false
+	}
+
+	// An expired key is not required to be revoked.
+	key := []byte(msg.Key)
+	if _, err := security.DecodeKey(key); err != nil && err != security.ErrKeyExpired {
+		return types.ErrBadRequest, false
+	}
+
+	if err := c.service.revokeKey(c.clientid.Contract(), key); err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.onKeyRevoke").Int64("connid", int64(c.connid)).Msg("unable to revoke key")
+		return types.ErrServerError, false
+	}
+	Globals.Cluster.revoke(c, key)
+
+	// Success, return the response
+	return &types.KeyRevokeResponse{
+		Status: 200,
+		Key:    msg.Key,
+	}, true
+}
@@ -0,0 +1,254 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	lp "github.com/unit-io/unitd/lineprotocol"
+	"github.com/unit-io/unitd/message"
+	"github.com/unit-io/unitd/message/security"
+	"github.com/unit-io/unitd/pkg/log"
+	"github.com/unit-io/unitd/pkg/uid"
+	"github.com/unit-io/unitd/store"
+	"github.com/unit-io/unitd/types"
+)
+
+// Presence events sent to the presence subscribers of a topic.
+const (
+	presenceJoin   = "join"   // A connection subscribed to the topic.
+	presenceLeave  = "leave"  // A connection unsubscribed from the topic or the connection is closed.
+	presenceStatus = "status" // The current subscribers of the topic, sent when the presence is subscribed.
+)
+
+// presencePrefix is the prefix of the presence subscription "unitd/presence/<key>/<topic>".
+var presencePrefix = []byte("presence/")
+
+// presence holds the connections subscribed to the presence events of the topics.
+type presence struct {
+	sync.Mutex
+	subs map[string]map[*Conn][]byte // The presence subscribers by contract and topic, and the topic the events are sent to.
+}
+
+func newPresence() *presence {
+	return &presence{
+		subs: make(map[string]map[*Conn][]byte),
+	}
+}
+
+func presenceKey(contract uint32, topic []byte) string {
+	return strconv.FormatUint(uint64(contract), 10) + "/" + string(topic)
+}
+
+// subscribe adds the connection to the presence subscribers of the topic.
+func (p *presence) subscribe(contract uint32, topic []byte, conn *Conn, eventTopic []byte) {
+	p.Lock()
+	defer p.Unlock()
+	key := presenceKey(contract, topic)
+	if p.subs[key] == nil {
+		p.subs[key] = make(map[*Conn][]byte)
+	}
+	p.subs[key][conn] = eventTopic
+}
+
+// unsubscribe removes the connection from the presence subscribers of the topic.
+func (p *presence) unsubscribe(contract uint32, topic []byte, conn *Conn) {
+	p.Lock()
+	defer p.Unlock()
+	key := presenceKey(contract, topic)
+	delete(p.subs[key], conn)
+	if len(p.subs[key]) == 0 {
+		delete(p.subs, key)
+	}
+}
+
+// unsubscribeAll removes the connection from the presence subscribers of all topics.
+func (p *presence) unsubscribeAll(conn *Conn) {
+	p.Lock()
+	defer p.Unlock()
+	for key, subs := range p.subs {
+		delete(subs, conn)
+		if len(subs) == 0 {
+			delete(p.subs, key)
+		}
+	}
+}
+
+// subscribers returns the presence subscribers of the topic and the topic to send the events to.
+func (p *presence) subscribers(contract uint32, topic []byte) map[*Conn][]byte {
+	p.Lock()
+	defer p.Unlock()
+	subs := make(map[*Conn][]byte, len(p.subs[presenceKey(contract, topic)]))
+	for conn, eventTopic := range p.subs[presenceKey(contract, topic)] {
+		subs[conn] = eventTopic
+	}
+	return subs
+}
+
+// presenceTarget parses the topic of the presence subscription "presence/<key>/<topic>".
+func presenceTarget(api *security.Topic) (*security.Topic, bool) {
+	text := api.Topic[:api.Size]
+	if !bytes.HasPrefix(text, presencePrefix) {
+		return nil, false
+	}
+	target := security.ParseKey(text[len(presencePrefix):])
+	if target.TopicType == security.TopicInvalid || target.Size == 0 {
+		return nil, false
+	}
+	return target, true
+}
+
+// whoIs returns the connections subscribed to the topic on this node.
+func (s *Service) whoIs(contract uint32, topic []byte) []types.PresenceInfo {
+	subs, err := store.Subscription.Get(contract, topic)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "service.whoIs").Uint32("contract", contract).Msg("unable to get subscribers")
+	}
+	who := make([]types.PresenceInfo, 0, len(subs))
+	seen := make(map[uid.LID]bool, len(subs))
+	for _, sub := range subs {
+		if len(sub) < 5 || offline(sub) {
+			continue
+		}
+		lid := uid.LID(binary.LittleEndian.Uint32(sub[1:5]))
+		conn := Globals.ConnCache.Get(lid)
+		if conn == nil || seen[lid] {
+			continue
+		}
+		seen[lid] = true
+		who = append(who, presenceInfo(lid, conn.username))
+	}
+	return who
+}
+
+// whoIs returns the connections subscribed to the topic on this node and on the cluster nodes.
+func (c *Conn) whoIs(topic []byte) []types.PresenceInfo {
+	who := c.service.whoIs(c.clientid.Contract(), topic)
+	seen := make(map[string]bool, len(who))
+	for _, info := range who {
+		seen[info.ID] = true
+	}
+	for _, info := range Globals.Cluster.whoIs(c, topic) {
+		if !seen[info.ID] {
+			seen[info.ID] = true
+			who = append(who, info)
+		}
+	}
+	return who
+}
+
+func presenceInfo(connid uid.LID, username string) types.PresenceInfo {
+	return types.PresenceInfo{ID: strconv.FormatUint(uint64(connid), 10), Username: username}
+}
+
+// sendPresence sends the presence event to the connection.
+func (c *Conn) sendPresence(eventTopic []byte, event string, topic []byte, who []types.PresenceInfo) {
+	b, err := json.Marshal(&types.PresenceEvent{
+		Event: event,
+		Topic: string(topic),
+		Time:  time.Now().Unix(),
+		Who:   who,
+	})
+	if err != nil {
+		return
+	}
+	c.SendMessage(&message.Message{
+		Topic:   eventTopic,
+		Payload: b,
+	})
+}
+
+// notifyPresence sends the join or leave event of the connection to the presence subscribers of the topic.
+// The presence subscribers are on the node that owns the contract, so the event is forwarded to the owner node.
+func (c *Conn) notifyPresence(event string, topic []byte) {
+	if Globals.Cluster.isRemoteContract(contractKey(c.clientid.Contract())) {
+		if err := Globals.Cluster.notifyPresence(c, event, topic); err != nil {
+			log.ErrLogger.Err(err).Str("context", "conn.notifyPresence").Int64("connid", int64(c.connid)).Msg("unable to notify presence to remote node")
+		}
+		return
+	}
+	c.service.notifyPresence(c.clientid.Contract(), event, topic, presenceInfo(c.connid, c.username))
+}
+
+// notifyPresence sends the event of the connection to the presence subscribers of the topic on this node.
+func (s *Service) notifyPresence(contract uint32, event string, topic []byte, info types.PresenceInfo) {
+	who := []types.PresenceInfo{info}
+	for conn, eventTopic := range s.presence.subscribers(contract, topic) {
+		conn.sendPresence(eventTopic, event, topic, who)
+	}
+}
+
+// onPresenceSubscribe subscribes the connection to the presence events of the topic, the current
+// subscribers of the topic are sent to the connection as the status event. The subscription is
+// forwarded to the node that owns the contract.
+func (c *Conn) onPresenceSubscribe(pkt lp.Subscribe, msgTopic []byte, api *security.Topic) *types.Error {
+	target, ok := presenceTarget(api)
+	if !ok {
+		return types.ErrBadRequest
+	}
+	// The subscription forwarded by a cluster node is authorized on the node.
+	if !c.insecure && !pkt.IsForwarded {
+		if _, err := c.authorize(target, security.AllowPresence); err != nil {
+			return err
+		}
+	}
+	if !pkt.IsForwarded && Globals.Cluster.isRemoteContract(contractKey(c.clientid.Contract())) {
+		if err := Globals.Cluster.routeToContract(&pkt, api, message.SUBSCRIBE, &message.Message{}, c); err != nil {
+			log.ErrLogger.Err(err).Str("context", "conn.onPresenceSubscribe").Int64("connid", int64(c.connid)).Msg("unable to subscribe to remote presence")
+			return types.ErrServerError
+		}
+		return nil
+	}
+
+	topic := target.Topic[:target.Size]
+	c.service.presence.subscribe(c.clientid.Contract(), topic, c, msgTopic)
+	c.sendPresence(msgTopic, presenceStatus, topic, c.whoIs(topic))
+	return nil
+}
+
+// onPresenceUnsubscribe unsubscribes the connection from the presence events of the topic.
+func (c *Conn) onPresenceUnsubscribe(pkt lp.Unsubscribe, api *security.Topic) *types.Error {
+	target, ok := presenceTarget(api)
+	if !ok {
+		return types.ErrBadRequest
+	}
+	if !pkt.IsForwarded && Globals.Cluster.isRemoteContract(contractKey(c.clientid.Contract())) {
+		if err := Globals.Cluster.routeToContract(&pkt, api, message.UNSUBSCRIBE, &message.Message{}, c); err != nil {
+			log.ErrLogger.Err(err).Str("context", "conn.onPresenceUnsubscribe").Int64("connid", int64(c.connid)).Msg("unable to unsubscribe from remote presence")
+			return types.ErrServerError
+		}
+		return nil
+	}
+	c.service.presence.unsubscribe(c.clientid.Contract(), target.Topic[:target.Size], c)
+	return nil
+}
+
+// onPresenceQuery processes a presence request, it returns the current subscribers of the topic.
+func (c *Conn) onPresenceQuery(payload []byte) (interface{}, bool) {
+	// Deserialize the payload.
+	msg := types.PresenceRequest{}
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Topic == "" {
+		return types.ErrBadRequest, false
+	}
+
+	target := security.ParseKey([]byte(msg.Key + "/" + msg.Topic))
+	if target.TopicType == security.TopicInvalid {
+		return types.ErrBadRequest, false
+	}
+	if !c.insecure {
+		if _, err := c.authorize(target, security.AllowPresence); err != nil {
+			return err, false
+		}
+	}
+
+	// Success, return the response
+	topic := target.Topic[:target.Size]
+	return &types.PresenceResponse{
+		Status: 200,
+		Topic:  string(topic),
+		Who:    c.whoIs(topic),
+	}, true
+}
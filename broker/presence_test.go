@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/unit-io/unitd/message/security"
+	"github.com/unit-io/unitd/pkg/uid"
+	"github.com/unit-io/unitd/types"
+)
+
+func TestPresenceTarget(t *testing.T) {
+	target, ok := presenceTarget(security.ParseKey([]byte("unitd/presence/KEY/a.b")))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("KEY"), target.Key)
+	assert.Equal(t, []byte("a.b"), target.Topic[:target.Size])
+
+	target, ok = presenceTarget(security.ParseKey([]byte("unitd/presence/a.b")))
+	assert.True(t, ok)
+	assert.Nil(t, target.Key)
+	assert.Equal(t, []byte("a.b"), target.Topic[:target.Size])
+
+	_, ok = presenceTarget(security.ParseKey([]byte("unitd/keygen")))
+	assert.False(t, ok)
+}
+
+func TestPresenceSubscribers(t *testing.T) {
+	p := newPresence()
+	c1, c2 := &Conn{}, &Conn{}
+	p.subscribe(1, []byte("a.b"), c1, []byte("unitd/presence/KEY/a.b"))
+	p.subscribe(1, []byte("a.b"), c2, []byte("unitd/presence/a.b"))
+	p.subscribe(2, []byte("a.b"), c2, []byte("unitd/presence/a.b"))
+
+	subs := p.subscribers(1, []byte("a.b"))
+	assert.Equal(t, 2, len(subs))
+	assert.Equal(t, []byte("unitd/presence/KEY/a.b"), subs[c1])
+
+	p.unsubscribe(1, []byte("a.b"), c1)
+	assert.Equal(t, 1, len(p.subscribers(1, []byte("a.b"))))
+
+	p.unsubscribeAll(c2)
+	assert.Empty(t, p.subscribers(1, []byte("a.b")))
+	assert.Empty(t, p.subscribers(2, []byte("a.b")))
+	assert.Empty(t, p.subs)
+}
+
+func TestClusterPresence(t *testing.T) {
+	prev := Globals.Service
+	defer func() { Globals.Service = prev }()
+	Globals.Service = &Service{presence: newPresence()}
+	sub := newTestConn()
+	Globals.Service.presence.subscribe(1, []byte("a.b"), sub, []byte("unitd/presence/a.b"))
+
+	// The event of a connection on a remote node is sent to the presence subscribers on this node.
+	clientid, err := uid.NewClientID(1)
+	assert.NoError(t, err)
+	clientid.SetContract(1)
+	req := &ClusterReq{
+		PresenceEvent: presenceJoin,
+		PresenceTopic: []byte("a.b"),
+		Conn:          &ClusterSess{ConnID: 7, ClientID: clientid, Username: "bob"},
+	}
+	var unused bool
+	assert.NoError(t, (&Cluster{}).Presence(req, &unused))
+
+	pub := <-sub.pub
+	assert.Equal(t, []byte("unitd/presence/a.b"), pub.Topic)
+	event := types.PresenceEvent{}
+	assert.NoError(t, json.Unmarshal(pub.Payload, &event))
+	assert.Equal(t, presenceJoin, event.Event)
+	assert.Equal(t, "a.b", event.Topic)
+	assert.Equal(t, []types.PresenceInfo{{ID: "7", Username: "bob"}}, event.Who)
+}
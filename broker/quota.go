@@ -0,0 +1,395 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitd/config"
+	"github.com/unit-io/unitd/pkg/log"
+	"github.com/unit-io/unitd/pkg/metrics"
+	"github.com/unit-io/unitd/store"
+)
+
+// bucket is a token bucket to limit the rate, the bucket holds up to one second of tokens.
+type bucket struct {
+	rate   float64 // Tokens added per second, zero means the rate is not limited.
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int, now time.Time) bucket {
+	return bucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// take takes n tokens from the bucket. A full bucket allows a request larger than the
+// bucket so the tokens owed are refilled before the next request is allowed.
+func (b *bucket) take(n float64, now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	if b.tokens < n && b.tokens < b.rate {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+const (
+	// The stored bytes are counted in the buckets of the payloads expiring in the same minute, the bytes
+	// of a bucket are released once the last payloads of the bucket expire.
+	storedBucket = time.Minute
+	// The bytes stored are recorded at most every interval so that the usage is kept on restart.
+	storedFlush = 10 * time.Second
+)
+
+// storedExpiry returns the expiry of the bucket the payload expiring at the time is counted in.
+func storedExpiry(expiry time.Time) time.Time {
+	bucket := expiry.Truncate(storedBucket)
+	if bucket.Before(expiry) {
+		bucket = bucket.Add(storedBucket)
+	}
+	return bucket
+}
+
+// contractQuota enforces the quota of a contract and tracks the usage of the quota.
+type contractQuota struct {
+	sync.Mutex
+	limits    config.Quota
+	messages  bucket
+	bytes     bucket
+	buckets   []store.StoredBytes                  // The bytes stored by the expiry in the time order, to release the bytes once the payloads expire.
+	unflushed map[int64]int64                      // The bytes stored by the expiry those are not recorded yet.
+	flushed   time.Time                            // The time the bytes stored were last recorded.
+	put       func(stored store.StoredBytes) error // Records the bytes stored so that the usage is kept on restart.
+
+	connections   metrics.Gauge
+	subscriptions metrics.Gauge
+	storedBytes   metrics.Gauge
+	throttled     metrics.Counter
+}
+
+// setLimits sets the limits of the quota, the rate limits start with full buckets.
+func (q *contractQuota) setLimits(limits config.Quota) {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	q.limits = limits
+	q.messages = newBucket(limits.MessagesPerSec, now)
+	q.bytes = newBucket(limits.BytesPerSec, now)
+}
+
+// connect counts the connection against the quota, it returns false if the contract has the maximum connections.
+func (q *contractQuota) connect() bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.limits.MaxConnections > 0 && q.connections.Value() >= int64(q.limits.MaxConnections) {
+		q.throttled.Inc(1)
+		return false
+	}
+	q.connections.Update(q.connections.Value() + 1)
+	return true
+}
+
+// disconnect releases the connection counted against the quota.
+func (q *contractQuota) disconnect() {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.connections.Update(q.connections.Value() - 1)
+}
+
+// allowSubscribe checks whether the contract has fewer than the maximum subscriptions.
+func (q *contractQuota) allowSubscribe() bool {
+	if q == nil {
+		return true
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.limits.MaxSubscriptions > 0 && q.subscriptions.Value() >= int64(q.limits.MaxSubscriptions) {
+		q.throttled.Inc(1)
+		return false
+	}
+	return true
+}
+
+// subscribed counts the subscriptions added, or removed if n is negative.
+func (q *contractQuota) subscribed(n int64) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.subscriptions.Update(q.subscriptions.Value() + n)
+}
+
+// publish takes the message and the payload bytes from the rate limits, it returns false if the rate is exceeded.
+func (q *contractQuota) publish(size int) bool {
+	if q == nil {
+		return true
+	}
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	if !q.messages.take(1, now) || !q.bytes.take(float64(size), now) {
+		q.throttled.Inc(1)
+		return false
+	}
+	return true
+}
+
+// store counts the payload stored against the quota, the payload is released once the ttl expires.
+// It returns false if the payload exceeds the maximum stored bytes.
+func (q *contractQuota) store(size int, ttl time.Duration) bool {
+	if q == nil {
+		return true
+	}
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	usage := q.storedBytes.Value()
+	for len(q.buckets) > 0 && !q.buckets[0].Expiry.After(now) {
+		usage -= q.buckets[0].Size
+		q.buckets = q.buckets[1:]
+	}
+	if q.limits.MaxStoredBytes > 0 && usage+int64(size) > q.limits.MaxStoredBytes {
+		q.storedBytes.Update(usage)
+		q.throttled.Inc(1)
+		return false
+	}
+	if ttl > 0 {
+		expiry := storedExpiry(now.Add(ttl))
+		q.add(store.StoredBytes{Expiry: expiry, Size: int64(size)})
+		if q.unflushed == nil {
+			q.unflushed = make(map[int64]int64)
+		}
+		q.unflushed[expiry.UnixNano()] += int64(size)
+		if now.Sub(q.flushed) >= storedFlush {
+			q.flush(now)
+		}
+	}
+	q.storedBytes.Update(usage + int64(size))
+	return true
+}
+
+// add adds the bytes stored to the bucket of the expiry.
+func (q *contractQuota) add(stored store.StoredBytes) {
+	i := sort.Search(len(q.buckets), func(i int) bool { return !q.buckets[i].Expiry.Before(stored.Expiry) })
+	if i < len(q.buckets) && q.buckets[i].Expiry.Equal(stored.Expiry) {
+		q.buckets[i].Size += stored.Size
+		return
+	}
+	q.buckets = append(q.buckets, store.StoredBytes{})
+	copy(q.buckets[i+1:], q.buckets[i:])
+	q.buckets[i] = stored
+}
+
+// flush records the bytes stored since the bytes were last recorded, one record for each bucket.
+func (q *contractQuota) flush(now time.Time) {
+	for expiry, size := range q.unflushed {
+		if err := q.put(store.StoredBytes{Expiry: time.Unix(0, expiry), Size: size}); err != nil {
+			log.ErrLogger.Err(err).Str("context", "quota.flush").Msg("unable to record stored bytes")
+		}
+	}
+	q.unflushed = nil
+	q.flushed = now
+}
+
+// load counts the bytes stored those are not expired against the quota.
+func (q *contractQuota) load(stored []store.StoredBytes) {
+	q.Lock()
+	defer q.Unlock()
+	usage := q.storedBytes.Value()
+	for _, b := range stored {
+		q.add(b)
+		usage += b.Size
+	}
+	q.storedBytes.Update(usage)
+}
+
+// quotas holds the quotas of the contracts, the usage of a contract is registered in the metrics.
+// The bytes stored are recorded in the quota store and loaded when the contract is first used.
+type quotas struct {
+	sync.Mutex
+	cfg       config.QuotaConfig
+	contracts map[uint32]*contractQuota
+	metrics   metrics.Metrics
+	load      func(contract uint32) ([]store.StoredBytes, error)
+	put       func(contract uint32, stored store.StoredBytes) error
+}
+
+func newQuotas(cfg config.QuotaConfig, m metrics.Metrics) *quotas {
+	return &quotas{
+		cfg:       cfg,
+		contracts: make(map[uint32]*contractQuota),
+		metrics:   m,
+		load:      store.Quota.Stored,
+		put:       store.Quota.PutStored,
+	}
+}
+
+// get returns the quota of the contract.
+func (q *quotas) get(contract uint32) *contractQuota {
+	q.Lock()
+	defer q.Unlock()
+	if quota, ok := q.contracts[contract]; ok {
+		return quota
+	}
+
+	prefix := "Quota." + strconv.FormatUint(uint64(contract), 10) + "."
+	quota := &contractQuota{
+		connections:   metrics.GetOrRegisterGauge(prefix+"Connections", q.metrics),
+		subscriptions: metrics.GetOrRegisterGauge(prefix+"Subscriptions", q.metrics),
+		storedBytes:   metrics.GetOrRegisterGauge(prefix+"StoredBytes", q.metrics),
+		throttled:     metrics.GetOrRegisterCounter(prefix+"Throttled", q.metrics),
+		put: func(stored store.StoredBytes) error {
+			return q.put(contract, stored)
+		},
+	}
+	limits, ok := q.cfg.Contracts[contract]
+	if !ok {
+		limits = q.cfg.Default
+	}
+	quota.setLimits(limits)
+	stored, err := q.load(contract)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "quotas.get").Uint32("contract", contract).Msg("unable to load stored bytes")
+	}
+	quota.load(stored)
+	q.contracts[contract] = quota
+	return quota
+}
+
+// lookup returns the quota of the contract if the contract is used or has a quota configured.
+func (q *quotas) lookup(contract uint32) (*contractQuota, bool) {
+	q.Lock()
+	quota, ok := q.contracts[contract]
+	_, configured := q.cfg.Contracts[contract]
+	q.Unlock()
+	if ok {
+		return quota, true
+	}
+	if configured {
+		return q.get(contract), true
+	}
+	return nil, false
+}
+
+// QuotaStatus is the quota of a contract and the usage of the quota returned by the admin API.
+type QuotaStatus struct {
+	Contract      uint32       `json:"contract"`
+	Quota         config.Quota `json:"quota"`
+	Connections   int64        `json:"connections"`
+	Subscriptions int64        `json:"subscriptions"`
+	StoredBytes   int64        `json:"stored_bytes"`
+	Throttled     int64        `json:"throttled"`
+}
+
+func (q *contractQuota) status(contract uint32) *QuotaStatus {
+	q.Lock()
+	defer q.Unlock()
+	return &QuotaStatus{
+		Contract:      contract,
+		Quota:         q.limits,
+		Connections:   q.connections.Value(),
+		Subscriptions: q.subscriptions.Value(),
+		StoredBytes:   q.storedBytes.Value(),
+		Throttled:     q.throttled.Count(),
+	}
+}
+
+// errAdminListen is returned if the admin API without the admin token is not listening on localhost.
+var errAdminListen = errors.New("admin API without the admin token must listen on localhost")
+
+// listenAdmin starts the admin API to get and set the quotas of the contracts. The admin API without
+// the admin token listens only on localhost or on a unix socket.
+func (s *Service) listenAdmin(addr string) error {
+	if s.config.Quota(s.config.QuotaConfig).AdminToken == "" && !localAddr(addr) {
+		return errAdminListen
+	}
+	l, err := netListener(addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/quotas/", s.HandleQuota)
+	go http.Serve(l, mux)
+	log.Info("service.listenAdmin", "admin API listening at "+addr)
+	return nil
+}
+
+// localAddr checks whether the address to listen on is a unix socket or a loopback address.
+func localAddr(addr string) bool {
+	if strings.HasPrefix(addr, "unix:") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// HandleQuota will process HTTP requests to get or set the quota of a contract at /quotas/<contract>.
+// The quota set is kept until the service is restarted. The quota of a contract not used and without
+// a quota configured is not found.
+func (s *Service) HandleQuota(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config.Quota(s.config.QuotaConfig)
+	if cfg.AdminToken != "" && r.Header.Get("Authorization") != "Bearer "+cfg.AdminToken {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	contract, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/quotas/"), 10, 32)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	quota, ok := s.quotas.lookup(uint32(contract))
+
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+	case http.MethodPut:
+		var limits config.Quota
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		// The quota is set before the contract is used.
+		if !ok {
+			quota = s.quotas.get(uint32(contract))
+		}
+		quota.setLimits(limits)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.MarshalIndent(quota.status(uint32(contract)), "", "  ")
+	if err != nil {
+		log.Error("quota", "Error marshaling response to /quotas request: "+err.Error())
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
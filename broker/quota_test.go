@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/unit-io/unitd/config"
+	"github.com/unit-io/unitd/pkg/metrics"
+	"github.com/unit-io/unitd/store"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := newBucket(2, now)
+	assert.True(t, b.take(1, now))
+	assert.True(t, b.take(1, now))
+	assert.False(t, b.take(1, now))
+	assert.True(t, b.take(1, now.Add(500*time.Millisecond)))
+
+	// A full bucket allows a request larger than the bucket.
+	b = newBucket(10, now)
+	assert.True(t, b.take(25, now))
+	assert.False(t, b.take(1, now.Add(time.Second)))
+	assert.True(t, b.take(1, now.Add(3*time.Second)))
+
+	unlimited := newBucket(0, now)
+	assert.True(t, unlimited.take(1000, now))
+}
+
+// newTestQuotas returns the quotas recording the bytes stored in memory.
+func newTestQuotas(cfg config.QuotaConfig, recorded map[uint32][]store.StoredBytes) *quotas {
+	q := newQuotas(cfg, metrics.NewMetrics())
+	q.load = func(contract uint32) ([]store.StoredBytes, error) {
+		return recorded[contract], nil
+	}
+	q.put = func(contract uint32, stored store.StoredBytes) error {
+		recorded[contract] = append(recorded[contract], stored)
+		return nil
+	}
+	return q
+}
+
+func TestContractQuota(t *testing.T) {
+	q := newTestQuotas(config.QuotaConfig{
+		Default:   config.Quota{MaxConnections: 1},
+		Contracts: map[uint32]config.Quota{42: {MessagesPerSec: 1, MaxSubscriptions: 1, MaxStoredBytes: 10}},
+	}, make(map[uint32][]store.StoredBytes))
+
+	quota := q.get(1)
+	assert.True(t, quota.connect())
+	assert.False(t, quota.connect())
+	quota.disconnect()
+	assert.True(t, quota.connect())
+
+	quota = q.get(42)
+	assert.True(t, quota.publish(5))
+	assert.False(t, quota.publish(5))
+
+	assert.True(t, quota.allowSubscribe())
+	quota.subscribed(1)
+	assert.False(t, quota.allowSubscribe())
+	quota.subscribed(-1)
+	assert.True(t, quota.allowSubscribe())
+
+	assert.True(t, quota.store(6, 0))
+	assert.False(t, quota.store(6, time.Minute))
+	// The bytes of a bucket are released once the bucket expires.
+	quota.load([]store.StoredBytes{{Expiry: time.Now().Add(20 * time.Millisecond), Size: 4}})
+	assert.False(t, quota.store(4, 0))
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, quota.store(4, 0))
+
+	status := quota.status(42)
+	assert.Equal(t, int64(10), status.StoredBytes)
+	assert.Equal(t, int64(4), status.Throttled)
+
+	// The nil quota of a cluster connection is not enforced.
+	var none *contractQuota
+	assert.True(t, none.publish(100))
+	assert.True(t, none.allowSubscribe())
+}
+
+func TestStoredQuotaRestart(t *testing.T) {
+	cfg := config.QuotaConfig{Default: config.Quota{MaxStoredBytes: 10}}
+	recorded := make(map[uint32][]store.StoredBytes)
+	quota := newTestQuotas(cfg, recorded).get(1)
+	assert.True(t, quota.store(6, time.Minute))
+	assert.True(t, quota.store(4, time.Minute))
+	assert.False(t, quota.store(1, time.Minute))
+	// The bytes stored in the same minute are counted in one bucket, the bytes are recorded at most every interval.
+	assert.Equal(t, 1, len(quota.buckets))
+	assert.Equal(t, []store.StoredBytes{{Expiry: quota.buckets[0].Expiry, Size: 6}}, recorded[1])
+	quota.flush(time.Now())
+	assert.Equal(t, 2, len(recorded[1]))
+
+	// The bytes stored are counted once the quotas are loaded again.
+	quota = newTestQuotas(cfg, recorded).get(1)
+	assert.Equal(t, int64(10), quota.status(1).StoredBytes)
+	assert.False(t, quota.store(1, time.Minute))
+}
+
+func TestStoredExpiry(t *testing.T) {
+	minute := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, minute, storedExpiry(minute))
+	assert.Equal(t, minute.Add(time.Minute), storedExpiry(minute.Add(time.Second)))
+}
+
+func TestHandleQuota(t *testing.T) {
+	cfg := config.QuotaConfig{Contracts: map[uint32]config.Quota{42: {MaxConnections: 1}}, AdminToken: "token"}
+	s := &Service{
+		config: &config.Config{QuotaConfig: []byte(`{"contracts": {"42": {"max_connections": 1}}, "admin_token": "token"}`)},
+		quotas: newTestQuotas(cfg, make(map[uint32][]store.StoredBytes)),
+	}
+	request := func(method, path, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		s.HandleQuota(w, r)
+		return w.Code
+	}
+
+	// The quota of a contract not used is not found, and is not created.
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/quotas/1", ""))
+	assert.Equal(t, 0, len(s.quotas.contracts))
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/quotas/42", ""))
+	assert.Equal(t, http.StatusOK, request(http.MethodPut, "/quotas/1", `{"max_connections": 2}`))
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/quotas/1", ""))
+
+	r := httptest.NewRequest(http.MethodGet, "/quotas/42", nil)
+	w := httptest.NewRecorder()
+	s.HandleQuota(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAdminListen(t *testing.T) {
+	s := &Service{config: &config.Config{}}
+	// The admin API without the admin token listens only on localhost.
+	assert.Equal(t, errAdminListen, s.listenAdmin(":0"))
+	assert.Equal(t, errAdminListen, s.listenAdmin("0.0.0.0:0"))
+	assert.True(t, localAddr("127.0.0.1:6061"))
+	assert.True(t, localAddr("localhost:6061"))
+	assert.True(t, localAddr("[::1]:6061"))
+	assert.True(t, localAddr("unix:/tmp/admin.sock"))
+	assert.False(t, localAddr("10.0.0.1:6061"))
+}
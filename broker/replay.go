@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/unit-io/unitd/message"
+	"github.com/unit-io/unitd/message/security"
+)
+
+// maxHeld is the maximum number of live messages held while the history is replayed, the live messages
+// are delivered as published once the limit is reached.
+const maxHeld = 1000
+
+// replayQueue holds the live messages delivered to the connection while the history is replayed,
+// so that the history is delivered in the time order before the live messages.
+type replayQueue struct {
+	sync.Mutex
+	topics   [][]byte       // The topics of the subscriptions the history is replayed for.
+	held     []heldMessage  // The live messages held until the replays are done.
+	replayed map[int64]bool // The published time of the messages replayed, those are not delivered again.
+}
+
+type heldMessage struct {
+	msg message.Message
+	qos uint8
+}
+
+// startReplay holds the live messages to the topic delivered to the connection until the replay is done.
+func (c *Conn) startReplay(topic []byte) {
+	c.replay.Lock()
+	defer c.replay.Unlock()
+	c.replay.topics = append(c.replay.topics, topic)
+}
+
+// hold holds the live message if the history of a subscription matching the message topic is being
+// replayed to the connection.
+func (c *Conn) hold(m *message.Message, qos uint8) bool {
+	c.replay.Lock()
+	defer c.replay.Unlock()
+	if len(c.replay.held) >= maxHeld {
+		return false
+	}
+	for _, topic := range c.replay.topics {
+		if matchTopic(topic, m.Topic) {
+			c.replay.held = append(c.replay.held, heldMessage{msg: *m, qos: qos})
+			return true
+		}
+	}
+	return false
+}
+
+// endReplay delivers the history replayed, and the live messages held once no other replay is in progress.
+// The live messages also found in the history are not delivered again.
+func (c *Conn) endReplay(topic []byte, msgs []message.Message, qos uint8) {
+	c.replay.Lock()
+	defer c.replay.Unlock()
+	for i := range msgs {
+		c.deliverNow(&msgs[i], qos)
+		if c.replay.replayed == nil {
+			c.replay.replayed = make(map[int64]bool)
+		}
+		c.replay.replayed[msgs[i].Published] = true
+	}
+
+	for i, t := range c.replay.topics {
+		if bytes.Equal(t, topic) {
+			c.replay.topics = append(c.replay.topics[:i], c.replay.topics[i+1:]...)
+			break
+		}
+	}
+	if len(c.replay.topics) > 0 {
+		return
+	}
+	for i := range c.replay.held {
+		if held := &c.replay.held[i]; !c.replay.replayed[held.msg.Published] {
+			c.deliverNow(&held.msg, held.qos)
+		}
+	}
+	c.replay.held, c.replay.replayed = nil, nil
+}
+
+// matchTopic checks whether the topic "a.b.c" matches the subscription topic "a.*.c" or "a...".
+func matchTopic(sub, topic []byte) bool {
+	multi := bytes.HasSuffix(sub, []byte("..."))
+	if multi {
+		sub = sub[:len(sub)-3]
+	}
+	var subParts [][]byte
+	if len(sub) > 0 {
+		subParts = bytes.Split(sub, []byte{security.TopicSeparator})
+	}
+	parts := bytes.Split(topic, []byte{security.TopicSeparator})
+	if len(parts) < len(subParts) || (!multi && len(parts) != len(subParts)) {
+		return false
+	}
+	for i, part := range subParts {
+		if !(len(part) == 1 && part[0] == '*') && !bytes.Equal(part, parts[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package broker
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitd/message/security"
+	"github.com/unit-io/unitd/pkg/crypto"
+	"github.com/unit-io/unitd/pkg/log"
+	"github.com/unit-io/unitd/pkg/uid"
+	"github.com/unit-io/unitd/store"
+	"github.com/unit-io/unitd/types"
+)
+
+// revocations caches the keys or the client Ids revoked by the contracts. The revocations of a contract
+// are loaded from the store when the contract is first checked.
+type revocations struct {
+	sync.RWMutex
+	contracts map[uint32]map[string]time.Time // The revoked keys and the time the revocation expires, zero if it does not expire.
+	load      func(contract uint32) ([][]byte, error)
+	expiry    func(key []byte) time.Time // The time the revocation expires, nil if the revocations do not expire.
+	canonical func(key []byte) []byte    // The form the keys are compared in, nil if the keys are compared as is.
+}
+
+func newRevocations(load func(contract uint32) ([][]byte, error), expiry func(key []byte) time.Time, canonical func(key []byte) []byte) *revocations {
+	return &revocations{
+		contracts: make(map[uint32]map[string]time.Time),
+		load:      load,
+		expiry:    expiry,
+		canonical: canonical,
+	}
+}
+
+// keys returns the keys revoked by the contract, loading them from the store if not cached.
+func (r *revocations) keys(contract uint32) map[string]time.Time {
+	r.RLock()
+	keys, ok := r.contracts[contract]
+	r.RUnlock()
+	if ok {
+		return keys
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if keys, ok := r.contracts[contract]; ok {
+		return keys
+	}
+	keys = make(map[string]time.Time)
+	revoked, err := r.load(contract)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "revocations.keys").Uint32("contract", contract).Msg("unable to load revocations")
+	}
+	for _, key := range revoked {
+		keys[string(r.canonicalOf(key))] = r.expiryOf(key)
+	}
+	r.contracts[contract] = keys
+	return keys
+}
+
+// expiryOf returns the time the revocation of the key expires, zero if it does not expire.
+func (r *revocations) expiryOf(key []byte) time.Time {
+	if r.expiry == nil {
+		return time.Time{}
+	}
+	return r.expiry(key)
+}
+
+// canonicalOf returns the form of the key the keys are compared in.
+func (r *revocations) canonicalOf(key []byte) []byte {
+	if r.canonical == nil {
+		return key
+	}
+	return r.canonical(key)
+}
+
+// revoked checks whether the key is revoked by the contract.
+func (r *revocations) revoked(contract uint32, key []byte) bool {
+	keys := r.keys(contract)
+	r.RLock()
+	defer r.RUnlock()
+	expiry, ok := keys[string(r.canonicalOf(key))]
+	return ok && (expiry.IsZero() || time.Now().Before(expiry))
+}
+
+// add caches the key revoked by the contract.
+func (r *revocations) add(contract uint32, key []byte) {
+	keys := r.keys(contract)
+	r.Lock()
+	defer r.Unlock()
+	keys[string(r.canonicalOf(key))] = r.expiryOf(key)
+}
+
+// revocationExpiry returns the time the revocation of the key expires, the revocation
+// is not needed once the key has expired.
+func revocationExpiry(key []byte) time.Time {
+	k, err := security.DecodeKey(key)
+	if err != nil {
+		return time.Time{}
+	}
+	return k.NotAfter()
+}
+
+// canonicalKey returns the key in the canonical form, so that any spelling of a revoked key is refused.
+// The key is returned as is if it is not a valid key.
+func canonicalKey(key []byte) []byte {
+	if canonical, err := security.CanonicalKey(key); err == nil {
+		return canonical
+	}
+	return key
+}
+
+// revokeKey revokes the key of the contract on this node. The key is stored in the revocation store
+// and the subscriptions made with any spelling of the key are terminated.
+func (s *Service) revokeKey(contract uint32, key []byte) error {
+	key = canonicalKey(key)
+	var ttl time.Duration
+	if notAfter := revocationExpiry(key); !notAfter.IsZero() {
+		ttl = time.Until(notAfter)
+	}
+	if err := store.Revocation.Revoke(contract, key, ttl); err != nil {
+		return err
+	}
+	s.revoked.add(contract, key)
+
+	for _, conn := range Globals.ConnCache.All() {
+		if conn.clientid != nil && conn.clientid.Contract() == contract {
+			conn.revokeKey(key)
+		}
+	}
+	return nil
+}
+
+// revokeKey terminates the subscriptions of the connection made with the revoked key, the key is canonical.
+func (c *Conn) revokeKey(key []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	removed := c.subs.RemoveKeyFunc(func(subKey []byte) bool {
+		return bytes.Equal(canonicalKey(subKey), key)
+	})
+	for _, stat := range removed {
+		if stat.Group != nil {
+			c.service.shares.Leave(shareKey(c.clientid.Contract(), stat.Group), uint32(c.connid))
+		}
+		if stat.ID == nil {
+			// The subscription is handled by a remote node.
+			continue
+		}
+		if err := store.Subscription.Delete(c.clientid.Contract(), stat.ID, stat.Topic); err != nil {
+			log.ErrLogger.Err(err).Str("context", "conn.revokeKey").Str("topic", string(stat.Topic)).Int64("connid", int64(c.connid)).Msg("unable to unsubscribe to topic")
+			continue
+		}
+		// Decrement the subscription counter
+		c.service.meter.Subscriptions.Dec(1)
+		c.quota.subscribed(-1)
+		c.notifyPresence(presenceLeave, stat.Topic)
+	}
+	if len(removed) > 0 && c.clnode == nil {
+		c.notifyError(types.ErrKeyRevoked, 0)
+	}
+}
+
+// revokeClientID revokes the secondary client Id of the contract, the id is the client Id decoded.
+// It returns false if the client Id is not found.
+func (s *Service) revokeClientID(contract uint32, id uid.ID) (bool, error) {
+	ok, err := store.ClientId.Revoke(contract, id)
+	if err != nil || !ok {
+		return false, err
+	}
+	s.clientIDRevoked(contract, id)
+	return true, nil
+}
+
+// putRevokedClientID records the client Id revoked by the contract on a remote node.
+func (s *Service) putRevokedClientID(contract uint32, id uid.ID) error {
+	if err := store.ClientId.PutRevoked(contract, id); err != nil {
+		return err
+	}
+	s.clientIDRevoked(contract, id)
+	return nil
+}
+
+// clientIDRevoked caches the client Id revoked by the contract. The client Id is evicted from the
+// contract cache and the connections using the client Id are disconnected.
+func (s *Service) clientIDRevoked(contract uint32, id uid.ID) {
+	s.revokedIDs.add(contract, id)
+	cid := id.Encode(s.Keyring)
+	s.cache.Delete(crypto.SignatureToUint32([]byte(cid[crypto.EpochSize:crypto.MessageOffset])))
+
+	for _, conn := range Globals.ConnCache.All() {
+		if conn.clnode == nil && conn.clientid != nil && bytes.Equal(conn.clientid, id) {
+			conn.revokeClientID()
+		}
+	}
+}
+
+// revokeClientID disconnects the connection as the client Id of the connection is revoked.
+func (c *Conn) revokeClientID() {
+	log.ConnLogger.Info().Str("context", "conn.revokeClientID").Int64("connid", int64(c.connid)).Msg("client Id revoked")
+	// The MQTT 5 client is notified with the reason not authorized.
+	c.disconnect(0x87)
+}
@@ -2,6 +2,7 @@ package broker
 
 import (
 	"context"
+	"errors"
 	"net"
 	"os"
 	"os/signal"
@@ -12,6 +13,8 @@ import (
 
 	"github.com/unit-io/unitd/config"
 	lp "github.com/unit-io/unitd/lineprotocol"
+	"github.com/unit-io/unitd/message"
+	"github.com/unit-io/unitd/message/security"
 	"github.com/unit-io/unitd/net/listener"
 	"github.com/unit-io/unitd/pkg/crypto"
 	"github.com/unit-io/unitd/pkg/log"
@@ -25,29 +28,41 @@ import (
 
 //Service is a main struct
 type Service struct {
-	PID     uint32             // The processid is unique Id for the application
-	MAC     *crypto.MAC        // The MAC to use for decoding and encoding keys.
-	cache   *sync.Map          // The cache for the contracts.
-	context context.Context    // context for the service
-	config  *config.Config     // The configuration for the service.
-	cancel  context.CancelFunc // cancellation function
-	start   time.Time          // The service start time
-	http    *lp.HttpServer     // The underlying HTTP server.
-	tcp     *lp.TcpServer      // The underlying TCP server.
-	grpc    *lp.GrpcServer     // The underlying GRPC server.
-	meter   *Meter             // The metircs to measure timeseries on message events
-	stats   *stats.Stats
+	PID        uint32                // The processid is unique Id for the application
+	Keyring    *crypto.Keyring       // The keyring to use for decoding and encoding client Ids.
+	auth       Authenticator         // The authenticator for username and password, nil if authentication is disabled.
+	insecure   config.InsecureConfig // The policy for the insecure flag provided by the client.
+	topics     config.TopicConfig    // The topic mode of the connections.
+	cache      *sync.Map             // The cache for the contracts.
+	shares     *message.Shares       // The shared subscription groups of the contracts owned by this node.
+	revoked    *revocations          // The keys revoked by the contracts.
+	revokedIDs *revocations          // The secondary client Ids revoked by the contracts.
+	quotas     *quotas               // The quotas of the contracts.
+	presence   *presence             // The presence subscribers of the topics.
+	context    context.Context       // context for the service
+	config     *config.Config        // The configuration for the service.
+	cancel     context.CancelFunc    // cancellation function
+	start      time.Time             // The service start time
+	http       *lp.HttpServer        // The underlying HTTP server.
+	tcp        *lp.TcpServer         // The underlying TCP server.
+	grpc       *lp.GrpcServer        // The underlying GRPC server.
+	meter      *Meter                // The metircs to measure timeseries on message events
+	stats      *stats.Stats
 }
 
 func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	s = &Service{
-		PID:     uid.NewUnique(),
-		cache:   new(sync.Map),
-		context: ctx,
-		config:  cfg,
-		cancel:  cancel,
-		start:   time.Now(),
+		PID:        uid.NewUnique(),
+		cache:      new(sync.Map),
+		shares:     message.NewShares(),
+		revoked:    newRevocations(store.Revocation.Revoked, revocationExpiry, canonicalKey),
+		revokedIDs: newRevocations(store.ClientId.Revoked, nil, nil),
+		presence:   newPresence(),
+		context:    ctx,
+		config:     cfg,
+		cancel:     cancel,
+		start:      time.Now(),
 		// subscriptions: message.NewSubscriptions(),
 		http:  lp.NewHttpServer(),
 		tcp:   lp.NewTcpServer(),
@@ -67,11 +82,44 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 	s.http.Handler = s.onAcceptConn
 	s.tcp.Handler = s.onAcceptConn
 
-	// Create a new MAC from the key.
-	if s.MAC, err = crypto.New([]byte(s.config.Encryption(s.config.EncryptionConfig).Key)); err != nil {
+	// Create the keyring from the encryption key and the rotated keys.
+	// The sealed keys are unsealed with the key-encryption key, the service does not start if unsealing fails.
+	unseal := &unsealer{cfg: s.config.Unseal(s.config.UnsealConfig)}
+	if s.Keyring, err = newKeyring(s.config, unseal); err != nil {
 		return nil, err
 	}
 
+	// Create the authenticator for username and password.
+	if s.auth, err = newAuthenticator(s.config.Auth(s.config.AuthConfig)); err != nil {
+		return nil, err
+	}
+
+	s.insecure = s.config.Insecure(s.config.InsecureConfig)
+	s.topics = s.config.Topic(s.config.TopicConfig)
+	s.quotas = newQuotas(s.config.Quota(s.config.QuotaConfig), s.meter.Metrics)
+
+	// Encrypt the payloads stored in the database.
+	if storage := s.config.StorageEncryption(s.config.StorageEncryptionConfig); storage.Enabled {
+		encr := s.config.Encryption(s.config.EncryptionConfig)
+		key, err := unseal.key(encr.Key, encr.Sealed)
+		if err != nil {
+			return nil, errors.New("encryption key '" + encr.Identifier + "': " + err.Error())
+		}
+		keys := map[string][]byte{encr.Identifier: key}
+		for id, key := range storage.Keys {
+			if keys[id], err = unseal.key(key, storage.Sealed); err != nil {
+				return nil, errors.New("storage key '" + id + "': " + err.Error())
+			}
+		}
+		current := storage.Identifier
+		if current == "" {
+			current = encr.Identifier
+		}
+		if err := store.SetEncryption(keys, current); err != nil {
+			return nil, err
+		}
+	}
+
 	// Open database connection
 	err = store.Open(string(s.config.StoreConfig))
 	if err != nil {
@@ -84,6 +132,129 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 	return s, nil
 }
 
+// newKeyring creates the keyring to encrypt the client Ids, the encryption config key is added with the rotated keys.
+func newKeyring(cfg *config.Config, unseal *unsealer) (*crypto.Keyring, error) {
+	keyring := cfg.Keyring(cfg.KeyringConfig)
+	ring := crypto.NewKeyring(time.Duration(keyring.GracePeriod) * time.Second)
+	for _, encr := range append([]config.EncryptionConfig{cfg.Encryption(cfg.EncryptionConfig)}, keyring.Keys...) {
+		key, err := unseal.key(encr.Key, encr.Sealed)
+		if err != nil {
+			return nil, errors.New("encryption key '" + encr.Identifier + "': " + err.Error())
+		}
+		if err := ring.Add(encr.Identifier, key, encr.Timestamp); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+// keepAlive returns the keepalive requested by the client clamped to the range allowed by the server, a keepalive
+// of zero disables the keepalive. The MQTT 5 client is informed of the keepalive clamped with the server keepalive
+// of the connack. The MQTT 3.1.1 client is not informed, so the MQTT 3.1.1 client requesting a keepalive longer than
+// the maximum keepalive is disconnected if it does not send a packet within one and a half times the maximum keepalive.
+func (s *Service) keepAlive(secs uint16) time.Duration {
+	if secs == 0 {
+		return 0
+	}
+	keepalive := time.Duration(secs) * time.Second
+	max := time.Duration(s.config.MaxKeepAlive) * time.Second
+	if max == 0 {
+		max = defaultKeepAlive
+	}
+	min := time.Duration(s.config.MinKeepAlive) * time.Second
+	if min > max {
+		min = max
+	}
+
+	switch {
+	case keepalive > max:
+		return max
+	case keepalive < min:
+		return min
+	}
+	return keepalive
+}
+
+// sessionExpiry returns the session expiry interval for the persistent session requested by the client,
+// zero means the session ends when the connection is closed.
+func (s *Service) sessionExpiry(pkt lp.Connect) time.Duration {
+	max := time.Duration(s.config.MaxSessionExpiry) * time.Second
+	if max == 0 {
+		max = defaultSessionExpiry
+	}
+	// MQTT 5 clients request the session expiry interval, the session of other clients persists unless clean session is requested.
+	if pkt.Version != 5 {
+		if pkt.CleanSessFlag {
+			return 0
+		}
+		return max
+	}
+
+	expiry := time.Duration(pkt.Properties.SessionExpiry) * time.Second
+	if expiry > max {
+		return max
+	}
+	return expiry
+}
+
+// messageTTL returns the time-to-live of the message requested by the publisher with the topic option,
+// zero means the message does not expire. The message expiry interval of a MQTT 5 publisher takes
+// precedence over the topic option.
+func (s *Service) messageTTL(topic *security.Topic, props lp.Properties) time.Duration {
+	ttl, ok := topic.TTL()
+	if props.MessageExpiry != 0 {
+		ttl, ok = time.Duration(props.MessageExpiry)*time.Second, true
+	}
+	if !ok {
+		return 0
+	}
+	if max := s.maxMessageTTL(); ttl > max {
+		return max
+	}
+	return ttl
+}
+
+// maxMessageTTL returns the maximum ttl of the messages.
+func (s *Service) maxMessageTTL() time.Duration {
+	if s.config.MaxMessageTTL == 0 {
+		return defaultMaxMessageTTL
+	}
+	return time.Duration(s.config.MaxMessageTTL) * time.Second
+}
+
+// retryInterval returns the interval to resend the messages not acknowledged by the client.
+func (s *Service) retryInterval() time.Duration {
+	if s.config.RetryInterval <= 0 {
+		return defaultRetryInterval
+	}
+	return time.Duration(s.config.RetryInterval) * time.Second
+}
+
+// allowInsecure checks the insecure policy for the listener and the contract.
+func (s *Service) allowInsecure(listener string, contract uint32) bool {
+	if allow, ok := s.insecure.Contracts[contract]; ok {
+		return allow
+	}
+	if allow, ok := s.insecure.Listeners[listener]; ok {
+		return allow
+	}
+	return s.insecure.Allow
+}
+
+// mqttTopics checks whether the connection uses the MQTT-standard topics. The topic mode requested
+// by the client with the user property "topic-mode" takes precedence over the listener setting.
+func (s *Service) mqttTopics(listener string, props lp.Properties) bool {
+	for _, prop := range props.UserProperties {
+		if string(prop.Key) == topicModeProperty {
+			return string(prop.Value) == topicModeMQTT
+		}
+	}
+	if mqtt, ok := s.topics.Listeners[listener]; ok {
+		return mqtt
+	}
+	return s.topics.MQTT
+}
+
 // netListener creates net.Listener for tcp and unix domains:
 // if addr is is in the form "unix:/run/tinode.sock" it's a unix socket, otherwise TCP host:port.
 func netListener(addr string) (net.Listener, error) {
@@ -125,6 +296,12 @@ func (s *Service) listen(addr string) {
 		}
 		s.grpc.Serve(grpcList)
 	}
+	// Start the admin API to get and set the quotas of the contracts.
+	if admin := s.config.Quota(s.config.QuotaConfig).AdminListen; admin != "" {
+		if err := s.listenAdmin(admin); err != nil {
+			log.Error("service.listen", "unable to start the admin API "+err.Error())
+		}
+	}
 	l.ServeCallback(listener.MatchWS("GET"), s.http.Serve)
 	l.ServeCallback(listener.MatchAny(), s.tcp.Serve)
 
@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"encoding/binary"
+	"time"
+
+	lp "github.com/unit-io/unitd/lineprotocol"
+	"github.com/unit-io/unitd/message"
+	"github.com/unit-io/unitd/message/security"
+	"github.com/unit-io/unitd/pkg/log"
+	"github.com/unit-io/unitd/store"
+)
+
+const (
+	// Session expiry used to move the session state of a connection taken over, if the
+	// session of the connection would otherwise end when the connection is closed.
+	takeoverExpiry = time.Minute
+
+	// Time to wait for the connection taken over to close.
+	takeoverTimeout = 5 * time.Second
+)
+
+// The subscription of an offline session is stored with connid zero, the payload
+// carries the session and the session expiry to queue messages for the session.
+// [qos][connid=0][sessid][session expiry in seconds]
+const offlineSubSize = 13
+
+// offline checks if the subscription payload belongs to an offline session.
+func offline(sub []byte) bool {
+	return len(sub) == offlineSubSize && binary.LittleEndian.Uint32(sub[1:5]) == 0
+}
+
+// storeSession keeps the subscription in the persistent session when the connection is closed. An offline
+// subscription queues the messages for the session until the client reconnects or the session expires.
+func (c *Conn) storeSession(stat message.Stat, expiry time.Duration) {
+	messageId, err := store.Subscription.NewID()
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.storeSession").Int64("connid", int64(c.connid)).Msg("unable to store session")
+		return
+	}
+	payload := make([]byte, offlineSubSize)
+	payload[0] = stat.Qos | stat.Options
+	binary.LittleEndian.PutUint32(payload[5:9], c.sessid)
+	binary.LittleEndian.PutUint32(payload[9:13], uint32(expiry.Seconds()))
+	if err := store.Subscription.PutWithTTL(c.clientid.Contract(), messageId, stat.Topic, payload, expiry); err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.storeSession").Str("topic", string(stat.Topic)).Int64("connid", int64(c.connid)).Msg("unable to store offline subscription")
+		return
+	}
+
+	topic := make([]byte, 0, len(stat.Key)+1+len(stat.Topic))
+	topic = append(append(append(topic, stat.Key...), '/'), stat.Topic...)
+	sub := store.SessionSubscription{ID: messageId, Topic: topic, Qos: stat.Qos, Options: stat.Options}
+	if err := store.Session.PutSubscription(c.clientid.Contract(), c.sessid, sub, expiry); err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.storeSession").Str("topic", string(stat.Topic)).Int64("connid", int64(c.connid)).Msg("unable to store session subscription")
+	}
+}
+
+// restoreSession restores the subscriptions of the persistent session. It returns true if the session was present.
+func (c *Conn) restoreSession() bool {
+	subs, err := store.Session.Subscriptions(c.clientid.Contract(), c.sessid)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.restoreSession").Int64("connid", int64(c.connid)).Msg("unable to restore session")
+	}
+	for _, sub := range subs {
+		topic := security.ParseKey(sub.Topic)
+		// Remove the offline subscription and subscribe the connection. The subscriptions moved
+		// from a cluster node do not have an offline subscription on this node.
+		if sub.ID != nil {
+			if err := store.Subscription.Delete(c.clientid.Contract(), sub.ID, topic.Topic[:topic.Size]); err != nil {
+				log.ErrLogger.Err(err).Str("context", "conn.restoreSession").Int64("connid", int64(c.connid)).Msg("unable to remove offline subscription")
+			}
+		}
+		// The subscriptions made with a key that has expired or is revoked are not restored.
+		if !c.insecure {
+			if _, err := c.authorize(topic, security.AllowRead); err != nil {
+				log.ConnLogger.Info().Err(err).Str("context", "conn.restoreSession").Str("topic", string(topic.Topic[:topic.Size])).Int64("connid", int64(c.connid)).Msg("subscription not restored")
+				continue
+			}
+		}
+		pkt := lp.Subscribe{Subscriptions: []lp.TopicQOSTuple{{Topic: sub.Topic, Qos: sub.Qos}}}
+		if err := c.subscribe(pkt, topic, sub.Qos, sub.Options, nil); err != nil {
+			log.ErrLogger.Err(err).Str("context", "conn.restoreSession").Str("topic", string(topic.Topic[:topic.Size])).Int64("connid", int64(c.connid)).Msg("unable to restore subscription")
+		}
+	}
+
+	return len(subs) > 0
+}
+
+// resumeSession delivers the messages queued for the session while the client was offline.
+func (c *Conn) resumeSession() {
+	msgs, err := store.Session.Dequeue(c.clientid.Contract(), c.sessid)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.resumeSession").Int64("connid", int64(c.connid)).Msg("unable to resume session")
+	}
+	c.deliverQueued(msgs)
+}
+
+// deliverQueued delivers the messages queued for the session in order. The messages are sent as the live
+// messages so that those are resent until acknowledged, but the delivery waits for the write loop.
+func (c *Conn) deliverQueued(msgs []message.Message) {
+	for i := range msgs {
+		if !c.sendMessage(c.outgoing(&msgs[i], msgs[i].Qos), 0) {
+			return
+		}
+	}
+}
+
+// cleanSession removes the persistent session as the client requested a clean session.
+func (c *Conn) cleanSession() {
+	takeSession(c.clientid.Contract(), c.sessid)
+}
+
+// takeSession removes the persistent session from the session store and returns the session state.
+func takeSession(contract, sessid uint32) ([]store.SessionSubscription, []message.Message) {
+	subs, err := store.Session.Subscriptions(contract, sessid)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.takeSession").Uint32("contract", contract).Msg("unable to take session subscriptions")
+	}
+	for i, sub := range subs {
+		topic := security.ParseKey(sub.Topic)
+		if sub.ID != nil {
+			store.Subscription.Delete(contract, sub.ID, topic.Topic[:topic.Size])
+		}
+		subs[i].ID = nil
+	}
+	msgs, err := store.Session.Dequeue(contract, sessid)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.takeSession").Uint32("contract", contract).Msg("unable to take session queue")
+	}
+	return subs, msgs
+}
+
+// sessionKey returns the key of the persistent session, the session is unique for the contract.
+func (c *Conn) sessionKey() uint64 {
+	return uint64(c.clientid.Contract())<<32 | uint64(c.sessid)
+}
+
+// expiry returns the session expiry of the connection.
+func (c *Conn) expiry() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	return c.sessionExpiry
+}
+
+// takeover closes the existing connection of the session on this node and on the cluster nodes. The session
+// state of the connection is moved to this connection unless the client requested a clean session.
+func (c *Conn) takeover(clean bool) {
+	if old := Globals.ConnCache.AddSession(c.sessionKey(), c); old != nil && old != c {
+		old.takenOver(clean)
+	}
+	Globals.Cluster.takeover(c, clean)
+}
+
+// takenOver closes the connection as the session is taken over by a new connection of the client.
+// The session state is stored on close unless the new connection requested a clean session.
+func (c *Conn) takenOver(clean bool) {
+	c.Lock()
+	switch {
+	case clean:
+		c.sessionExpiry = 0
+	case c.sessionExpiry == 0:
+		c.sessionExpiry = takeoverExpiry
+	}
+	c.Unlock()
+
+	log.ConnLogger.Info().Str("context", "conn.takenOver").Int64("connid", int64(c.connid)).Msg("session taken over")
+	// The MQTT 5 client is notified with the reason session taken over.
+	c.disconnect(0x8E)
+
+	select {
+	case <-c.done:
+	case <-time.After(takeoverTimeout):
+		log.ErrLogger.Error().Str("context", "conn.takenOver").Int64("connid", int64(c.connid)).Msg("timeout closing connection taken over")
+	}
+}
+
+// enqueue queues the message for the offline session, the messages with qos zero are not queued.
+func (c *Conn) enqueue(m *message.Message, sub []byte) {
+	qos := sub[0] & 0x03
+	if qos > m.Qos {
+		qos = m.Qos
+	}
+	if qos == 0 {
+		return
+	}
+	sessid := binary.LittleEndian.Uint32(sub[5:9])
+	expiry := time.Duration(binary.LittleEndian.Uint32(sub[9:13])) * time.Second
+	// The message expires from the queue with the message ttl.
+	if ttl := time.Duration(m.TTL) * time.Second; ttl > 0 && ttl < expiry {
+		expiry = ttl
+	}
+	msg := *m
+	msg.Qos = qos
+	if err := store.Session.Enqueue(c.clientid.Contract(), sessid, &msg, expiry); err != nil {
+		log.ErrLogger.Err(err).Str("context", "conn.enqueue").Int64("connid", int64(c.connid)).Msg("unable to queue message for offline session")
+	}
+}
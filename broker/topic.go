@@ -0,0 +1,68 @@
+package broker
+
+import (
+	"bytes"
+
+	lp "github.com/unit-io/unitd/lineprotocol"
+	"github.com/unit-io/unitd/message"
+	"github.com/unit-io/unitd/message/security"
+	"github.com/unit-io/unitd/types"
+)
+
+// The user property a MQTT 5 client provides during connect to choose the topic mode of the connection.
+const (
+	topicModeProperty = "topic-mode"
+	topicModeMQTT     = "mqtt"
+)
+
+// unitdPrefix is the prefix of the topics of the API requests "unitd/<request>".
+var unitdPrefix = []byte("unitd/")
+
+// internalTopic translates the MQTT-standard topic "key/a/+/#" of the connection to the topic "key/a.*...".
+// The key is the first part of the topic unless the connection is insecure, the shared subscription group
+// and the API requests are kept as is except for the topic of the presence subscription "unitd/presence/<key>/<topic>".
+// The topic with a level containing the '.' separator is refused as a bad request.
+func (c *Conn) internalTopic(topic []byte) ([]byte, *types.Error) {
+	if !c.mqttTopics {
+		return topic, nil
+	}
+
+	// The offset of the topic to translate.
+	var n int
+	if group, rest, ok := message.SplitShare(topic); !ok {
+		return topic, nil
+	} else if group != nil {
+		n = len(topic) - len(rest)
+	}
+	if bytes.HasPrefix(topic[n:], unitdPrefix) {
+		if !bytes.HasPrefix(topic[n+len(unitdPrefix):], presencePrefix) {
+			return topic, nil
+		}
+		n += len(unitdPrefix) + len(presencePrefix)
+	}
+	if !c.insecure {
+		if i := bytes.IndexByte(topic[n:], security.TopicKeySeparator); i >= 0 {
+			n += i + 1
+		}
+	}
+
+	internal, err := security.FromMQTT(topic[n:])
+	if err != nil {
+		return nil, types.ErrBadRequest
+	}
+	text := append([]byte(nil), topic[:n]...)
+	return append(text, internal...), nil
+}
+
+// internalTopics translates the MQTT-standard topics of the subscriptions in place. It returns the
+// subscriptions translated, and the error of each subscription whose topic is refused.
+func (c *Conn) internalTopics(subs []lp.TopicQOSTuple) ([]lp.TopicQOSTuple, []*types.Error) {
+	translated := make([]lp.TopicQOSTuple, 0, len(subs))
+	errs := make([]*types.Error, len(subs))
+	for i := range subs {
+		if subs[i].Topic, errs[i] = c.internalTopic(subs[i].Topic); errs[i] == nil {
+			translated = append(translated, subs[i])
+		}
+	}
+	return translated, errs
+}
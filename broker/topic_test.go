@@ -0,0 +1,53 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/unit-io/unitd/config"
+	lp "github.com/unit-io/unitd/lineprotocol"
+	"github.com/unit-io/unitd/types"
+)
+
+func TestInternalTopic(t *testing.T) {
+	c := &Conn{mqttTopics: true}
+	for mqtt, topic := range map[string]string{
+		"KEY/a/+/#":              "KEY/a.*...",
+		"$share/g/KEY/a/b":       "$share/g/KEY/a.b",
+		"unitd/clientid/list":    "unitd/clientid/list",
+		"unitd/presence/KEY/a/b": "unitd/presence/KEY/a.b",
+	} {
+		text, err := c.internalTopic([]byte(mqtt))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(topic), text)
+	}
+	for _, mqtt := range []string{"KEY/a/b.c", "KEY/a/#/b", "KEY/a//b"} {
+		_, err := c.internalTopic([]byte(mqtt))
+		assert.Equal(t, types.ErrBadRequest, err, mqtt)
+	}
+
+	subs, errs := c.internalTopics([]lp.TopicQOSTuple{{Topic: []byte("KEY/a.b")}, {Topic: []byte("KEY/a/b")}})
+	assert.Equal(t, []lp.TopicQOSTuple{{Topic: []byte("KEY/a.b")}}, subs)
+	assert.Equal(t, []*types.Error{types.ErrBadRequest, nil}, errs)
+
+	c.insecure = true
+	text, err := c.internalTopic([]byte("a/b?ttl=30m"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a.b?ttl=30m"), text)
+
+	c = &Conn{}
+	text, err = c.internalTopic([]byte("KEY/a/b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("KEY/a/b"), text)
+}
+
+func TestMQTTTopics(t *testing.T) {
+	s := &Service{topics: config.TopicConfig{Listeners: map[string]bool{"listen": true}}}
+	assert.True(t, s.mqttTopics("listen", lp.Properties{}))
+	assert.False(t, s.mqttTopics("grpc_listen", lp.Properties{}))
+
+	props := lp.Properties{UserProperties: []lp.UserProperty{{Key: []byte(topicModeProperty), Value: []byte("unitd")}}}
+	assert.False(t, s.mqttTopics("listen", props))
+	props.UserProperties[0].Value = []byte(topicModeMQTT)
+	assert.True(t, s.mqttTopics("grpc_listen", props))
+}
@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/unit-io/unitd/config"
+	"github.com/unit-io/unitd/pkg/crypto"
+)
+
+// Time to wait for the unseal command to print the key-encryption key.
+const unsealCommandTimeout = 30 * time.Second
+
+var errNoKEK = errors.New("unseal: sealed key found but no key-encryption key is configured")
+
+// LoadKEK reads the key-encryption key from the file, the environment variable or the output of the command.
+func LoadKEK(cfg config.UnsealConfig) ([]byte, error) {
+	var text []byte
+	switch {
+	case cfg.File != "":
+		b, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		text = b
+	case cfg.Env != "":
+		v, ok := os.LookupEnv(cfg.Env)
+		if !ok {
+			return nil, errors.New("unseal: environment variable " + cfg.Env + " is not set")
+		}
+		text = []byte(v)
+	case len(cfg.Command) > 0:
+		ctx, cancel := context.WithTimeout(context.Background(), unsealCommandTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, cfg.Command[0], cfg.Command[1:]...).Output()
+		if err != nil {
+			return nil, errors.New("unseal: command failed: " + err.Error())
+		}
+		text = out
+	default:
+		return nil, errNoKEK
+	}
+	return crypto.ParseKEK(text)
+}
+
+// unsealer unseals the sealed keys, the key-encryption key is loaded once the first sealed key is found.
+type unsealer struct {
+	cfg config.UnsealConfig
+	kek []byte
+}
+
+// key returns the key, the key is unsealed if it is sealed.
+func (u *unsealer) key(key string, sealed bool) ([]byte, error) {
+	if !sealed {
+		return []byte(key), nil
+	}
+	if u.kek == nil {
+		kek, err := LoadKEK(u.cfg)
+		if err != nil {
+			return nil, err
+		}
+		u.kek = kek
+	}
+	return crypto.Unseal(u.kek, key)
+}
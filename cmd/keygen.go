@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/unit-io/unitd/message/security"
 	"github.com/unit-io/unitd/pkg/hash"
@@ -37,6 +38,12 @@ func (m *keyGenRequest) access() uint32 {
 			required |= security.AllowRead
 		case 'w':
 			required |= security.AllowWrite
+		case 'p':
+			required |= security.AllowPresence
+		case 'l', 'h':
+			required |= security.AllowHistory
+		case 'e':
+			required |= security.AllowExtend
 		}
 	}
 
@@ -56,6 +63,6 @@ func generateKey() {
 		Type:  "rwp",
 	}
 
-	key, _ := security.GenerateKey(uint32(3376684800), []byte(message.Topic), message.access())
+	key, _ := security.GenerateKey(uint32(3376684800), []byte(message.Topic), message.access(), time.Time{}, nil)
 	fmt.Println("Key: ", key)
 }
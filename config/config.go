@@ -29,12 +29,59 @@ type Config struct {
 	// Default logging level is "InfoLevel" so to enable the debug log set the "LogLevel" to "DebugLevel".
 	LoggingLevel string `json:"logging_level"`
 
+	// Minimum keepalive in seconds, a lower keepalive requested by the client is raised to this value.
+	MinKeepAlive int `json:"min_keepalive"`
+
+	// Maximum keepalive in seconds, a higher keepalive requested by the client is lowered to this value.
+	// A keepalive of zero requested by the client disables the keepalive.
+	// The MQTT 3.1.1 clients are not informed of the keepalive lowered, those must send a packet within this value.
+	MaxKeepAlive int `json:"max_keepalive"`
+
+	// Maximum session expiry interval in seconds for persistent sessions. It is also used for
+	// clients those connect without clean session and do not request a session expiry interval.
+	MaxSessionExpiry int `json:"max_session_expiry"`
+
+	// Maximum time-to-live in seconds of a message, a higher ttl requested by the publisher
+	// with the topic option "?ttl=" is lowered to this value.
+	MaxMessageTTL int `json:"max_message_ttl"`
+
+	// Interval in seconds to resend the QoS 1 and QoS 2 messages not acknowledged by the client.
+	RetryInterval int `json:"retry_interval"`
+
+	// Maximum number of times a message is sent to the client before it is dropped, zero means
+	// the message is resent until acknowledged.
+	MaxRetryAttempts int `json:"max_retry_attempts"`
+
 	// MaxMessageSize     int             `json:"max_message_size"`
-	// // Maximum number of topic subscribers.
-	// MaxSubscriberCount int             `json:"max_subscriber_count"`
+	// Maximum number of subscribers per shared subscription group.
+	MaxSubscriberCount int `json:"max_subscriber_count"`
+
+	// Strategy to select a member of the shared subscription group "round_robin" or "least_loaded".
+	SharedSubscription string `json:"shared_subscription"`
 
 	EncryptionConfig json.RawMessage `json:"encryption_config"`
 
+	// Config for the encryption keys rotated with the encryption config key
+	KeyringConfig json.RawMessage `json:"keyring_config"`
+
+	// Config for the key-encryption key to unseal the sealed keys
+	UnsealConfig json.RawMessage `json:"unseal_config"`
+
+	// Config for the encryption of the message payloads stored in the database
+	StorageEncryptionConfig json.RawMessage `json:"storage_encryption_config"`
+
+	// Config for username and password authentication
+	AuthConfig json.RawMessage `json:"auth_config"`
+
+	// Config for the insecure flag provided by the client during connect
+	InsecureConfig json.RawMessage `json:"insecure_config"`
+
+	// Config for the quotas of the contracts
+	QuotaConfig json.RawMessage `json:"quota_config"`
+
+	// Config for the MQTT-standard topics with the '/' separator and the '+' and '#' wildcards
+	TopicConfig json.RawMessage `json:"topic_config"`
+
 	// Configs for subsystems
 	Cluster json.RawMessage `json:"cluster_config"`
 
@@ -54,8 +101,8 @@ type EncryptionConfig struct {
 	// Key identifier. it is useful when you use multiple keys.
 	Identifier string `json:"identifier"`
 
-	// slealed flag tells if key in the configuration is sealed.
-	Sealed bool `json:"slealed"`
+	// sealed flag tells if key in the configuration is sealed with the key-encryption key.
+	Sealed bool `json:"sealed"`
 
 	// timestamp is helpful to determine the latest key in case of keyroll over.
 	Timestamp uint32 `json:"timestamp,omitempty"`
@@ -70,6 +117,207 @@ func (c *Config) Encryption(encrConfig json.RawMessage) EncryptionConfig {
 	return encr
 }
 
+// KeyringConfig represents the configuration for the rotation of the encryption keys.
+type KeyringConfig struct {
+	// Keys in addition to the encryption config key. The key with the latest timestamp encrypts the new client Ids.
+	Keys []EncryptionConfig `json:"keys,omitempty"`
+
+	// Grace period in seconds the client Ids encrypted with an older key are accepted after a newer key
+	// timestamp, the older key is retired after the grace period. Zero means the keys are not retired.
+	GracePeriod int `json:"grace_period"`
+}
+
+func (c *Config) Keyring(keyringConfig json.RawMessage) KeyringConfig {
+	var keyring KeyringConfig
+	if len(keyringConfig) == 0 {
+		return keyring
+	}
+	if err := json.Unmarshal(keyringConfig, &keyring); err != nil {
+		log.Fatal("config.Keyring", "error in parsing keyring config", err)
+	}
+
+	return keyring
+}
+
+// UnsealConfig represents the configuration for the key-encryption key to unseal the sealed keys.
+// The key-encryption key is 32 bytes base64-encoded, taken from the first source configured.
+type UnsealConfig struct {
+	// File is the path to the file with the key-encryption key.
+	File string `json:"file,omitempty"`
+
+	// Env is the environment variable with the key-encryption key.
+	Env string `json:"env,omitempty"`
+
+	// Command is run at startup and the key-encryption key is read from its output.
+	Command []string `json:"command,omitempty"`
+}
+
+func (c *Config) Unseal(unsealConfig json.RawMessage) UnsealConfig {
+	var unseal UnsealConfig
+	if len(unsealConfig) == 0 {
+		return unseal
+	}
+	if err := json.Unmarshal(unsealConfig, &unseal); err != nil {
+		log.Fatal("config.Unseal", "error in parsing unseal config", err)
+	}
+
+	return unseal
+}
+
+// StorageEncryptionConfig represents the configuration for the encryption of the payloads at rest.
+type StorageEncryptionConfig struct {
+	// Enabled flag tells if the payloads are encrypted before those are stored.
+	Enabled bool `json:"enabled"`
+
+	// Identifier of the key to encrypt the payloads. The encryption config key is used if it is not set.
+	Identifier string `json:"identifier,omitempty"`
+
+	// chacha20poly1305 storage keys by identifier. The keys rotated out are kept to decrypt the payloads stored earlier.
+	Keys map[string]string `json:"keys,omitempty"`
+
+	// sealed flag tells if the storage keys are sealed with the key-encryption key.
+	Sealed bool `json:"sealed"`
+}
+
+func (c *Config) StorageEncryption(storageConfig json.RawMessage) StorageEncryptionConfig {
+	var storage StorageEncryptionConfig
+	if len(storageConfig) == 0 {
+		return storage
+	}
+	if err := json.Unmarshal(storageConfig, &storage); err != nil {
+		log.Fatal("config.StorageEncryption", "error in parsing storage encryption config", err)
+	}
+
+	return storage
+}
+
+// AuthConfig represents the configuration for the username and password authentication.
+type AuthConfig struct {
+	// Type of the authenticator "htpasswd" or "http". Authentication is disabled if type is empty.
+	Type string `json:"type"`
+
+	// File is the path to htpasswd file with bcrypt hashed passwords.
+	File string `json:"file,omitempty"`
+
+	// Contracts maps the users in the htpasswd file to the contracts.
+	Contracts map[string]uint32 `json:"contracts,omitempty"`
+
+	// URL of the HTTP endpoint to authenticate the users.
+	URL string `json:"url,omitempty"`
+
+	// Timeout for the HTTP endpoint call.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+func (c *Config) Auth(authConfig json.RawMessage) AuthConfig {
+	var auth AuthConfig
+	if len(authConfig) == 0 {
+		return auth
+	}
+	if err := json.Unmarshal(authConfig, &auth); err != nil {
+		log.Fatal("config.Auth", "error in parsing auth config", err)
+	}
+
+	return auth
+}
+
+// InsecureConfig represents the policy for the insecure flag provided by the client during connect.
+// The contract setting takes precedence over the listener setting, and the listener setting
+// takes precedence over the global setting.
+type InsecureConfig struct {
+	// Allow is the global setting to allow the insecure flag, it is allowed if the config is not present.
+	Allow bool `json:"allow"`
+
+	// Listeners overrides the global setting for a listener, listeners are named by their config key "listen" or "grpc_listen".
+	Listeners map[string]bool `json:"listeners,omitempty"`
+
+	// Contracts overrides the global and listener settings for a contract.
+	Contracts map[uint32]bool `json:"contracts,omitempty"`
+}
+
+func (c *Config) Insecure(insecureConfig json.RawMessage) InsecureConfig {
+	insecure := InsecureConfig{Allow: true}
+	if len(insecureConfig) == 0 {
+		return insecure
+	}
+	if err := json.Unmarshal(insecureConfig, &insecure); err != nil {
+		log.Fatal("config.Insecure", "error in parsing insecure config", err)
+	}
+
+	return insecure
+}
+
+// Quota represents the limits of a contract, a zero limit is not enforced.
+type Quota struct {
+	// Messages per second the clients of the contract are allowed to publish.
+	MessagesPerSec int `json:"messages_per_sec,omitempty"`
+
+	// Payload bytes per second the clients of the contract are allowed to publish.
+	BytesPerSec int `json:"bytes_per_sec,omitempty"`
+
+	// Maximum number of connections of the contract.
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// Maximum number of subscriptions of the contract.
+	MaxSubscriptions int `json:"max_subscriptions,omitempty"`
+
+	// Maximum payload bytes of the messages stored for the contract and not yet expired, the messages
+	// without ttl are counted until the maximum message ttl.
+	MaxStoredBytes int64 `json:"max_stored_bytes,omitempty"`
+}
+
+// QuotaConfig represents the configuration for the quotas of the contracts.
+type QuotaConfig struct {
+	// Default quota for the contracts those do not have a quota.
+	Default Quota `json:"default"`
+
+	// Contracts overrides the default quota for a contract.
+	Contracts map[uint32]Quota `json:"contracts,omitempty"`
+
+	// Address to listen on for the admin API to get and set the quotas, the API is disabled if it is empty.
+	AdminListen string `json:"admin_listen,omitempty"`
+
+	// Bearer token the admin API requests must provide, the admin API listens only on localhost
+	// if the token is empty.
+	AdminToken string `json:"admin_token,omitempty"`
+}
+
+func (c *Config) Quota(quotaConfig json.RawMessage) QuotaConfig {
+	var quota QuotaConfig
+	if len(quotaConfig) == 0 {
+		return quota
+	}
+	if err := json.Unmarshal(quotaConfig, &quota); err != nil {
+		log.Fatal("config.Quota", "error in parsing quota config", err)
+	}
+
+	return quota
+}
+
+// TopicConfig represents the topic mode of the connections. The connections using the MQTT-standard topics
+// subscribe to "key/a/+/#" and receive the messages on "a/b", the topics are translated to "key/a.*..." and "a.b".
+// The listener setting takes precedence over the global setting, and a MQTT 5 client may choose the
+// topic mode of the connection with the user property "topic-mode" set to "mqtt" or "unitd" during connect.
+type TopicConfig struct {
+	// MQTT is the global setting to use the MQTT-standard topics.
+	MQTT bool `json:"mqtt"`
+
+	// Listeners overrides the global setting for a listener, listeners are named by their config key "listen" or "grpc_listen".
+	Listeners map[string]bool `json:"listeners,omitempty"`
+}
+
+func (c *Config) Topic(topicConfig json.RawMessage) TopicConfig {
+	var topic TopicConfig
+	if len(topicConfig) == 0 {
+		return topic
+	}
+	if err := json.Unmarshal(topicConfig, &topic); err != nil {
+		log.Fatal("config.Topic", "error in parsing topic config", err)
+	}
+
+	return topic
+}
+
 // StoreConfig represents the configuration for the store.
 type StoreConfig struct {
 	// clean cleans logs to start clean and reset message store on service restart
@@ -39,7 +39,7 @@ type Adapter interface {
 	// Get performs a query and attempts to fetch last n messages where
 	// n is specified by limit argument. From and until times can also be specified
 	// for time-series retrieval.
-	Get(contract uint32, topic []byte) ([][]byte, error)
+	Get(contract uint32, topic []byte, limit int) ([][]byte, error)
 
 	// NewID generate messageId that can later used to store and delete message from message store
 	NewID() ([]byte, error)
@@ -38,8 +38,6 @@ type configType struct {
 const (
 	// Maximum number of records to return
 	maxResults = 1024
-	// Maximum TTL for message
-	maxTTL = "24h"
 )
 
 // Store represents an SSD-optimized storage store.
@@ -150,10 +148,14 @@ func (a *adapter) PutWithID(contract uint32, messageId, topic, payload []byte) e
 // Get performs a query and attempts to fetch last n messages where
 // n is specified by limit argument. From and until times can also be specified
 // for time-series retrieval.
-func (a *adapter) Get(contract uint32, topic []byte) (matches [][]byte, err error) {
+func (a *adapter) Get(contract uint32, topic []byte, limit int) (matches [][]byte, err error) {
+	if limit <= 0 || limit > maxResults {
+		limit = maxResults
+	}
 	// Iterating over key/value pairs.
 	query := unitdb.NewQuery(topic)
 	query.WithContract(contract)
+	query.WithLimit(limit)
 	return a.db.Get(query)
 }
 
@@ -2,9 +2,13 @@ package lineprotocol
 
 import (
 	"bytes"
+	"errors"
 	"io"
 )
 
+// ErrMalformedPacket occurs when a packet cannot be decoded, it is answered with the reason code malformed packet.
+var ErrMalformedPacket = errors.New("Malformed packet")
+
 //Packet is the interface all our packets in the line protocol will be implementing
 type Packet interface {
 	Type() uint8
@@ -43,6 +47,44 @@ type FixedHeader struct {
 	RemainingLength int
 }
 
+// UserProperty is a name and value pair sent as MQTT 5 user property.
+type UserProperty struct {
+	Key   []byte
+	Value []byte
+}
+
+// Properties represents the MQTT 5 properties of a packet. The zero value of a
+// property means the property is not present in the packet.
+type Properties struct {
+	PayloadFormat          *uint8
+	MessageExpiry          uint32
+	ContentType            []byte
+	ResponseTopic          []byte
+	CorrelationData        []byte
+	SubscriptionIdentifier []uint32
+	SessionExpiry          uint32
+	AssignedClientID       []byte
+	ServerKeepAlive        *uint16
+	AuthMethod             []byte
+	AuthData               []byte
+	RequestProblemInfo     *uint8
+	WillDelayInterval      uint32
+	RequestResponseInfo    *uint8
+	ResponseInfo           []byte
+	ServerReference        []byte
+	ReasonString           []byte
+	ReceiveMaximum         uint16
+	TopicAliasMaximum      uint16
+	TopicAlias             uint16
+	MaximumQos             *uint8
+	RetainAvailable        *uint8
+	UserProperties         []UserProperty
+	MaximumPacketSize      uint32
+	WildcardSubAvailable   *uint8
+	SubIDAvailable         *uint8
+	SharedSubAvailable     *uint8
+}
+
 // Connect represents a connect packet.
 type Connect struct {
 	ProtoName      []byte
@@ -60,6 +102,8 @@ type Connect struct {
 	WillMessage    []byte
 	Username       []byte
 	Password       []byte
+	Properties     Properties
+	WillProperties Properties
 
 	Packet
 }
@@ -71,9 +115,12 @@ type Connect struct {
 // 0x03 refused server unavailiable
 // 0x04 bad user or password
 // 0x05 not authorized
+// The return code is sent as equivalent reason code to the MQTT 5 clients.
 type Connack struct {
-	ReturnCode uint8
-	ConnID     uint32
+	SessionPresent bool
+	ReturnCode     uint8
+	ConnID         uint32
+	Properties     Properties
 	Packet
 }
 
@@ -89,6 +136,9 @@ type Pingresp struct {
 
 //Disconnect is to signal you want to cease communications with the server
 type Disconnect struct {
+	ReasonCode uint8
+	Properties Properties
+
 	Packet
 }
 
@@ -99,6 +149,7 @@ type Publish struct {
 	MessageID   uint16
 	IsForwarded bool
 	Payload     []byte
+	Properties  Properties
 
 	Packet
 }
@@ -106,7 +157,9 @@ type Publish struct {
 //Puback is sent for QOS level one to verify the receipt of a publish
 //Qoth the spec: "A PUBACK Packet is sent by a server in response to a PUBLISH Packet from a publishing client, and by a subscriber in response to a PUBLISH Packet from the server."
 type Puback struct {
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode uint8
+	Properties Properties
 
 	Packet
 }
@@ -115,7 +168,9 @@ type Puback struct {
 //Qoth the spec:"It is the second Packet of the QoS level 2 protocol flow. A PUBREC Packet is sent by the server in response to a PUBLISH Packet from a publishing client, or by a subscriber in response to a PUBLISH Packet from the server."
 type Pubrec struct {
 	FixedHeader
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode uint8
+	Properties Properties
 
 	Packet
 }
@@ -123,7 +178,9 @@ type Pubrec struct {
 //Pubrel is a response to pubrec from either the client or server.
 type Pubrel struct {
 	FixedHeader
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode uint8
+	Properties Properties
 
 	Packet
 }
@@ -131,7 +188,9 @@ type Pubrel struct {
 //Pubcomp is for saying is in response to a pubrel sent by the publisher
 //the final member of the QOS2 flow. both sides have said "hey, we did it!"
 type Pubcomp struct {
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode uint8
+	Properties Properties
 
 	Packet
 }
@@ -141,6 +200,10 @@ type Pubcomp struct {
 type TopicQOSTuple struct {
 	Qos   uint8
 	Topic []byte
+	// MQTT 5 subscription options
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    uint8
 }
 
 //Subscribe tells the server which topics the client would like to subscribe to
@@ -149,14 +212,16 @@ type Subscribe struct {
 	MessageID     uint16
 	IsForwarded   bool
 	Subscriptions []TopicQOSTuple
+	Properties    Properties
 
 	Packet
 }
 
 //Suback is to say "hey, you got it buddy. I will send you messages that fit this pattern"
 type Suback struct {
-	MessageID uint16
-	Qos       []uint8
+	MessageID  uint16
+	Qos        []uint8
+	Properties Properties
 
 	Packet
 }
@@ -167,13 +232,16 @@ type Unsubscribe struct {
 	MessageID     uint16
 	IsForwarded   bool
 	Subscriptions []TopicQOSTuple
+	Properties    Properties
 
 	Packet
 }
 
 //Unsuback is to unsubscribe as suback is to subscribe
 type Unsuback struct {
-	MessageID uint16
+	MessageID   uint16
+	ReasonCodes []uint8 // Reason codes for each subscription sent to the MQTT 5 clients.
+	Properties  Properties
 
 	Packet
 }
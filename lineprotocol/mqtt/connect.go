@@ -24,11 +24,17 @@ func encodeConnect(c lp.Connect) (bytes.Buffer, error) {
 	msg.WriteByte(flagByte)
 
 	msg.Write(encodeUint16(c.KeepAlive))
+	if c.Version == protoVersion5 {
+		msg.Write(encodeProperties(c.Properties))
+	}
 	msg.Write(encodeBytes(c.ClientID))
 
 	if c.WillFlag {
-		msg.Write(c.WillTopic)
-		msg.Write(c.WillMessage)
+		if c.Version == protoVersion5 {
+			msg.Write(encodeProperties(c.WillProperties))
+		}
+		msg.Write(encodeBytes(c.WillTopic))
+		msg.Write(encodeBytes(c.WillMessage))
 	}
 
 	if c.UsernameFlag {
@@ -46,15 +52,20 @@ func encodeConnect(c lp.Connect) (bytes.Buffer, error) {
 	return packet, err
 }
 
-func encodeConnack(c lp.Connack) (bytes.Buffer, error) {
+func encodeConnack(c lp.Connack, version uint8) (bytes.Buffer, error) {
 	var msg bytes.Buffer
 
 	//msg.Write(reserveForHeader)
-	msg.WriteByte(byte(0))
-	msg.WriteByte(byte(c.ReturnCode))
+	msg.WriteByte(byte(boolToUInt8(c.SessionPresent)))
+	if version == protoVersion5 {
+		msg.WriteByte(byte(connackReasonCode(c.ReturnCode)))
+		msg.Write(encodeProperties(c.Properties))
+	} else {
+		msg.WriteByte(byte(c.ReturnCode))
+	}
 
 	// Write to the underlying buffer
-	fh := FixedHeader{MessageType: lp.CONNACK, RemainingLength: 2}
+	fh := FixedHeader{MessageType: lp.CONNACK, RemainingLength: msg.Len()}
 	packet := fh.pack(nil)
 	_, err := packet.Write(msg.Bytes())
 	return packet, err
@@ -70,28 +81,50 @@ func encodePingreq(p lp.Pingreq) (bytes.Buffer, error) {
 // Encode encodes message into binary data
 func encodePingresp(p lp.Pingresp) (bytes.Buffer, error) {
 	var msg bytes.Buffer
-	_, err := msg.Write([]byte{0xc0, 0x0})
+	_, err := msg.Write([]byte{0xd0, 0x0})
 	return msg, err
 }
 
 // Encode encodes message into binary data
-func encodeDisconnect(d lp.Disconnect) (bytes.Buffer, error) {
+func encodeDisconnect(d lp.Disconnect, version uint8) (bytes.Buffer, error) {
 	var msg bytes.Buffer
-	_, err := msg.Write([]byte{0xc0, 0x0})
-	return msg, err
+	if version == protoVersion5 {
+		msg.WriteByte(d.ReasonCode)
+		msg.Write(encodeProperties(d.Properties))
+	}
+
+	// Write to the underlying buffer
+	fh := FixedHeader{MessageType: lp.DISCONNECT, RemainingLength: msg.Len()}
+	packet := fh.pack(nil)
+	_, err := packet.Write(msg.Bytes())
+	return packet, err
 }
 
-func unpackConnect(data []byte, fh FixedHeader) lp.Packet {
-	//TODO: Decide how to recover rom invalid packets (offsets don't equal actual reading?)
+func unpackConnect(data []byte, fh FixedHeader) (*lp.Connect, error) {
 	bookmark := uint32(0)
 
-	protoname := readString(data, &bookmark)
+	protoname, err := readString(data, &bookmark)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < int(bookmark)+4 {
+		return nil, lp.ErrMalformedPacket
+	}
 	ver := uint8(data[bookmark])
 	bookmark++
 	flags := data[bookmark]
 	bookmark++
-	keepalive := readUint16(data, &bookmark)
-	cliID := readString(data, &bookmark)
+	keepalive, _ := readUint16(data, &bookmark)
+	var props lp.Properties
+	if ver == protoVersion5 {
+		if props, err = unpackProperties(data, &bookmark); err != nil {
+			return nil, err
+		}
+	}
+	cliID, err := readString(data, &bookmark)
+	if err != nil {
+		return nil, err
+	}
 	connect := &lp.Connect{
 		ProtoName:      protoname,
 		Version:        ver,
@@ -100,34 +133,60 @@ func unpackConnect(data []byte, fh FixedHeader) lp.Packet {
 		UsernameFlag:   flags&(1<<7) > 0,
 		PasswordFlag:   flags&(1<<6) > 0,
 		WillRetainFlag: flags&(1<<5) > 0,
-		WillQOS:        (flags & (1 << 4)) + (flags & (1 << 3)),
+		WillQOS:        (flags >> 3) & 0x03,
 		WillFlag:       flags&(1<<2) > 0,
 		CleanSessFlag:  flags&(1<<1) > 0,
+		Properties:     props,
 	}
 
 	if connect.WillFlag {
-		connect.WillTopic = readString(data, &bookmark)
-		connect.WillMessage = readString(data, &bookmark)
+		if ver == protoVersion5 {
+			if connect.WillProperties, err = unpackProperties(data, &bookmark); err != nil {
+				return nil, err
+			}
+		}
+		if connect.WillTopic, err = readString(data, &bookmark); err != nil {
+			return nil, err
+		}
+		if connect.WillMessage, err = readString(data, &bookmark); err != nil {
+			return nil, err
+		}
 	}
 
 	if connect.UsernameFlag {
-		connect.Username = readString(data, &bookmark)
+		if connect.Username, err = readString(data, &bookmark); err != nil {
+			return nil, err
+		}
 	}
 
 	if connect.PasswordFlag {
-		connect.Password = readString(data, &bookmark)
+		if connect.Password, err = readString(data, &bookmark); err != nil {
+			return nil, err
+		}
 	}
-	return connect
+	return connect, nil
 }
 
-func unpackConnack(data []byte, fh FixedHeader) lp.Packet {
+func unpackConnack(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
+	if len(data) < 2 {
+		return nil, lp.ErrMalformedPacket
+	}
 	//first byte is weird in connack
-	bookmark := uint32(1)
-	retcode := data[bookmark]
-
-	return &lp.Connack{
-		ReturnCode: retcode,
+	bookmark := uint32(0)
+	connack := &lp.Connack{
+		SessionPresent: data[bookmark]&0x01 > 0,
 	}
+	bookmark++
+	connack.ReturnCode = data[bookmark]
+	bookmark++
+	if version == protoVersion5 && int(bookmark) < len(data) {
+		var err error
+		if connack.Properties, err = unpackProperties(data, &bookmark); err != nil {
+			return nil, err
+		}
+	}
+
+	return connack, nil
 }
 
 func unpackPingreq(data []byte, fh FixedHeader) lp.Packet {
@@ -138,6 +197,19 @@ func unpackPingresp(data []byte, fh FixedHeader) lp.Packet {
 	return &lp.Pingresp{}
 }
 
-func unpackDisconnect(data []byte, fh FixedHeader) lp.Packet {
-	return &lp.Disconnect{}
+func unpackDisconnect(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
+	disconnect := &lp.Disconnect{}
+	if version != protoVersion5 || len(data) == 0 {
+		return disconnect, nil
+	}
+	bookmark := uint32(0)
+	disconnect.ReasonCode = data[bookmark]
+	bookmark++
+	if int(bookmark) < len(data) {
+		var err error
+		if disconnect.Properties, err = unpackProperties(data, &bookmark); err != nil {
+			return nil, err
+		}
+	}
+	return disconnect, nil
 }
@@ -11,7 +11,9 @@ import (
 
 type FixedHeader lp.FixedHeader
 
+// LineProto is the MQTT line protocol for a connection. The MQTT version is chosen from the connect packet.
 type LineProto struct {
+	version uint8
 }
 
 // ReadPacket unpacks the packet from the provided reader.
@@ -28,7 +30,9 @@ func (p *LineProto) ReadPacket(r io.Reader) (lp.Packet, error) {
 	case lp.PINGRESP:
 		return &lp.Pingresp{}, nil
 	case lp.DISCONNECT:
-		return &lp.Disconnect{}, nil
+		if fh.RemainingLength == 0 {
+			return &lp.Disconnect{}, nil
+		}
 	}
 
 	msg := make([]byte, fh.RemainingLength)
@@ -38,32 +42,42 @@ func (p *LineProto) ReadPacket(r io.Reader) (lp.Packet, error) {
 
 	// unpack the body
 	var pkt lp.Packet
+	var err error
 	switch fh.MessageType {
 	case lp.CONNECT:
-		pkt = unpackConnect(msg, fh)
+		var connect *lp.Connect
+		if connect, err = unpackConnect(msg, fh); err == nil {
+			p.version = connect.Version
+			pkt = connect
+		}
 	case lp.CONNACK:
-		pkt = unpackConnack(msg, fh)
+		pkt, err = unpackConnack(msg, fh, p.version)
+	case lp.DISCONNECT:
+		pkt, err = unpackDisconnect(msg, fh, p.version)
 	case lp.PUBLISH:
-		pkt = unpackPublish(msg, fh)
+		pkt, err = unpackPublish(msg, fh, p.version)
 	case lp.PUBACK:
-		pkt = unpackPuback(msg, fh)
+		pkt, err = unpackPuback(msg, fh, p.version)
 	case lp.PUBREC:
-		pkt = unpackPubrec(msg, fh)
+		pkt, err = unpackPubrec(msg, fh, p.version)
 	case lp.PUBREL:
-		pkt = unpackPubrel(msg, fh)
+		pkt, err = unpackPubrel(msg, fh, p.version)
 	case lp.PUBCOMP:
-		pkt = unpackPubcomp(msg, fh)
+		pkt, err = unpackPubcomp(msg, fh, p.version)
 	case lp.SUBSCRIBE:
-		pkt = unpackSubscribe(msg, fh)
+		pkt, err = unpackSubscribe(msg, fh, p.version)
 	case lp.SUBACK:
-		pkt = unpackSuback(msg, fh)
+		pkt, err = unpackSuback(msg, fh, p.version)
 	case lp.UNSUBSCRIBE:
-		pkt = unpackUnsubscribe(msg, fh)
+		pkt, err = unpackUnsubscribe(msg, fh, p.version)
 	case lp.UNSUBACK:
-		pkt = unpackUnsuback(msg, fh)
+		pkt, err = unpackUnsuback(msg, fh, p.version)
 	default:
 		return nil, fmt.Errorf("Invalid zero-length packet with type %d", fh.MessageType)
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	return pkt, nil
 }
@@ -77,27 +91,27 @@ func (p *LineProto) Encode(pkt lp.Packet) (bytes.Buffer, error) {
 	case lp.CONNECT:
 		return encodeConnect(*pkt.(*lp.Connect))
 	case lp.CONNACK:
-		return encodeConnack(*pkt.(*lp.Connack))
+		return encodeConnack(*pkt.(*lp.Connack), p.version)
 	case lp.DISCONNECT:
-		return encodeDisconnect(*pkt.(*lp.Disconnect))
+		return encodeDisconnect(*pkt.(*lp.Disconnect), p.version)
 	case lp.SUBSCRIBE:
-		return encodeSubscribe(*pkt.(*lp.Subscribe))
+		return encodeSubscribe(*pkt.(*lp.Subscribe), p.version)
 	case lp.SUBACK:
-		return encodeSuback(*pkt.(*lp.Suback))
+		return encodeSuback(*pkt.(*lp.Suback), p.version)
 	case lp.UNSUBSCRIBE:
-		return encodeUnsubscribe(*pkt.(*lp.Unsubscribe))
+		return encodeUnsubscribe(*pkt.(*lp.Unsubscribe), p.version)
 	case lp.UNSUBACK:
-		return encodeUnsuback(*pkt.(*lp.Unsuback))
+		return encodeUnsuback(*pkt.(*lp.Unsuback), p.version)
 	case lp.PUBLISH:
-		return encodePublish(*pkt.(*lp.Publish))
+		return encodePublish(*pkt.(*lp.Publish), p.version)
 	case lp.PUBACK:
-		return encodePuback(*pkt.(*lp.Puback))
+		return encodePuback(*pkt.(*lp.Puback), p.version)
 	case lp.PUBREC:
-		return encodePubrec(*pkt.(*lp.Pubrec))
+		return encodePubrec(*pkt.(*lp.Pubrec), p.version)
 	case lp.PUBREL:
-		return encodePubrel(*pkt.(*lp.Pubrel))
+		return encodePubrel(*pkt.(*lp.Pubrel), p.version)
 	case lp.PUBCOMP:
-		return encodePubcomp(*pkt.(*lp.Pubcomp))
+		return encodePubcomp(*pkt.(*lp.Pubcomp), p.version)
 	}
 	return bytes.Buffer{}, nil
 }
@@ -131,24 +145,36 @@ func (fh *FixedHeader) unpack(r io.Reader) error {
 		fh.Retain = controlByte&0x01 > 0
 	}
 
-	fh.RemainingLength = decodeLength(r)
+	length, err := decodeLength(r)
+	if err != nil {
+		return err
+	}
+	fh.RemainingLength = length
 	return nil
 }
 
 // -------------------------------------------------------------
-func readString(b []byte, startsAt *uint32) []byte {
-	l := readUint16(b, startsAt)
+// readString reads the string or the binary data prefixed with the length.
+func readString(b []byte, startsAt *uint32) ([]byte, error) {
+	l, err := readUint16(b, startsAt)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(*startsAt)+uint64(l) > uint64(len(b)) {
+		return nil, lp.ErrMalformedPacket
+	}
 	v := b[*startsAt : uint32(l)+*startsAt]
 	*startsAt += uint32(l)
-	return v
+	return v, nil
 }
 
-func readUint16(b []byte, startsAt *uint32) uint16 {
-	fst := uint16(b[*startsAt])
-	*startsAt++
-	snd := uint16(b[*startsAt])
-	*startsAt++
-	return (fst << 8) + snd
+func readUint16(b []byte, startsAt *uint32) (uint16, error) {
+	if uint64(*startsAt)+2 > uint64(len(b)) {
+		return 0, lp.ErrMalformedPacket
+	}
+	v := binary.BigEndian.Uint16(b[*startsAt:])
+	*startsAt += 2
+	return v, nil
 }
 
 func boolToUInt8(v bool) uint8 {
@@ -188,18 +214,21 @@ func encodeLength(length int) []byte {
 	return encLength
 }
 
-func decodeLength(r io.Reader) int {
+// decodeLength reads the remaining length, the length is at most four bytes long.
+func decodeLength(r io.Reader) (int, error) {
 	var rLength uint32
-	var multiplier uint32 = 0
+	var multiplier uint32
 	b := make([]byte, 1)
-	for {
-		io.ReadFull(r, b)
+	for multiplier < 28 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, err
+		}
 		digit := b[0]
 		rLength |= uint32(digit&127) << multiplier
 		if (digit & 128) == 0 {
-			break
+			return int(rLength), nil
 		}
 		multiplier += 7
 	}
-	return int(rLength)
+	return 0, lp.ErrMalformedPacket
 }
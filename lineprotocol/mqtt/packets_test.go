@@ -0,0 +1,170 @@
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	lp "github.com/unit-io/unitd/lineprotocol"
+)
+
+func TestConnectV5(t *testing.T) {
+	format := uint8(1)
+	connect := &lp.Connect{
+		ProtoName:   []byte("MQTT"),
+		Version:     protoVersion5,
+		KeepAlive:   60,
+		ClientID:    []byte("client"),
+		WillFlag:    true,
+		WillQOS:     1,
+		WillTopic:   []byte("dev.status"),
+		WillMessage: []byte("offline"),
+		Properties: lp.Properties{
+			SessionExpiry:  3600,
+			UserProperties: []lp.UserProperty{{Key: []byte("topic-mode"), Value: []byte("mqtt")}},
+		},
+		WillProperties: lp.Properties{PayloadFormat: &format, MessageExpiry: 30},
+	}
+	var client LineProto
+	m, err := client.Encode(connect)
+	assert.NoError(t, err)
+
+	var server LineProto
+	pkt, err := server.ReadPacket(bytes.NewReader(m.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(protoVersion5), server.version)
+	assert.Equal(t, connect, pkt)
+
+	// The connack return code is sent as MQTT 5 reason code.
+	m, err = server.Encode(&lp.Connack{ReturnCode: 0x05})
+	assert.NoError(t, err)
+	client.version = protoVersion5
+	pkt, err = client.ReadPacket(bytes.NewReader(m.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x87), pkt.(*lp.Connack).ReturnCode)
+}
+
+func TestPublishV5(t *testing.T) {
+	p := LineProto{version: protoVersion5}
+	pub := &lp.Publish{
+		FixedHeader: lp.FixedHeader{MessageType: lp.PUBLISH, Qos: 1},
+		Topic:       []byte("dev.temp"),
+		MessageID:   7,
+		Payload:     []byte("21"),
+		Properties: lp.Properties{
+			MessageExpiry:   10,
+			ContentType:     []byte("text/plain"),
+			ResponseTopic:   []byte("dev.reply"),
+			CorrelationData: []byte{1, 2, 3},
+		},
+	}
+	m, err := p.Encode(pub)
+	assert.NoError(t, err)
+	pkt, err := p.ReadPacket(bytes.NewReader(m.Bytes()))
+	assert.NoError(t, err)
+	pub.RemainingLength = pkt.(*lp.Publish).RemainingLength
+	assert.Equal(t, pub, pkt)
+
+	// Reason code and properties are omitted from a successful ack.
+	m, err = p.Encode(&lp.Puback{MessageID: 7})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x40, 0x02, 0x00, 0x07}, m.Bytes())
+
+	m, err = p.Encode(&lp.Puback{MessageID: 7, ReasonCode: 0x87, Properties: lp.Properties{ReasonString: []byte("not authorized")}})
+	assert.NoError(t, err)
+	pkt, err = p.ReadPacket(bytes.NewReader(m.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x87), pkt.(*lp.Puback).ReasonCode)
+	assert.Equal(t, []byte("not authorized"), pkt.(*lp.Puback).Properties.ReasonString)
+}
+
+func TestSubscribeV5(t *testing.T) {
+	p := LineProto{version: protoVersion5}
+	sub := &lp.Subscribe{
+		FixedHeader:   lp.FixedHeader{MessageType: lp.SUBSCRIBE, Qos: 1},
+		MessageID:     3,
+		Subscriptions: []lp.TopicQOSTuple{{Topic: []byte("dev.*"), Qos: 2, NoLocal: true, RetainHandling: 2}},
+		Properties:    lp.Properties{SubscriptionIdentifier: []uint32{300}},
+	}
+	m, err := p.Encode(sub)
+	assert.NoError(t, err)
+	pkt, err := p.ReadPacket(bytes.NewReader(m.Bytes()))
+	assert.NoError(t, err)
+	sub.RemainingLength = pkt.(*lp.Subscribe).RemainingLength
+	assert.Equal(t, sub, pkt)
+
+	m, err = p.Encode(&lp.Unsuback{MessageID: 3, ReasonCodes: []uint8{0x00, 0x80}})
+	assert.NoError(t, err)
+	pkt, err = p.ReadPacket(bytes.NewReader(m.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, []uint8{0x00, 0x80}, pkt.(*lp.Unsuback).ReasonCodes)
+
+	m, err = p.Encode(&lp.Disconnect{ReasonCode: 0x8E})
+	assert.NoError(t, err)
+	pkt, err = p.ReadPacket(bytes.NewReader(m.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x8E), pkt.(*lp.Disconnect).ReasonCode)
+}
+
+func TestV3Unchanged(t *testing.T) {
+	var p LineProto
+	m, err := p.Encode(&lp.Puback{MessageID: 7, ReasonCode: 0x87})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x40, 0x02, 0x00, 0x07}, m.Bytes())
+
+	m, err = p.Encode(&lp.Connack{ReturnCode: 0x05})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x20, 0x02, 0x00, 0x05}, m.Bytes())
+
+	m, err = p.Encode(&lp.Unsuback{MessageID: 3, ReasonCodes: []uint8{0x00}})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xb0, 0x02, 0x00, 0x03}, m.Bytes())
+}
+
+func TestMalformedProperties(t *testing.T) {
+	tests := []struct {
+		name  string
+		props []byte
+	}{
+		{"property length past the packet", []byte{0x05, propSessionExpiry, 0x00}},
+		{"property length too long", []byte{0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"truncated property length", []byte{0x80}},
+		{"truncated byte", []byte{0x01, propPayloadFormat}},
+		{"truncated uint16", []byte{0x02, propReceiveMaximum, 0x00}},
+		{"truncated uint32", []byte{0x03, propMessageExpiry, 0x00, 0x00}},
+		{"truncated string length", []byte{0x02, propContentType, 0x00}},
+		{"truncated string", []byte{0x04, propContentType, 0x00, 0x05, 'a'}},
+		{"string past the property length", []byte{0x03, propContentType, 0x00, 0x01, 'a'}},
+		{"truncated user property value", []byte{0x05, propUserProperty, 0x00, 0x01, 'k', 0x00}},
+		{"subscription identifier too long", []byte{0x06, propSubscriptionIdentifier, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"unknown property", []byte{0x02, 0x7F, 0x00}},
+	}
+	for _, tt := range tests {
+		bookmark := uint32(0)
+		_, err := unpackProperties(tt.props, &bookmark)
+		assert.Equal(t, lp.ErrMalformedPacket, err, tt.name)
+	}
+
+	// The malformed properties of a packet fail the packet.
+	p := LineProto{version: protoVersion5}
+	body := append([]byte{0x00, 0x03, 'a', '.', 'b'}, 0x03, propMessageExpiry, 0x00, 0x00)
+	packet := append([]byte{lp.PUBLISH << 4, byte(len(body))}, body...)
+	_, err := p.ReadPacket(bytes.NewReader(packet))
+	assert.Equal(t, lp.ErrMalformedPacket, err)
+}
+
+func FuzzReadPacket(f *testing.F) {
+	p := LineProto{version: protoVersion5}
+	m, _ := p.Encode(&lp.Publish{
+		FixedHeader: lp.FixedHeader{Qos: 1},
+		Topic:       []byte("a.b"),
+		MessageID:   1,
+		Properties:  lp.Properties{ContentType: []byte("text/plain"), UserProperties: []lp.UserProperty{{Key: []byte("k"), Value: []byte("v")}}},
+	})
+	f.Add(m.Bytes())
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		p := LineProto{version: protoVersion5}
+		// The packet is either decoded or refused, it never panics.
+		p.ReadPacket(bytes.NewReader(packet))
+	})
+}
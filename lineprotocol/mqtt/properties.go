@@ -0,0 +1,310 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	lp "github.com/unit-io/unitd/lineprotocol"
+)
+
+const (
+	// MQTT 5 protocol version
+	protoVersion5 = 5
+)
+
+// MQTT 5 property identifiers
+const (
+	propPayloadFormat          = 0x01
+	propMessageExpiry          = 0x02
+	propContentType            = 0x03
+	propResponseTopic          = 0x08
+	propCorrelationData        = 0x09
+	propSubscriptionIdentifier = 0x0B
+	propSessionExpiry          = 0x11
+	propAssignedClientID       = 0x12
+	propServerKeepAlive        = 0x13
+	propAuthMethod             = 0x15
+	propAuthData               = 0x16
+	propRequestProblemInfo     = 0x17
+	propWillDelayInterval      = 0x18
+	propRequestResponseInfo    = 0x19
+	propResponseInfo           = 0x1A
+	propServerReference        = 0x1C
+	propReasonString           = 0x1F
+	propReceiveMaximum         = 0x21
+	propTopicAliasMaximum      = 0x22
+	propTopicAlias             = 0x23
+	propMaximumQos             = 0x24
+	propRetainAvailable        = 0x25
+	propUserProperty           = 0x26
+	propMaximumPacketSize      = 0x27
+	propWildcardSubAvailable   = 0x28
+	propSubIDAvailable         = 0x29
+	propSharedSubAvailable     = 0x2A
+)
+
+// connackReasonCode maps the MQTT 3.1.1 connack return code to the MQTT 5 reason code.
+func connackReasonCode(returnCode uint8) uint8 {
+	switch returnCode {
+	case 0x01:
+		return 0x84 // Unsupported protocol version
+	case 0x02:
+		return 0x85 // Client identifier not valid
+	case 0x03:
+		return 0x88 // Server unavailable
+	case 0x04:
+		return 0x86 // Bad user name or password
+	case 0x05:
+		return 0x87 // Not authorized
+	}
+	return returnCode
+}
+
+// encodeProperties encodes the properties prefixed with the property length.
+func encodeProperties(p lp.Properties) []byte {
+	var msg bytes.Buffer
+	if p.PayloadFormat != nil {
+		msg.WriteByte(propPayloadFormat)
+		msg.WriteByte(*p.PayloadFormat)
+	}
+	if p.MessageExpiry != 0 {
+		msg.WriteByte(propMessageExpiry)
+		msg.Write(encodeUint32(p.MessageExpiry))
+	}
+	if p.ContentType != nil {
+		msg.WriteByte(propContentType)
+		msg.Write(encodeBytes(p.ContentType))
+	}
+	if p.ResponseTopic != nil {
+		msg.WriteByte(propResponseTopic)
+		msg.Write(encodeBytes(p.ResponseTopic))
+	}
+	if p.CorrelationData != nil {
+		msg.WriteByte(propCorrelationData)
+		msg.Write(encodeBytes(p.CorrelationData))
+	}
+	for _, id := range p.SubscriptionIdentifier {
+		msg.WriteByte(propSubscriptionIdentifier)
+		msg.Write(encodeLength(int(id)))
+	}
+	if p.SessionExpiry != 0 {
+		msg.WriteByte(propSessionExpiry)
+		msg.Write(encodeUint32(p.SessionExpiry))
+	}
+	if p.AssignedClientID != nil {
+		msg.WriteByte(propAssignedClientID)
+		msg.Write(encodeBytes(p.AssignedClientID))
+	}
+	if p.ServerKeepAlive != nil {
+		msg.WriteByte(propServerKeepAlive)
+		msg.Write(encodeUint16(*p.ServerKeepAlive))
+	}
+	if p.AuthMethod != nil {
+		msg.WriteByte(propAuthMethod)
+		msg.Write(encodeBytes(p.AuthMethod))
+	}
+	if p.AuthData != nil {
+		msg.WriteByte(propAuthData)
+		msg.Write(encodeBytes(p.AuthData))
+	}
+	if p.RequestProblemInfo != nil {
+		msg.WriteByte(propRequestProblemInfo)
+		msg.WriteByte(*p.RequestProblemInfo)
+	}
+	if p.WillDelayInterval != 0 {
+		msg.WriteByte(propWillDelayInterval)
+		msg.Write(encodeUint32(p.WillDelayInterval))
+	}
+	if p.RequestResponseInfo != nil {
+		msg.WriteByte(propRequestResponseInfo)
+		msg.WriteByte(*p.RequestResponseInfo)
+	}
+	if p.ResponseInfo != nil {
+		msg.WriteByte(propResponseInfo)
+		msg.Write(encodeBytes(p.ResponseInfo))
+	}
+	if p.ServerReference != nil {
+		msg.WriteByte(propServerReference)
+		msg.Write(encodeBytes(p.ServerReference))
+	}
+	if p.ReasonString != nil {
+		msg.WriteByte(propReasonString)
+		msg.Write(encodeBytes(p.ReasonString))
+	}
+	if p.ReceiveMaximum != 0 {
+		msg.WriteByte(propReceiveMaximum)
+		msg.Write(encodeUint16(p.ReceiveMaximum))
+	}
+	if p.TopicAliasMaximum != 0 {
+		msg.WriteByte(propTopicAliasMaximum)
+		msg.Write(encodeUint16(p.TopicAliasMaximum))
+	}
+	if p.TopicAlias != 0 {
+		msg.WriteByte(propTopicAlias)
+		msg.Write(encodeUint16(p.TopicAlias))
+	}
+	if p.MaximumQos != nil {
+		msg.WriteByte(propMaximumQos)
+		msg.WriteByte(*p.MaximumQos)
+	}
+	if p.RetainAvailable != nil {
+		msg.WriteByte(propRetainAvailable)
+		msg.WriteByte(*p.RetainAvailable)
+	}
+	for _, u := range p.UserProperties {
+		msg.WriteByte(propUserProperty)
+		msg.Write(encodeBytes(u.Key))
+		msg.Write(encodeBytes(u.Value))
+	}
+	if p.MaximumPacketSize != 0 {
+		msg.WriteByte(propMaximumPacketSize)
+		msg.Write(encodeUint32(p.MaximumPacketSize))
+	}
+	if p.WildcardSubAvailable != nil {
+		msg.WriteByte(propWildcardSubAvailable)
+		msg.WriteByte(*p.WildcardSubAvailable)
+	}
+	if p.SubIDAvailable != nil {
+		msg.WriteByte(propSubIDAvailable)
+		msg.WriteByte(*p.SubIDAvailable)
+	}
+	if p.SharedSubAvailable != nil {
+		msg.WriteByte(propSharedSubAvailable)
+		msg.WriteByte(*p.SharedSubAvailable)
+	}
+
+	return append(encodeLength(msg.Len()), msg.Bytes()...)
+}
+
+// unpackProperties reads the properties prefixed with the property length. The properties
+// running past the property length or past the packet are malformed.
+func unpackProperties(b []byte, startsAt *uint32) (lp.Properties, error) {
+	var p lp.Properties
+	length, err := readLength(b, startsAt)
+	if err != nil {
+		return p, err
+	}
+	if uint64(*startsAt)+uint64(length) > uint64(len(b)) {
+		return p, lp.ErrMalformedPacket
+	}
+	end := *startsAt + length
+	// The properties are read within the property length.
+	b = b[:end]
+	for *startsAt < end && err == nil {
+		id := b[*startsAt]
+		*startsAt++
+		switch id {
+		case propPayloadFormat:
+			p.PayloadFormat, err = readByte(b, startsAt)
+		case propMessageExpiry:
+			p.MessageExpiry, err = readUint32(b, startsAt)
+		case propContentType:
+			p.ContentType, err = readString(b, startsAt)
+		case propResponseTopic:
+			p.ResponseTopic, err = readString(b, startsAt)
+		case propCorrelationData:
+			p.CorrelationData, err = readString(b, startsAt)
+		case propSubscriptionIdentifier:
+			var id uint32
+			if id, err = readLength(b, startsAt); err == nil {
+				p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, id)
+			}
+		case propSessionExpiry:
+			p.SessionExpiry, err = readUint32(b, startsAt)
+		case propAssignedClientID:
+			p.AssignedClientID, err = readString(b, startsAt)
+		case propServerKeepAlive:
+			var keepalive uint16
+			if keepalive, err = readUint16(b, startsAt); err == nil {
+				p.ServerKeepAlive = &keepalive
+			}
+		case propAuthMethod:
+			p.AuthMethod, err = readString(b, startsAt)
+		case propAuthData:
+			p.AuthData, err = readString(b, startsAt)
+		case propRequestProblemInfo:
+			p.RequestProblemInfo, err = readByte(b, startsAt)
+		case propWillDelayInterval:
+			p.WillDelayInterval, err = readUint32(b, startsAt)
+		case propRequestResponseInfo:
+			p.RequestResponseInfo, err = readByte(b, startsAt)
+		case propResponseInfo:
+			p.ResponseInfo, err = readString(b, startsAt)
+		case propServerReference:
+			p.ServerReference, err = readString(b, startsAt)
+		case propReasonString:
+			p.ReasonString, err = readString(b, startsAt)
+		case propReceiveMaximum:
+			p.ReceiveMaximum, err = readUint16(b, startsAt)
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum, err = readUint16(b, startsAt)
+		case propTopicAlias:
+			p.TopicAlias, err = readUint16(b, startsAt)
+		case propMaximumQos:
+			p.MaximumQos, err = readByte(b, startsAt)
+		case propRetainAvailable:
+			p.RetainAvailable, err = readByte(b, startsAt)
+		case propUserProperty:
+			var key, value []byte
+			if key, err = readString(b, startsAt); err != nil {
+				break
+			}
+			if value, err = readString(b, startsAt); err == nil {
+				p.UserProperties = append(p.UserProperties, lp.UserProperty{Key: key, Value: value})
+			}
+		case propMaximumPacketSize:
+			p.MaximumPacketSize, err = readUint32(b, startsAt)
+		case propWildcardSubAvailable:
+			p.WildcardSubAvailable, err = readByte(b, startsAt)
+		case propSubIDAvailable:
+			p.SubIDAvailable, err = readByte(b, startsAt)
+		case propSharedSubAvailable:
+			p.SharedSubAvailable, err = readByte(b, startsAt)
+		default:
+			// The size of an unknown property is not known.
+			err = lp.ErrMalformedPacket
+		}
+	}
+	return p, err
+}
+
+func readByte(b []byte, startsAt *uint32) (*uint8, error) {
+	if int(*startsAt) >= len(b) {
+		return nil, lp.ErrMalformedPacket
+	}
+	v := b[*startsAt]
+	*startsAt++
+	return &v, nil
+}
+
+func readUint32(b []byte, startsAt *uint32) (uint32, error) {
+	if uint64(*startsAt)+4 > uint64(len(b)) {
+		return 0, lp.ErrMalformedPacket
+	}
+	v := binary.BigEndian.Uint32(b[*startsAt:])
+	*startsAt += 4
+	return v, nil
+}
+
+// readLength reads the variable byte integer, the integer is at most four bytes long.
+func readLength(b []byte, startsAt *uint32) (uint32, error) {
+	var v uint32
+	for i := 0; i < 4; i++ {
+		if int(*startsAt) >= len(b) {
+			return 0, lp.ErrMalformedPacket
+		}
+		digit := b[*startsAt]
+		*startsAt++
+		v |= uint32(digit&127) << (7 * i)
+		if (digit & 128) == 0 {
+			return v, nil
+		}
+	}
+	return 0, lp.ErrMalformedPacket
+}
+
+func encodeUint32(num uint32) []byte {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, num)
+	return bytes
+}
@@ -7,10 +7,14 @@ import (
 	lp "github.com/unit-io/unitd/lineprotocol"
 )
 
-func encodePublish(p lp.Publish) (bytes.Buffer, error) {
+func encodePublish(p lp.Publish, version uint8) (bytes.Buffer, error) {
 	var msg bytes.Buffer
+	var props []byte
 	var length int
-	length = 2 + len(p.Topic) + len(p.Payload)
+	if version == protoVersion5 {
+		props = encodeProperties(p.Properties)
+	}
+	length = 2 + len(p.Topic) + len(props) + len(p.Payload)
 	if p.FixedHeader.Qos > 0 {
 		length += 2
 	}
@@ -22,6 +26,7 @@ func encodePublish(p lp.Publish) (bytes.Buffer, error) {
 	if p.FixedHeader.Qos > 0 {
 		msg.Write(encodeUint16(p.MessageID))
 	}
+	msg.Write(props)
 	msg.Write(p.Payload)
 	// Write to the underlying buffer
 	fh := FixedHeader{MessageType: lp.PUBLISH, RemainingLength: length}
@@ -30,42 +35,89 @@ func encodePublish(p lp.Publish) (bytes.Buffer, error) {
 	return packet, nil
 }
 
-func encodePuback(p lp.Puback) (bytes.Buffer, error) {
-	fh := FixedHeader{MessageType: lp.PUBACK, RemainingLength: 2}
+// encodeAck encodes the message Id of the acknowledgement, and for the MQTT 5 clients
+// the reason code and properties. These are omitted on success if there are no properties.
+func encodeAck(msgID uint16, reasonCode uint8, props lp.Properties, version uint8) []byte {
+	msg := encodeUint16(msgID)
+	if version != protoVersion5 {
+		return msg
+	}
+	propBytes := encodeProperties(props)
+	if reasonCode == 0x00 && len(propBytes) == 1 {
+		return msg
+	}
+	msg = append(msg, reasonCode)
+	return append(msg, propBytes...)
+}
+
+// unpackAck reads the message Id of the acknowledgement, and for the MQTT 5 clients the reason code and properties.
+func unpackAck(data []byte, version uint8) (msgID uint16, reasonCode uint8, props lp.Properties, err error) {
+	bookmark := uint32(0)
+	if msgID, err = readUint16(data, &bookmark); err != nil {
+		return 0, 0, props, err
+	}
+	if version != protoVersion5 || int(bookmark) >= len(data) {
+		return msgID, 0x00, props, nil
+	}
+	reasonCode = data[bookmark]
+	bookmark++
+	if int(bookmark) < len(data) {
+		props, err = unpackProperties(data, &bookmark)
+	}
+	return msgID, reasonCode, props, err
+}
+
+func encodePuback(p lp.Puback, version uint8) (bytes.Buffer, error) {
+	msg := encodeAck(p.MessageID, p.ReasonCode, p.Properties, version)
+	fh := FixedHeader{MessageType: lp.PUBACK, RemainingLength: len(msg)}
 	packet := fh.pack(nil)
-	_, err := packet.Write(encodeUint16(p.MessageID))
+	_, err := packet.Write(msg)
 	return packet, err
 }
 
-func encodePubrec(p lp.Pubrec) (bytes.Buffer, error) {
-	fh := FixedHeader{MessageType: lp.PUBREC, RemainingLength: 2}
+func encodePubrec(p lp.Pubrec, version uint8) (bytes.Buffer, error) {
+	msg := encodeAck(p.MessageID, p.ReasonCode, p.Properties, version)
+	fh := FixedHeader{MessageType: lp.PUBREC, RemainingLength: len(msg)}
 	packet := fh.pack(&p.FixedHeader)
-	_, err := packet.Write(encodeUint16(p.MessageID))
+	_, err := packet.Write(msg)
 	return packet, err
 }
 
-func encodePubrel(p lp.Pubrel) (bytes.Buffer, error) {
+func encodePubrel(p lp.Pubrel, version uint8) (bytes.Buffer, error) {
 	// Write to the underlying buffer
-	fh := FixedHeader{MessageType: lp.PUBREL, RemainingLength: 2}
+	msg := encodeAck(p.MessageID, p.ReasonCode, p.Properties, version)
+	fh := FixedHeader{MessageType: lp.PUBREL, RemainingLength: len(msg)}
 	packet := fh.pack(&p.FixedHeader)
-	_, err := packet.Write(encodeUint16(p.MessageID))
+	_, err := packet.Write(msg)
 	return packet, err
 }
 
-func encodePubcomp(p lp.Pubcomp) (bytes.Buffer, error) {
+func encodePubcomp(p lp.Pubcomp, version uint8) (bytes.Buffer, error) {
 	// Write to the underlying buffer
-	fh := FixedHeader{MessageType: lp.PUBCOMP, RemainingLength: 2}
+	msg := encodeAck(p.MessageID, p.ReasonCode, p.Properties, version)
+	fh := FixedHeader{MessageType: lp.PUBCOMP, RemainingLength: len(msg)}
 	packet := fh.pack(nil)
-	_, err := packet.Write(encodeUint16(p.MessageID))
+	_, err := packet.Write(msg)
 	return packet, err
 }
 
-func unpackPublish(data []byte, fh FixedHeader) lp.Packet {
+func unpackPublish(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
 	bookmark := uint32(0)
-	topic := readString(data, &bookmark)
+	topic, err := readString(data, &bookmark)
+	if err != nil {
+		return nil, err
+	}
 	var msgID uint16
 	if fh.Qos > 0 {
-		msgID = readUint16(data, &bookmark)
+		if msgID, err = readUint16(data, &bookmark); err != nil {
+			return nil, err
+		}
+	}
+	var props lp.Properties
+	if version == protoVersion5 {
+		if props, err = unpackProperties(data, &bookmark); err != nil {
+			return nil, err
+		}
 	}
 
 	return &lp.Publish{
@@ -73,39 +125,56 @@ func unpackPublish(data []byte, fh FixedHeader) lp.Packet {
 		Topic:       topic,
 		Payload:     data[bookmark:],
 		MessageID:   msgID,
-	}
+		Properties:  props,
+	}, nil
 }
 
-func unpackPuback(data []byte, fh FixedHeader) lp.Packet {
-	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
-	return &lp.Puback{
-		MessageID: msgID,
+func unpackPuback(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
+	msgID, reasonCode, props, err := unpackAck(data, version)
+	if err != nil {
+		return nil, err
 	}
+	return &lp.Puback{
+		MessageID:  msgID,
+		ReasonCode: reasonCode,
+		Properties: props,
+	}, nil
 }
 
-func unpackPubrec(data []byte, fh FixedHeader) lp.Packet {
-	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
+func unpackPubrec(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
+	msgID, reasonCode, props, err := unpackAck(data, version)
+	if err != nil {
+		return nil, err
+	}
 	return &lp.Pubrec{
 		FixedHeader: lp.FixedHeader(fh),
 		MessageID:   msgID,
-	}
+		ReasonCode:  reasonCode,
+		Properties:  props,
+	}, nil
 }
 
-func unpackPubrel(data []byte, fh FixedHeader) lp.Packet {
-	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
+func unpackPubrel(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
+	msgID, reasonCode, props, err := unpackAck(data, version)
+	if err != nil {
+		return nil, err
+	}
 	return &lp.Pubrel{
 		FixedHeader: lp.FixedHeader(fh),
 		MessageID:   msgID,
-	}
+		ReasonCode:  reasonCode,
+		Properties:  props,
+	}, nil
 }
 
-func unpackPubcomp(data []byte, fh FixedHeader) lp.Packet {
-	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
-	return &lp.Pubcomp{
-		MessageID: msgID,
+func unpackPubcomp(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
+	msgID, reasonCode, props, err := unpackAck(data, version)
+	if err != nil {
+		return nil, err
 	}
+	return &lp.Pubcomp{
+		MessageID:  msgID,
+		ReasonCode: reasonCode,
+		Properties: props,
+	}, nil
 }
@@ -6,14 +6,23 @@ import (
 	lp "github.com/unit-io/unitd/lineprotocol"
 )
 
-func encodeSubscribe(s lp.Subscribe) (bytes.Buffer, error) {
+func encodeSubscribe(s lp.Subscribe, version uint8) (bytes.Buffer, error) {
 	var msg bytes.Buffer
 
 	//msg.Write(reserveForHeader)
 	msg.Write(encodeUint16(s.MessageID))
+	if version == protoVersion5 {
+		msg.Write(encodeProperties(s.Properties))
+	}
 	for _, sub := range s.Subscriptions {
 		msg.Write(encodeBytes(sub.Topic))
-		msg.WriteByte(byte(sub.Qos))
+		opts := sub.Qos
+		if version == protoVersion5 {
+			opts |= boolToUInt8(sub.NoLocal) << 2
+			opts |= boolToUInt8(sub.RetainAsPublished) << 3
+			opts |= sub.RetainHandling << 4
+		}
+		msg.WriteByte(byte(opts))
 	}
 
 	// Write to the underlying buffer
@@ -23,11 +32,14 @@ func encodeSubscribe(s lp.Subscribe) (bytes.Buffer, error) {
 	return packet, err
 }
 
-func encodeSuback(s lp.Suback) (bytes.Buffer, error) {
+func encodeSuback(s lp.Suback, version uint8) (bytes.Buffer, error) {
 	var msg bytes.Buffer
 
 	//msg.Write(reserveForHeader)
 	msg.Write(encodeUint16(s.MessageID))
+	if version == protoVersion5 {
+		msg.Write(encodeProperties(s.Properties))
+	}
 	for _, q := range s.Qos {
 		msg.WriteByte(byte(q))
 	}
@@ -39,11 +51,14 @@ func encodeSuback(s lp.Suback) (bytes.Buffer, error) {
 	return packet, err
 }
 
-func encodeUnsubscribe(u lp.Unsubscribe) (bytes.Buffer, error) {
+func encodeUnsubscribe(u lp.Unsubscribe, version uint8) (bytes.Buffer, error) {
 	var msg bytes.Buffer
 
 	//msg.Write(reserveForHeader)
 	msg.Write(encodeUint16(u.MessageID))
+	if version == protoVersion5 {
+		msg.Write(encodeProperties(u.Properties))
+	}
 	for _, sub := range u.Subscriptions {
 		msg.Write(encodeBytes(sub.Topic))
 	}
@@ -55,37 +70,73 @@ func encodeUnsubscribe(u lp.Unsubscribe) (bytes.Buffer, error) {
 	return packet, err
 }
 
-func encodeUnsuback(u lp.Unsuback) (bytes.Buffer, error) {
+func encodeUnsuback(u lp.Unsuback, version uint8) (bytes.Buffer, error) {
+	var msg bytes.Buffer
+
+	msg.Write(encodeUint16(u.MessageID))
+	if version == protoVersion5 {
+		msg.Write(encodeProperties(u.Properties))
+		msg.Write(u.ReasonCodes)
+	}
+
 	// Write to the underlying buffer
-	fh := FixedHeader{MessageType: lp.UNSUBACK, RemainingLength: 2}
+	fh := FixedHeader{MessageType: lp.UNSUBACK, RemainingLength: msg.Len()}
 	packet := fh.pack(nil)
-	_, err := packet.Write(encodeUint16(u.MessageID))
+	_, err := packet.Write(msg.Bytes())
 	return packet, err
 }
 
-func unpackSubscribe(data []byte, fh FixedHeader) lp.Packet {
+func unpackSubscribe(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
 	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
+	msgID, err := readUint16(data, &bookmark)
+	if err != nil {
+		return nil, err
+	}
+	var props lp.Properties
+	if version == protoVersion5 {
+		if props, err = unpackProperties(data, &bookmark); err != nil {
+			return nil, err
+		}
+	}
 	var topics []lp.TopicQOSTuple
 	maxlen := uint32(len(data))
 	for bookmark < maxlen {
 		var t lp.TopicQOSTuple
-		t.Topic = readString(data, &bookmark)
-		qos := data[bookmark]
-		bookmark++
-		t.Qos = uint8(qos)
+		if t.Topic, err = readString(data, &bookmark); err != nil {
+			return nil, err
+		}
+		opts, err := readByte(data, &bookmark)
+		if err != nil {
+			return nil, err
+		}
+		t.Qos = uint8(*opts & 0x03)
+		if version == protoVersion5 {
+			t.NoLocal = *opts&(1<<2) > 0
+			t.RetainAsPublished = *opts&(1<<3) > 0
+			t.RetainHandling = (*opts >> 4) & 0x03
+		}
 		topics = append(topics, t)
 	}
 	return &lp.Subscribe{
 		FixedHeader:   lp.FixedHeader(fh),
 		MessageID:     msgID,
 		Subscriptions: topics,
-	}
+		Properties:    props,
+	}, nil
 }
 
-func unpackSuback(data []byte, fh FixedHeader) lp.Packet {
+func unpackSuback(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
 	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
+	msgID, err := readUint16(data, &bookmark)
+	if err != nil {
+		return nil, err
+	}
+	var props lp.Properties
+	if version == protoVersion5 {
+		if props, err = unpackProperties(data, &bookmark); err != nil {
+			return nil, err
+		}
+	}
 	var qoses []uint8
 	maxlen := uint32(len(data))
 	for bookmark < maxlen {
@@ -94,32 +145,55 @@ func unpackSuback(data []byte, fh FixedHeader) lp.Packet {
 		qoses = append(qoses, qos)
 	}
 	return &lp.Suback{
-		MessageID: msgID,
-		Qos:       qoses,
-	}
+		MessageID:  msgID,
+		Qos:        qoses,
+		Properties: props,
+	}, nil
 }
 
-func unpackUnsubscribe(data []byte, fh FixedHeader) lp.Packet {
+func unpackUnsubscribe(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
 	bookmark := uint32(0)
 	var topics []lp.TopicQOSTuple
-	msgID := readUint16(data, &bookmark)
+	msgID, err := readUint16(data, &bookmark)
+	if err != nil {
+		return nil, err
+	}
+	var props lp.Properties
+	if version == protoVersion5 {
+		if props, err = unpackProperties(data, &bookmark); err != nil {
+			return nil, err
+		}
+	}
 	maxlen := uint32(len(data))
 	for bookmark < maxlen {
 		var t lp.TopicQOSTuple
-		t.Topic = readString(data, &bookmark)
+		if t.Topic, err = readString(data, &bookmark); err != nil {
+			return nil, err
+		}
 		topics = append(topics, t)
 	}
 	return &lp.Unsubscribe{
 		FixedHeader:   lp.FixedHeader(fh),
 		MessageID:     msgID,
 		Subscriptions: topics,
-	}
+		Properties:    props,
+	}, nil
 }
 
-func unpackUnsuback(data []byte, fh FixedHeader) lp.Packet {
+func unpackUnsuback(data []byte, fh FixedHeader, version uint8) (lp.Packet, error) {
 	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
-	return &lp.Unsuback{
+	msgID, err := readUint16(data, &bookmark)
+	if err != nil {
+		return nil, err
+	}
+	unsuback := &lp.Unsuback{
 		MessageID: msgID,
 	}
+	if version == protoVersion5 {
+		if unsuback.Properties, err = unpackProperties(data, &bookmark); err != nil {
+			return nil, err
+		}
+		unsuback.ReasonCodes = data[bookmark:]
+	}
+	return unsuback, nil
 }
@@ -16,6 +16,12 @@ import (
 )
 
 func main() {
+	// Seal a key with the key-encryption key.
+	if len(os.Args) > 1 && os.Args[1] == "seal" {
+		sealKey(os.Args[2:])
+		return
+	}
+
 	// Get the directory of the process
 	exe, err := os.Executable()
 	if err != nil {
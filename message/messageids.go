@@ -2,6 +2,7 @@ package message
 
 import (
 	"sync"
+	"time"
 )
 
 // MID is 32-bit local message identifier
@@ -9,13 +10,22 @@ type MID uint32
 
 type MessageIds struct {
 	sync.RWMutex
-	id    MID
-	index map[MID]uint8 // map[MID]PacketType
+	id       MID
+	index    map[MID]uint8     // map[MID]PacketType
+	inflight map[MID]*InFlight // The outbound messages pending acknowledgement.
+}
+
+// InFlight represents an outbound message pending acknowledgement.
+type InFlight struct {
+	Message  Message   // The message to resend.
+	Attempts int       // The number of times the message has been sent.
+	Sent     time.Time // The time the message was last sent.
 }
 
 func NewMessageIds() MessageIds {
 	return MessageIds{
-		index: make(map[MID]uint8),
+		index:    make(map[MID]uint8),
+		inflight: make(map[MID]*InFlight),
 	}
 }
 
@@ -25,10 +35,12 @@ func (mids *MessageIds) Reset(id MID) {
 	mids.id = id
 }
 
+// FreeID removes the message identifier and the in-flight message for the identifier.
 func (mids *MessageIds) FreeID(id MID) {
 	mids.Lock()
 	defer mids.Unlock()
 	delete(mids.index, id)
+	delete(mids.inflight, id)
 }
 
 func (mids *MessageIds) NextID(pktType uint8) MID {
@@ -44,3 +56,42 @@ func (mids *MessageIds) GetType(id MID) uint8 {
 	defer mids.RUnlock()
 	return mids.index[id]
 }
+
+// Track adds the message sent to the in-flight messages, the message is resent until acknowledged.
+func (mids *MessageIds) Track(id MID, m Message) {
+	mids.Lock()
+	defer mids.Unlock()
+	mids.inflight[id] = &InFlight{Message: m, Attempts: 1, Sent: time.Now()}
+}
+
+// Release stops resending the in-flight message, the message identifier is in use until it is freed.
+func (mids *MessageIds) Release(id MID) {
+	mids.Lock()
+	defer mids.Unlock()
+	delete(mids.inflight, id)
+}
+
+// Retry returns the in-flight messages not acknowledged within the retry interval to resend them. The
+// messages already sent max attempts times are removed and returned as dropped, zero max attempts
+// means the messages are resent until acknowledged.
+func (mids *MessageIds) Retry(interval time.Duration, maxAttempts int) (resend []Message, dropped int) {
+	mids.Lock()
+	defer mids.Unlock()
+
+	now := time.Now()
+	for id, m := range mids.inflight {
+		if now.Sub(m.Sent) < interval {
+			continue
+		}
+		if maxAttempts > 0 && m.Attempts >= maxAttempts {
+			delete(mids.inflight, id)
+			delete(mids.index, id)
+			dropped++
+			continue
+		}
+		m.Attempts++
+		m.Sent = now
+		resend = append(resend, m.Message)
+	}
+	return resend, dropped
+}
@@ -0,0 +1,47 @@
+package message
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInFlightRetry(t *testing.T) {
+	mids := NewMessageIds()
+	id := mids.NextID(3)
+	mids.Track(id, Message{MessageID: 1, Topic: []byte("a"), Qos: 1})
+
+	// Not resent within the retry interval.
+	msgs, dropped := mids.Retry(time.Minute, 3)
+	assert.Empty(t, msgs)
+	assert.Equal(t, 0, dropped)
+
+	msgs, dropped = mids.Retry(0, 3)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, 0, dropped)
+	msgs, _ = mids.Retry(0, 3)
+	assert.Len(t, msgs, 1)
+
+	// Dropped after max attempts.
+	msgs, dropped = mids.Retry(0, 3)
+	assert.Empty(t, msgs)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, uint8(0), mids.GetType(id))
+}
+
+func TestInFlightAck(t *testing.T) {
+	mids := NewMessageIds()
+	id := mids.NextID(3)
+	mids.Track(id, Message{MessageID: 1, Qos: 2})
+
+	mids.Release(id)
+	msgs, _ := mids.Retry(0, 0)
+	assert.Empty(t, msgs)
+	assert.Equal(t, uint8(3), mids.GetType(id))
+
+	mids.FreeID(id)
+	assert.Equal(t, uint8(0), mids.GetType(id))
+	assert.Empty(t, mids.index)
+	assert.Empty(t, mids.inflight)
+}
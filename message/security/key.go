@@ -2,7 +2,11 @@ package security
 
 import (
 	"bytes"
+	"encoding/base32"
+	"encoding/binary"
 	"errors"
+	"strconv"
+	"time"
 
 	"github.com/unit-io/unitd/message"
 	"github.com/unit-io/unitd/pkg/encoding"
@@ -15,6 +19,9 @@ const (
 	AllowRead      = uint32(1 << 1)         // Key should be allowed to subscribe to the topic.
 	AllowWrite     = uint32(1 << 2)         // Key should be allowed to publish to the topic.
 	AllowReadWrite = AllowRead | AllowWrite // Key should be allowed to read and write to the topic.
+	AllowPresence  = uint32(1 << 3)         // Key should be allowed to get the presence of the topic.
+	AllowHistory   = uint32(1 << 4)         // Key should be allowed to load the message history of the topic.
+	AllowExtend    = uint32(1 << 5)         // Key should be allowed to generate keys for the sub-topics of the topic.
 
 	// Topic types
 	TopicInvalid = uint8(iota)
@@ -25,23 +32,34 @@ const (
 	TopicSeparator    = '.' // The separator character.
 	encodedLen        = 13  // string encoded len
 	rawLen            = 8   // binary raw len
+
+	// The v2 key "[version][permissions][bit path 24 bits][target hash 64 bits][not-after 32 bits]".
+	keyVersion2  = 2
+	encodedLenV2 = 28 // string encoded len
+	rawLenV2     = 17 // binary raw len
 )
 
 // Key errors
 var (
 	ErrTargetTooLong = errors.New("topic can not have more than 23 parts")
+	ErrKeyExpired    = errors.New("key has expired")
+	ErrNotExtendable = errors.New("parent key does not have the extend permission")
+	ErrNotSubTopic   = errors.New("topic is not a sub-topic of the parent key topic")
+	ErrNotGranted    = errors.New("permissions are not granted by the parent key")
+	ErrMQTTLevel     = errors.New("topic level can not contain the '.' separator")
+	ErrMQTTEmpty     = errors.New("topic level can not be empty")
+	ErrMQTTWildcard  = errors.New("topic wildcard must fill the level and '#' must be the last level")
 )
 
+// keyEncoding is the base32 encoding of the v2 keys.
+var keyEncoding = base32.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdef").WithPadding(base32.NoPadding)
+
 type splitFunc struct{}
 
 func (splitFunc) splitTopic(c rune) bool {
 	return c == TopicSeparator
 }
 
-func (splitFunc) splitKey(c rune) bool {
-	return c == TopicKeySeparator
-}
-
 func (splitFunc) options(c rune) bool {
 	return c == '?'
 }
@@ -54,6 +72,53 @@ type Topic struct {
 	Size      int // Topic size without options
 }
 
+// option returns the value of the topic option, the options follow the topic "topic?ttl=30m&last=10".
+func (t *Topic) option(name string) (string, bool) {
+	if t.Size >= len(t.Topic) {
+		return "", false
+	}
+	for _, opt := range bytes.Split(t.Topic[t.Size+1:], []byte("&")) {
+		if kv := bytes.SplitN(opt, []byte("="), 2); len(kv) == 2 && string(kv[0]) == name {
+			return string(kv[1]), true
+		}
+	}
+	return "", false
+}
+
+// TTL returns the time-to-live option of the topic, the ttl is a duration "30m" or a number of seconds.
+func (t *Topic) TTL() (time.Duration, bool) {
+	v, ok := t.option("ttl")
+	if !ok {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, secs > 0
+	}
+	ttl, err := time.ParseDuration(v)
+	return ttl, err == nil && ttl > 0
+}
+
+// Last returns the history options of the topic "topic?last=50&since=<unix>&until=<unix>", the
+// messages published since and until the unix time are replayed, at most last messages are replayed.
+func (t *Topic) Last() (since, until time.Time, limit int, ok bool) {
+	if v, exists := t.option("last"); exists {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit, ok = n, true
+		}
+	}
+	if v, exists := t.option("since"); exists {
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			since, ok = time.Unix(secs, 0), true
+		}
+	}
+	if v, exists := t.option("until"); exists {
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			until, ok = time.Unix(secs, 0), true
+		}
+	}
+	return since, until, limit, ok
+}
+
 // Key represents a security key.
 type Key []byte
 
@@ -62,16 +127,60 @@ func (k Key) IsEmpty() bool {
 	return len(k) == 0
 }
 
+// Version gets the version of the key format.
+func (k Key) Version() uint8 {
+	if len(k) == rawLenV2 {
+		return k[0]
+	}
+	return 1
+}
+
 // Permissions gets the permission flags.
 func (k Key) Permissions() uint32 {
+	if k.Version() == keyVersion2 {
+		return uint32(k[1])
+	}
 	return uint32(k[0])
 }
 
 // SetPermissions sets the permission flags.
 func (k Key) SetPermissions(value uint32) {
+	if k.Version() == keyVersion2 {
+		k[1] = byte(value)
+		return
+	}
 	k[0] = byte(value)
 }
 
+// NotAfter gets the time the key expires, it is zero if the key does not expire.
+func (k Key) NotAfter() time.Time {
+	if k.Version() != keyVersion2 {
+		return time.Time{}
+	}
+	if secs := binary.BigEndian.Uint32(k[13:17]); secs != 0 {
+		return time.Unix(int64(secs), 0)
+	}
+	return time.Time{}
+}
+
+// SetNotAfter sets the time the key expires, a zero time means the key does not expire.
+func (k Key) SetNotAfter(t time.Time) {
+	if k.Version() != keyVersion2 {
+		return
+	}
+	var secs uint32
+	if !t.IsZero() {
+		secs = uint32(t.Unix())
+	}
+	binary.BigEndian.PutUint32(k[13:17], secs)
+}
+
+// Expired checks whether the key has expired.
+func (k Key) Expired() bool {
+	notAfter := k.NotAfter()
+	return !notAfter.IsZero() && time.Now().After(notAfter)
+}
+
 // Target returns the topic (first element of the query, second element of an parts)
 func (topic *Topic) Target() uint32 {
 	return hash.WithSalt(topic.Topic[:topic.Size], message.Contract)
@@ -82,7 +191,7 @@ func ParseKey(text []byte) (topic *Topic) {
 	topic = new(Topic)
 	var fn splitFunc
 
-	parts := bytes.FieldsFunc(text, fn.splitKey)
+	parts := splitKey(text)
 	if parts == nil || len(parts) < 2 {
 		// topic.TopicType = TopicInvalid
 		topic.Topic = parts[0]
@@ -102,8 +211,87 @@ func ParseKey(text []byte) (topic *Topic) {
 	return topic
 }
 
+// splitKey splits the text into the key and the topic at the first separator, so the
+// topic may contain the separator, i.e. "unitd/clientid/list".
+func splitKey(text []byte) [][]byte {
+	text = bytes.TrimLeft(text, string(TopicKeySeparator))
+	parts := bytes.SplitN(text, []byte{TopicKeySeparator}, 2)
+	if len(parts) == 2 && len(parts[1]) == 0 {
+		return parts[:1]
+	}
+	return parts
+}
+
+// FromMQTT translates the MQTT-standard topic "a/b/+" or "a/#" with the '/' separator and the '+' and '#'
+// wildcards to the topic "a.b.*" or "a...". The topic must not contain the key, the options are kept as is.
+// A level containing the '.' separator is refused as it would be split into several levels, and so are
+// the empty levels and the wildcards not filling the level or the '#' wildcard not on the last level.
+func FromMQTT(topic []byte) ([]byte, error) {
+	var options []byte
+	if i := bytes.IndexByte(topic, '?'); i >= 0 {
+		topic, options = topic[:i], topic[i:]
+	}
+	if bytes.IndexByte(topic, TopicSeparator) >= 0 {
+		return nil, ErrMQTTLevel
+	}
+	parts := bytes.Split(topic, []byte{TopicKeySeparator})
+	text := make([]byte, 0, len(topic)+len(options)+2)
+	for i, part := range parts {
+		if len(part) == 0 {
+			return nil, ErrMQTTEmpty
+		}
+		if bytes.ContainsAny(part, "+#") && (len(part) != 1 || (part[0] == '#' && i != len(parts)-1)) {
+			return nil, ErrMQTTWildcard
+		}
+		switch {
+		case part[0] == '#':
+			text = append(text, "..."...)
+			continue
+		case i > 0:
+			text = append(text, TopicSeparator)
+		}
+		if part[0] == '+' {
+			part = []byte{'*'}
+		}
+		text = append(text, part...)
+	}
+	return append(text, options...), nil
+}
+
+// ToMQTT translates the topic "a.b.*" or "a..." to the MQTT-standard topic "a/b/+" or "a/#".
+func ToMQTT(topic []byte) []byte {
+	multi := bytes.HasSuffix(topic, []byte("..."))
+	if multi {
+		topic = topic[:len(topic)-3]
+	}
+	parts := bytes.Split(topic, []byte{TopicSeparator})
+	text := make([]byte, 0, len(topic)+2)
+	for i, part := range parts {
+		if i > 0 {
+			text = append(text, TopicKeySeparator)
+		}
+		if len(part) == 1 && part[0] == '*' {
+			part = []byte{'+'}
+		}
+		text = append(text, part...)
+	}
+	if multi {
+		if len(text) > 0 {
+			text = append(text, TopicKeySeparator)
+		}
+		text = append(text, '#')
+	}
+	return text
+}
+
 // ValidateTopic validates the topic string.
 func (k Key) ValidateTopic(contract uint32, topic []byte) (ok bool, wildcard bool) {
+	if k.Expired() {
+		return false, false
+	}
+	if k.Version() == keyVersion2 {
+		return k.validateTopicV2(contract, topic)
+	}
 	// var fn splitFunc
 	// Bytes 4-5-6-7 contains target hash
 	target := uint32(k[4])<<24 | uint32(k[5])<<16 | uint32(k[6])<<8 | uint32(k[7])
@@ -121,6 +309,22 @@ func (k Key) ValidateTopic(contract uint32, topic []byte) (ok bool, wildcard boo
 	return h == target, ((targetPath >> 23) & 1) == 0
 }
 
+// validateTopicV2 validates the topic string with the 64 bits target hash of the v2 key.
+func (k Key) validateTopicV2(contract uint32, topic []byte) (ok bool, wildcard bool) {
+	// Bytes 5 to 12 contains target hash
+	target := binary.BigEndian.Uint64(k[5:13])
+	targetPath := uint32(k[2])<<16 | uint32(k[3])<<8 | uint32(k[4])
+
+	if targetPath == 0 {
+		if target == hash.WithSalt64([]byte("..."), contract) {
+			return true, true
+		}
+		return target == hash.WithSalt64(topic, contract), true
+	}
+
+	return target == hash.WithSalt64(topic, contract), ((targetPath >> 23) & 1) == 0
+}
+
 // SetTarget sets the topic for the key.
 func (k Key) SetTarget(contract uint32, topic []byte) error {
 	var fn splitFunc
@@ -152,6 +356,14 @@ func (k Key) SetTarget(contract uint32, topic []byte) error {
 			bitPath |= uint32(1 << (22 - uint16(idx)))
 		}
 	}
+	if k.Version() == keyVersion2 {
+		// Set the bit path and the hash of the target
+		k[2] = byte(bitPath >> 16)
+		k[3] = byte(bitPath >> 8)
+		k[4] = byte(bitPath)
+		binary.BigEndian.PutUint64(k[5:13], hash.WithSalt64(topic, contract))
+		return nil
+	}
 	value := hash.WithSalt(topic, contract)
 
 	// Set the bit path
@@ -173,10 +385,32 @@ func (k Key) HasPermission(flag uint32) bool {
 	return (p & flag) == flag
 }
 
-// GenerateKey generates a new key.
-func GenerateKey(contract uint32, topic []byte, permissions uint32) (string, error) {
-	key := Key(make([]byte, rawLen))
+// GenerateKey generates a new key, the key expires at the not-after time unless the time is zero. The key
+// generated with a parent key is for a sub-topic of the parent key topic with the permissions of the parent
+// key, the parent key must have the extend permission and the key does not outlive the parent key.
+func GenerateKey(contract uint32, topic []byte, permissions uint32, notAfter time.Time, parent Key) (string, error) {
+	if parent != nil {
+		if parent.Expired() {
+			return "", ErrKeyExpired
+		}
+		if !parent.HasPermission(AllowExtend) {
+			return "", ErrNotExtendable
+		}
+		if permissions&^parent.Permissions() != 0 {
+			return "", ErrNotGranted
+		}
+		if !parent.validatePrefix(contract, topic) {
+			return "", ErrNotSubTopic
+		}
+		if parentNotAfter := parent.NotAfter(); !parentNotAfter.IsZero() && (notAfter.IsZero() || notAfter.After(parentNotAfter)) {
+			notAfter = parentNotAfter
+		}
+	}
+
+	key := Key(make([]byte, rawLenV2))
+	key[0] = keyVersion2
 	key.SetPermissions(permissions)
+	key.SetNotAfter(notAfter)
 	if err := key.SetTarget(contract, topic); err != nil {
 		return "", err
 	}
@@ -184,7 +418,27 @@ func GenerateKey(contract uint32, topic []byte, permissions uint32) (string, err
 	return key.Encode(), nil
 }
 
+// validatePrefix checks whether the topic or a parent topic of the topic is the target of the key.
+func (k Key) validatePrefix(contract uint32, topic []byte) bool {
+	// The options of the topic are not part of the prefix.
+	if i := bytes.IndexByte(topic, '?'); i >= 0 {
+		topic = topic[:i]
+	}
+	for i := 1; i <= len(topic); i++ {
+		if i < len(topic) && topic[i] != TopicSeparator {
+			continue
+		}
+		if ok, _ := k.ValidateTopic(contract, topic[:i]); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (k Key) Encode() string {
+	if k.Version() == keyVersion2 {
+		return k.encodeV2()
+	}
 	buffer := make([]byte, rawLen)
 	buffer[0] = k[0]
 	buffer[1] = k[1]
@@ -200,7 +454,22 @@ func (k Key) Encode() string {
 	return string(text)
 }
 
+// encodeV2 encodes the v2 key, the key is XORed with the version and the permissions as salt.
+func (k Key) encodeV2() string {
+	buffer := make([]byte, rawLenV2)
+	buffer[0] = k[0]
+	buffer[1] = k[1]
+	for i := 2; i < rawLenV2; i++ {
+		buffer[i] = k[i] ^ buffer[i%2]
+	}
+	return keyEncoding.EncodeToString(buffer)
+}
+
+// DecodeKey decodes the key, it returns an error if the key is invalid or the key has expired.
 func DecodeKey(key []byte) (Key, error) {
+	if len(key) == encodedLenV2 {
+		return decodeKeyV2(key)
+	}
 	if len(key) != encodedLen {
 		return Key{}, errors.New("Key provided is invalid")
 	}
@@ -221,3 +490,45 @@ func DecodeKey(key []byte) (Key, error) {
 	// Return the key on the decrypted buffer.
 	return Key(buffer), nil
 }
+
+func decodeKeyV2(key []byte) (Key, error) {
+	k, err := decodeV2(key)
+	if err != nil {
+		return Key{}, err
+	}
+	if k.Expired() {
+		return Key{}, ErrKeyExpired
+	}
+	return k, nil
+}
+
+// decodeV2 decodes the v2 key whether or not the key has expired.
+func decodeV2(key []byte) (Key, error) {
+	buffer := make([]byte, rawLenV2)
+	if n, err := keyEncoding.Decode(buffer, key); err != nil || n != rawLenV2 || buffer[0] != keyVersion2 {
+		return Key{}, errors.New("Key provided is invalid")
+	}
+
+	// XOR the array with the salt.
+	for i := 2; i < rawLenV2; i++ {
+		buffer[i] = buffer[i] ^ buffer[i%2]
+	}
+	return Key(buffer), nil
+}
+
+// CanonicalKey returns the key decoded and encoded again. The unused bits of the last character
+// are not decoded, so the spellings of a key that differ in the unused bits have the same canonical key.
+func CanonicalKey(key []byte) ([]byte, error) {
+	if len(key) == encodedLenV2 {
+		k, err := decodeV2(key)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(k.Encode()), nil
+	}
+	k, err := DecodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(k.Encode()), nil
+}
@@ -0,0 +1,233 @@
+package security
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicTTL(t *testing.T) {
+	ttl, ok := ParseKey([]byte("key/a.b?ttl=30m")).TTL()
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Minute, ttl)
+
+	ttl, ok = ParseKey([]byte("key/a.b?last=10&ttl=60")).TTL()
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, ttl)
+
+	_, ok = ParseKey([]byte("key/a.b")).TTL()
+	assert.False(t, ok)
+
+	_, ok = ParseKey([]byte("key/a.b?ttl=never")).TTL()
+	assert.False(t, ok)
+}
+
+func TestTopicLast(t *testing.T) {
+	since, until, limit, ok := ParseKey([]byte("key/a.b?last=50&since=1600000000&until=1600003600")).Last()
+	assert.True(t, ok)
+	assert.Equal(t, 50, limit)
+	assert.Equal(t, int64(1600000000), since.Unix())
+	assert.Equal(t, int64(1600003600), until.Unix())
+
+	_, _, _, ok = ParseKey([]byte("key/a.b?ttl=30m")).Last()
+	assert.False(t, ok)
+}
+
+func TestKeyV1(t *testing.T) {
+	k := Key(make([]byte, rawLen))
+	k.SetPermissions(AllowReadWrite)
+	assert.NoError(t, k.SetTarget(3376684800, []byte("a.b.c")))
+	encoded := k.Encode()
+	assert.Equal(t, encodedLen, len(encoded))
+
+	key, err := DecodeKey([]byte(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(1), key.Version())
+	assert.Equal(t, uint32(AllowReadWrite), key.Permissions())
+	assert.True(t, key.NotAfter().IsZero())
+	ok, _ := key.ValidateTopic(3376684800, []byte("a.b.c"))
+	assert.True(t, ok)
+}
+
+func TestKeyV2(t *testing.T) {
+	encoded, err := GenerateKey(3376684800, []byte("a.b.c"), AllowReadWrite, time.Time{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, encodedLenV2, len(encoded))
+
+	key, err := DecodeKey([]byte(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(keyVersion2), key.Version())
+	assert.Equal(t, uint32(AllowReadWrite), key.Permissions())
+	assert.True(t, key.NotAfter().IsZero())
+	ok, wildcard := key.ValidateTopic(3376684800, []byte("a.b.c"))
+	assert.True(t, ok)
+	assert.False(t, wildcard)
+	ok, _ = key.ValidateTopic(3376684800, []byte("a.b.d"))
+	assert.False(t, ok)
+	ok, _ = key.ValidateTopic(1, []byte("a.b.c"))
+	assert.False(t, ok)
+}
+
+func TestKeyExpiry(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour)
+	encoded, err := GenerateKey(3376684800, []byte("a.b"), AllowRead, notAfter, nil)
+	assert.NoError(t, err)
+	key, err := DecodeKey([]byte(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, notAfter.Unix(), key.NotAfter().Unix())
+
+	key.SetNotAfter(time.Now().Add(-time.Second))
+	assert.True(t, key.Expired())
+	ok, _ := key.ValidateTopic(3376684800, []byte("a.b"))
+	assert.False(t, ok)
+
+	encoded, err = GenerateKey(3376684800, []byte("a.b"), AllowRead, time.Now().Add(-time.Second), nil)
+	assert.NoError(t, err)
+	_, err = DecodeKey([]byte(encoded))
+	assert.Equal(t, ErrKeyExpired, err)
+}
+
+func TestParseKey(t *testing.T) {
+	topic := ParseKey([]byte("unitd/clientid/list"))
+	assert.Equal(t, []byte("unitd"), topic.Key)
+	assert.Equal(t, []byte("clientid/list"), topic.Topic[:topic.Size])
+
+	topic = ParseKey([]byte("key/a.b?ttl=30m"))
+	assert.Equal(t, []byte("key"), topic.Key)
+	assert.Equal(t, []byte("a.b"), topic.Topic[:topic.Size])
+
+	topic = ParseKey([]byte("a.b"))
+	assert.Nil(t, topic.Key)
+	assert.Equal(t, []byte("a.b"), topic.Topic[:topic.Size])
+}
+
+func TestMQTTTopic(t *testing.T) {
+	for mqtt, topic := range map[string]string{
+		"a/b/+":       "a.b.*",
+		"a/+/c/#":     "a.*.c...",
+		"#":           "...",
+		"a/b?ttl=30m": "a.b?ttl=30m",
+		"+":           "*",
+	} {
+		text, err := FromMQTT([]byte(mqtt))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(topic), text)
+	}
+	// The '.' separator in a level is refused.
+	_, err := FromMQTT([]byte("a/b.c"))
+	assert.Equal(t, ErrMQTTLevel, err)
+	_, err = FromMQTT([]byte("a/..."))
+	assert.Equal(t, ErrMQTTLevel, err)
+	// The wildcards fill the level and '#' is the last level.
+	for _, mqtt := range []string{"a/#/b", "a+/b", "a/+b", "a/#b", "a/b#", "a/##", "#/a"} {
+		_, err = FromMQTT([]byte(mqtt))
+		assert.Equal(t, ErrMQTTWildcard, err, mqtt)
+	}
+	// The empty levels are refused.
+	for _, mqtt := range []string{"", "/a", "a/", "a//b", "a//#", "?ttl=30m"} {
+		_, err = FromMQTT([]byte(mqtt))
+		assert.Equal(t, ErrMQTTEmpty, err, mqtt)
+	}
+
+	assert.Equal(t, []byte("a/b"), ToMQTT([]byte("a.b")))
+	assert.Equal(t, []byte("a/+/c/#"), ToMQTT([]byte("a.*.c...")))
+	assert.Equal(t, []byte("#"), ToMQTT([]byte("...")))
+}
+
+func TestKeyPermissions(t *testing.T) {
+	encoded, err := GenerateKey(3376684800, []byte("a.b"), AllowRead|AllowPresence|AllowHistory|AllowExtend, time.Time{}, nil)
+	assert.NoError(t, err)
+	key, err := DecodeKey([]byte(encoded))
+	assert.NoError(t, err)
+	assert.True(t, key.HasPermission(AllowRead|AllowHistory))
+	assert.True(t, key.HasPermission(AllowPresence))
+	assert.True(t, key.HasPermission(AllowExtend))
+	assert.False(t, key.HasPermission(AllowWrite))
+
+	encoded, err = GenerateKey(3376684800, []byte("a.b"), AllowRead, time.Time{}, nil)
+	assert.NoError(t, err)
+	key, err = DecodeKey([]byte(encoded))
+	assert.NoError(t, err)
+	assert.False(t, key.HasPermission(AllowRead|AllowHistory))
+}
+
+func TestGenerateKeyWithParent(t *testing.T) {
+	encoded, err := GenerateKey(3376684800, []byte("a.b"), AllowReadWrite|AllowExtend, time.Time{}, nil)
+	assert.NoError(t, err)
+	parent, err := DecodeKey([]byte(encoded))
+	assert.NoError(t, err)
+
+	encoded, err = GenerateKey(3376684800, []byte("a.b.c"), AllowRead, time.Time{}, parent)
+	assert.NoError(t, err)
+	key, err := DecodeKey([]byte(encoded))
+	assert.NoError(t, err)
+	ok, _ := key.ValidateTopic(3376684800, []byte("a.b.c"))
+	assert.True(t, ok)
+
+	_, err = GenerateKey(3376684800, []byte("a.b"), AllowRead, time.Time{}, parent)
+	assert.NoError(t, err)
+	_, err = GenerateKey(3376684800, []byte("a.bc"), AllowRead, time.Time{}, parent)
+	assert.Equal(t, ErrNotSubTopic, err)
+	_, err = GenerateKey(3376684800, []byte("a.c"), AllowRead, time.Time{}, parent)
+	assert.Equal(t, ErrNotSubTopic, err)
+	_, err = GenerateKey(3376684800, []byte("a.b.c"), AllowRead|AllowPresence, time.Time{}, parent)
+	assert.Equal(t, ErrNotGranted, err)
+
+	// The key generated does not outlive the parent key.
+	notAfter := time.Now().Add(time.Hour)
+	encoded, err = GenerateKey(3376684800, []byte("a.b"), AllowRead|AllowExtend, notAfter, nil)
+	assert.NoError(t, err)
+	parent, err = DecodeKey([]byte(encoded))
+	assert.NoError(t, err)
+	encoded, err = GenerateKey(3376684800, []byte("a.b.c"), AllowRead, time.Time{}, parent)
+	assert.NoError(t, err)
+	key, err = DecodeKey([]byte(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, notAfter.Unix(), key.NotAfter().Unix())
+
+	// The parent key without the extend permission.
+	encoded, err = GenerateKey(3376684800, []byte("a.b"), AllowReadWrite, time.Time{}, nil)
+	assert.NoError(t, err)
+	parent, err = DecodeKey([]byte(encoded))
+	assert.NoError(t, err)
+	_, err = GenerateKey(3376684800, []byte("a.b.c"), AllowRead, time.Time{}, parent)
+	assert.Equal(t, ErrNotExtendable, err)
+}
+
+// otherSpelling returns the key with the unused low bit of the last character flipped.
+func otherSpelling(key string) string {
+	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdef"
+	last := strings.IndexByte(chars, key[len(key)-1])
+	return key[:len(key)-1] + string(chars[last^1])
+}
+
+func TestCanonicalKey(t *testing.T) {
+	k := Key(make([]byte, rawLen))
+	k.SetPermissions(AllowReadWrite)
+	assert.NoError(t, k.SetTarget(3376684800, []byte("a.b.c")))
+	v2, err := GenerateKey(3376684800, []byte("a.b.c"), AllowReadWrite, time.Time{}, nil)
+	assert.NoError(t, err)
+
+	for _, encoded := range []string{k.Encode(), v2} {
+		other := otherSpelling(encoded)
+		assert.NotEqual(t, encoded, other)
+		canonical, err := CanonicalKey([]byte(other))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(encoded), canonical)
+	}
+
+	// The expired key is also made canonical.
+	expired, err := GenerateKey(3376684800, []byte("a.b.c"), AllowReadWrite, time.Now().Add(time.Second), nil)
+	assert.NoError(t, err)
+	k2, err := DecodeKey([]byte(expired))
+	assert.NoError(t, err)
+	k2.SetNotAfter(time.Now().Add(-time.Hour))
+	canonical, err := CanonicalKey([]byte(otherSpelling(k2.Encode())))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(k2.Encode()), canonical)
+
+	_, err = CanonicalKey([]byte("invalid"))
+	assert.Error(t, err)
+}
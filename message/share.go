@@ -0,0 +1,100 @@
+package message
+
+import (
+	"bytes"
+	"sync"
+)
+
+// sharePrefix is the topic prefix of a shared subscription "$share/<group>/<key>/<topic>".
+var sharePrefix = []byte("$share/")
+
+// SplitShare splits the shared subscription topic into group name and the topic. The group
+// is nil if the topic is not a shared subscription, and ok is false if the group name is invalid.
+func SplitShare(topic []byte) (group, rest []byte, ok bool) {
+	if !bytes.HasPrefix(topic, sharePrefix) {
+		return nil, topic, true
+	}
+	topic = topic[len(sharePrefix):]
+	i := bytes.IndexByte(topic, '/')
+	if i <= 0 || bytes.ContainsAny(topic[:i], "*.+#") {
+		return nil, topic, false
+	}
+	return topic[:i], topic[i+1:], true
+}
+
+// Shares represents the shared subscription groups. A message published to a shared
+// subscription is delivered to only one member of the group.
+type Shares struct {
+	sync.Mutex
+	groups map[string]*Share
+}
+
+// Share represents the members of a shared subscription group.
+type Share struct {
+	members []uint32
+	next    int
+}
+
+// NewShares creates a new container.
+func NewShares() *Shares {
+	return &Shares{
+		groups: make(map[string]*Share),
+	}
+}
+
+// Join adds the member to the group. It returns false if the group already has
+// max members, a max of zero means the group size is not limited.
+func (s *Shares) Join(group string, member uint32, max int) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	share, exists := s.groups[group]
+	if !exists {
+		share = &Share{}
+		s.groups[group] = share
+	}
+	for _, m := range share.members {
+		if m == member {
+			return true
+		}
+	}
+	if max > 0 && len(share.members) >= max {
+		return false
+	}
+	share.members = append(share.members, member)
+	return true
+}
+
+// Leave removes the member from the group, the group is removed if there are no members left.
+func (s *Shares) Leave(group string, member uint32) {
+	s.Lock()
+	defer s.Unlock()
+
+	share, exists := s.groups[group]
+	if !exists {
+		return
+	}
+	for i, m := range share.members {
+		if m == member {
+			share.members = append(share.members[:i], share.members[i+1:]...)
+			break
+		}
+	}
+	if len(share.members) == 0 {
+		delete(s.groups, group)
+	}
+}
+
+// Next returns the position to start the selection from among n members of the group in round-robin order.
+func (s *Shares) Next(group string, n int) int {
+	s.Lock()
+	defer s.Unlock()
+
+	share, exists := s.groups[group]
+	if !exists || n == 0 {
+		return 0
+	}
+	next := share.next % n
+	share.next = next + 1
+	return next
+}
@@ -0,0 +1,46 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitShare(t *testing.T) {
+	group, rest, ok := SplitShare([]byte("$share/workers/KEY/jobs.new"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("workers"), group)
+	assert.Equal(t, []byte("KEY/jobs.new"), rest)
+
+	group, rest, ok = SplitShare([]byte("KEY/jobs.new"))
+	assert.True(t, ok)
+	assert.Nil(t, group)
+	assert.Equal(t, []byte("KEY/jobs.new"), rest)
+
+	_, _, ok = SplitShare([]byte("$share//KEY/jobs.new"))
+	assert.False(t, ok)
+
+	_, _, ok = SplitShare([]byte("$share/work*/KEY/jobs.new"))
+	assert.False(t, ok)
+}
+
+func TestShares(t *testing.T) {
+	shares := NewShares()
+	assert.True(t, shares.Join("workers", 1, 2))
+	assert.True(t, shares.Join("workers", 2, 2))
+	// Joining again is not counted against the max group size.
+	assert.True(t, shares.Join("workers", 2, 2))
+	assert.False(t, shares.Join("workers", 3, 2))
+
+	// Round-robin order
+	assert.Equal(t, 0, shares.Next("workers", 2))
+	assert.Equal(t, 1, shares.Next("workers", 2))
+	assert.Equal(t, 0, shares.Next("workers", 2))
+
+	shares.Leave("workers", 1)
+	assert.True(t, shares.Join("workers", 3, 2))
+
+	shares.Leave("workers", 2)
+	shares.Leave("workers", 3)
+	assert.Equal(t, 0, len(shares.groups))
+}
@@ -1,7 +1,10 @@
 package message
 
 import (
+	"bytes"
 	"sync"
+
+	lp "github.com/unit-io/unitd/lineprotocol"
 )
 
 const (
@@ -18,6 +21,13 @@ const (
 	Contract = uint32(3376684800)
 )
 
+// The MQTT 5 subscription options, the options are stored with the qos of the subscription
+// as those are laid out in the subscription options of the MQTT 5 subscribe packet.
+const (
+	SubNoLocal           = 0x04 // The messages published by the connection are not delivered to the connection.
+	SubRetainAsPublished = 0x08 // The messages are delivered with the retain flag as published.
+)
+
 // ------------------------------------------------------------------------------------
 
 // SubscriberType represents a type of subscriber
@@ -47,6 +57,10 @@ type Message struct {
 	Payload   []byte `json:"data,omitempty"`       // The payload of the message
 	Qos       uint8  `json:"qos,omitempty"`        // The qos of the message
 	TTL       int64  `json:"ttl,omitempty"`        // The time-to-live of the message
+	Retain    bool   `json:"retain,omitempty"`     // The retain flag of the message
+	Published int64  `json:"published,omitempty"`  // The time the message is published in unix nanoseconds
+
+	Properties *lp.Properties `json:"-"` // The MQTT 5 properties forwarded to the subscribers, nil if the message has none.
 }
 
 // Size returns the byte size of the message.
@@ -65,6 +79,10 @@ type Stats struct {
 type Stat struct {
 	ID      []byte
 	Topic   []byte
+	Key     []byte
+	Qos     uint8
+	Options uint8  // The MQTT 5 subscription options.
+	Group   []byte // The shared subscription group, nil if the subscription is not shared.
 	Counter int
 }
 
@@ -76,16 +94,14 @@ func NewStats() *Stats {
 }
 
 // Increment adds the subscription to the stats.
-func (s *Stats) Increment(topic []byte, key string, id []byte) (first bool) {
+func (s *Stats) Increment(key string, sub Stat) (first bool) {
 	s.Lock()
 	defer s.Unlock()
 
 	stat, exists := s.stats[key]
 	if !exists {
-		stat = &Stat{
-			ID:    id,
-			Topic: topic,
-		}
+		stat = &sub
+		stat.Counter = 0
 	}
 	stat.Counter++
 	s.stats[key] = stat
@@ -120,6 +136,25 @@ func (s *Stats) Exist(key string) (ok bool) {
 	return false
 }
 
+// RemoveKey removes the subscriptions made with the key from the stats and returns the subscriptions removed.
+func (s *Stats) RemoveKey(key []byte) (removed []Stat) {
+	return s.RemoveKeyFunc(func(k []byte) bool { return bytes.Equal(k, key) })
+}
+
+// RemoveKeyFunc removes the subscriptions made with the keys matched from the stats and returns the subscriptions removed.
+func (s *Stats) RemoveKeyFunc(match func(key []byte) bool) (removed []Stat) {
+	s.Lock()
+	defer s.Unlock()
+
+	for k, stat := range s.stats {
+		if match(stat.Key) {
+			delete(s.stats, k)
+			removed = append(removed, *stat)
+		}
+	}
+	return removed
+}
+
 // All gets the all subscriptions from the stats.
 func (s *Stats) All() []Stat {
 	s.Lock()
@@ -0,0 +1,22 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsRemoveKey(t *testing.T) {
+	stats := NewStats()
+	stats.Increment("KEY1", Stat{Topic: []byte("a.b"), Key: []byte("KEY1")})
+	stats.Increment("workers/KEY1", Stat{Topic: []byte("a.b"), Key: []byte("KEY1"), Group: []byte("workers")})
+	stats.Increment("KEY2", Stat{Topic: []byte("a.c"), Key: []byte("KEY2")})
+
+	removed := stats.RemoveKey([]byte("KEY1"))
+	assert.Equal(t, 2, len(removed))
+	assert.False(t, stats.Exist("KEY1"))
+	assert.False(t, stats.Exist("workers/KEY1"))
+	assert.True(t, stats.Exist("KEY2"))
+
+	assert.Empty(t, stats.RemoveKey([]byte("KEY1")))
+}
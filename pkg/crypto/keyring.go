@@ -0,0 +1,99 @@
+package crypto
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/unit-io/unitd/pkg/hash"
+)
+
+// Keyring holds the MACs by the key identifier. The values are encrypted with the newest key, the
+// values encrypted with an older key are decrypted until the key is retired after the grace period.
+type Keyring struct {
+	keys  []ringKey // sorted by the key timestamp, newest first.
+	grace time.Duration
+}
+
+type ringKey struct {
+	id        uint32
+	mac       *MAC
+	timestamp time.Time
+}
+
+// NewKeyring creates a new keyring, an older key is retired the grace period after a newer key
+// timestamp. A zero grace period means the older keys are not retired.
+func NewKeyring(grace time.Duration) *Keyring {
+	return &Keyring{grace: grace}
+}
+
+// KeyID returns the key identifier encoded with the values.
+func KeyID(identifier string) uint32 {
+	return hash.New([]byte(identifier))
+}
+
+// Add adds the key with the identifier and the unix timestamp the key is issued.
+func (r *Keyring) Add(identifier string, key []byte, timestamp uint32) error {
+	id := KeyID(identifier)
+	for _, k := range r.keys {
+		if k.id == id {
+			return errors.New("crypto: duplicate key identifier '" + identifier + "'")
+		}
+	}
+	mac, err := New(key)
+	if err != nil {
+		return err
+	}
+	r.keys = append(r.keys, ringKey{id: id, mac: mac, timestamp: time.Unix(int64(timestamp), 0)})
+	sort.SliceStable(r.keys, func(i, j int) bool {
+		return r.keys[i].timestamp.After(r.keys[j].timestamp)
+	})
+	return nil
+}
+
+// Current returns the newest key to encrypt the values.
+func (r *Keyring) Current() (id uint32, mac *MAC) {
+	if len(r.keys) == 0 {
+		return 0, nil
+	}
+	return r.keys[0].id, r.keys[0].mac
+}
+
+// Get returns the MAC of the key identifier, it returns false if the key is unknown or retired.
+func (r *Keyring) Get(id uint32) (*MAC, bool) {
+	now := time.Now()
+	for i, k := range r.keys {
+		if k.id == id {
+			return k.mac, !r.retired(i, now)
+		}
+	}
+	return nil, false
+}
+
+// Active returns the MACs of the keys not retired, newest first.
+func (r *Keyring) Active() []*MAC {
+	now := time.Now()
+	macs := make([]*MAC, 0, len(r.keys))
+	for i, k := range r.keys {
+		if !r.retired(i, now) {
+			macs = append(macs, k.mac)
+		}
+	}
+	return macs
+}
+
+// Overhead returns the maximum difference between the lengths of a plaintext and its ciphertext.
+func (r *Keyring) Overhead() int {
+	if len(r.keys) == 0 {
+		return 0
+	}
+	return r.keys[0].mac.Overhead()
+}
+
+// retired checks whether the grace period has passed since the newer key timestamp.
+func (r *Keyring) retired(i int, now time.Time) bool {
+	if i == 0 || r.grace <= 0 {
+		return false
+	}
+	return now.After(r.keys[i-1].timestamp.Add(r.grace))
+}
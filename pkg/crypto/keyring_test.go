@@ -0,0 +1,32 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	now := uint32(time.Now().Unix())
+	ring := NewKeyring(time.Hour)
+	assert.NoError(t, ring.Add("old", []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I"), now-2*3600))
+	assert.NoError(t, ring.Add("new", []byte("Xk1Gq3kPb2cSVjXo2Zl0w8vN6hYt4Rr9"), now-1800))
+	assert.Error(t, ring.Add("new", []byte("Xk1Gq3kPb2cSVjXo2Zl0w8vN6hYt4Rr9"), now))
+
+	id, mac := ring.Current()
+	assert.Equal(t, KeyID("new"), id)
+
+	// The older key is accepted within the grace period after the newer key timestamp.
+	old, ok := ring.Get(KeyID("old"))
+	assert.True(t, ok)
+	assert.NotEqual(t, mac, old)
+	assert.Len(t, ring.Active(), 2)
+
+	// The older key is retired after the grace period.
+	assert.NoError(t, ring.Add("between", []byte("Pq7Ld2sWm9Kx4Hv6Bn1Zc8Tj3Fy5Gr0A"), now-2*3600+1))
+	_, ok = ring.Get(KeyID("old"))
+	assert.False(t, ok)
+	_, ok = ring.Get(KeyID("unknown"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,56 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Seal encrypts the key with the key-encryption key, the sealed key is base64-encoded nonce and ciphertext.
+func Seal(kek, key []byte) (string, error) {
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(key)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, key, nil)), nil
+}
+
+// Unseal decrypts the key sealed with the key-encryption key.
+func Unseal(kek []byte, sealed string) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, errors.New("sealed key is not base64-encoded")
+	}
+	if len(raw) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("sealed key is invalid")
+	}
+	key, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("unable to unseal key, the key-encryption key does not match")
+	}
+	return key, nil
+}
+
+// ParseKEK parses the key-encryption key, the key is 32 bytes base64-encoded or 32 bytes as is.
+func ParseKEK(text []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(text))
+	if kek, err := base64.StdEncoding.DecodeString(s); err == nil && len(kek) == chacha20poly1305.KeySize {
+		return kek, nil
+	}
+	if len(s) == chacha20poly1305.KeySize {
+		return []byte(s), nil
+	}
+	return nil, errors.New("key-encryption key must be 32 bytes")
+}
@@ -0,0 +1,25 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeal(t *testing.T) {
+	kek, err := ParseKEK([]byte("Xk1Gq3kPb2cSVjXo2Zl0w8vN6hYt4Rr9\n"))
+	assert.NoError(t, err)
+
+	sealed, err := Seal(kek, []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I"))
+	assert.NoError(t, err)
+	key, err := Unseal(kek, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I"), key)
+
+	other, _ := ParseKEK([]byte("Pq7Ld2sWm9Kx4Hv6Bn1Zc8Tj3Fy5Gr0A"))
+	_, err = Unseal(other, sealed)
+	assert.Error(t, err)
+
+	_, err = ParseKEK([]byte("short"))
+	assert.Error(t, err)
+}
@@ -10,6 +10,9 @@ const (
 
 	// Init is what 32 bits hash values should be initialized with.
 	Init = offset32
+
+	offset64 uint64 = 0xcbf29ce484222325
+	prime64  uint64 = 0x100000001b3
 )
 
 // Of returns the hash of bytes. it uses salt to shuffle the slice before calculating hash
@@ -43,6 +46,21 @@ func New(b []byte) uint32 {
 	return h
 }
 
+// WithSalt64 returns the 64 bits hash of bytes. it uses salt to shuffle the slice before calculating hash
+func WithSalt64(text []byte, salt uint32) uint64 {
+	b := shuffleInPlace(text, salt)
+	return New64(b)
+}
+
+// New64 returns the 64 bits FNV-1a hash of bytes.
+func New64(b []byte) uint64 {
+	h := offset64
+	for _, c := range b {
+		h = (h ^ uint64(c)) * prime64
+	}
+	return h
+}
+
 // shuffleInPlace shuffle the slice
 func shuffleInPlace(text []byte, contract uint32) []byte {
 	if contract == 0 {
@@ -4,11 +4,15 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"strings"
 
 	"github.com/unit-io/unitd/pkg/crypto"
 	"github.com/unit-io/unitd/pkg/encoding"
 )
 
+// encodingChars are the characters of the base32 encoding.
+const encodingChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdef"
+
 // ID represents a unique ID for client connection.
 type ID []byte
 
@@ -18,6 +22,8 @@ const (
 
 	encodedLen = 13 // string encoded len
 	rawLen     = 12 // binary raw len
+	idLen      = 52 // encrypted client Id string encoded len
+	keyIDLen   = 7  // string encoded len of the key identifier appended to the client Id
 )
 
 // IsPrimary gets whether the ID is a primary client Id.
@@ -73,7 +79,10 @@ func (id ID) SetContract(value uint32) {
 	id[11] = byte(value)
 }
 
-func (id ID) Encode(mac *crypto.MAC) string {
+// Encode encrypts the client Id with the newest key of the keyring, the key identifier is appended
+// to the encrypted client Id so that the client Id is decrypted after the key is rotated.
+func (id ID) Encode(ring *crypto.Keyring) string {
+	keyID, mac := ring.Current()
 	buffer := make([]byte, rawLen)
 	buffer[0] = id[0]
 	buffer[1] = id[1]
@@ -86,21 +95,43 @@ func (id ID) Encode(mac *crypto.MAC) string {
 
 	// Encryption.
 	ciphertext := mac.Encrypt(nil, buffer)
-	text := make([]byte, 52)
+	text := make([]byte, idLen+keyIDLen)
 	encoding.Encode32(text, ciphertext[:])
+	encodeKeyID(text[idLen:], keyID)
 	return string(text)
 }
 
-func Decode(buffer []byte, mac *crypto.MAC) (ID, error) {
-	if len(buffer) < 52 {
+// Decode decrypts the client Id with the key of the keyring the client Id is encrypted with. The client
+// Id encoded without the key identifier is decrypted with the keys those are not retired.
+func Decode(buffer []byte, ring *crypto.Keyring) (ID, error) {
+	if len(buffer) < idLen {
 		return nil, errors.New("Key provided is invalid")
 	}
 
+	macs := ring.Active()
+	if len(buffer) >= idLen+keyIDLen {
+		keyID, err := decodeKeyID(buffer[idLen : idLen+keyIDLen])
+		if err != nil {
+			return nil, err
+		}
+		mac, ok := ring.Get(keyID)
+		if !ok {
+			return nil, errors.New("Key provided is invalid")
+		}
+		macs = []*crypto.MAC{mac}
+	}
+
 	// Warning: base32 decoding is done in the same underlying buffer, to save up
 	// on memory allocations.
 	encoding.Decode32(buffer, buffer)
 	// Decryption.
-	key, err := mac.Decrypt(nil, buffer[:32])
+	var key []byte
+	err := errors.New("Key provided is invalid")
+	for _, mac := range macs {
+		if key, err = mac.Decrypt(nil, buffer[:32]); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, errors.New("Key provided is invalid")
 	}
@@ -118,6 +149,26 @@ func Decode(buffer []byte, mac *crypto.MAC) (ID, error) {
 	return ID(buffer), nil
 }
 
+// encodeKeyID encodes the key identifier with 5 bits per character.
+func encodeKeyID(dst []byte, keyID uint32) {
+	for i := keyIDLen - 1; i >= 0; i-- {
+		dst[i] = encodingChars[keyID&0x1F]
+		keyID >>= 5
+	}
+}
+
+// decodeKeyID decodes the key identifier, it returns an error if a character is not of the encoding.
+func decodeKeyID(src []byte) (keyID uint32, err error) {
+	for _, c := range src {
+		i := strings.IndexByte(encodingChars, c)
+		if i < 0 {
+			return 0, errors.New("Key provided is invalid")
+		}
+		keyID = keyID<<5 | uint32(i)
+	}
+	return keyID, nil
+}
+
 // NewClientID generates a new primary client Id.
 func NewClientID(master uint16) (ID, error) {
 	raw := make([]byte, 4)
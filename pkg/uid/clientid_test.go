@@ -0,0 +1,30 @@
+package uid
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/unit-io/unitd/pkg/crypto"
+)
+
+func TestDecodeKeyID(t *testing.T) {
+	ring := crypto.NewKeyring(0)
+	assert.NoError(t, ring.Add("key", make([]byte, 32), 0))
+	id, err := NewClientID(1)
+	assert.NoError(t, err)
+	cid := id.Encode(ring)
+
+	decoded, err := Decode([]byte(cid), ring)
+	assert.NoError(t, err)
+	assert.Equal(t, id, decoded)
+
+	// The key identifier with a character not of the encoding is refused.
+	for _, c := range []byte{'0', 'g', '!', '/'} {
+		invalid := []byte(cid)
+		invalid[idLen+keyIDLen-1] = c
+		_, err = Decode(invalid, ring)
+		assert.Error(t, err, string(c))
+	}
+	_, err = decodeKeyID([]byte("AAAAAA!"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	jcr "github.com/DisposaBoy/JsonConfigReader"
+	"github.com/unit-io/unitd/broker"
+	"github.com/unit-io/unitd/config"
+	"github.com/unit-io/unitd/pkg/crypto"
+)
+
+// sealKey seals a key with the key-encryption key so that the key is not kept in plain text in the config file.
+// Usage: unitd seal [-config unitd.conf] [-kek-file file] [-kek-env name] [key]
+// The key is read from the standard input if it is not provided.
+func sealKey(args []string) {
+	flags := flag.NewFlagSet("seal", flag.ExitOnError)
+	var configfile = flags.String("config", "", "Path to config file to read the unseal config from.")
+	var kekFile = flags.String("kek-file", "", "Path to the file with the key-encryption key.")
+	var kekEnv = flags.String("kek-env", "", "Environment variable with the key-encryption key.")
+	flags.Parse(args)
+
+	var unseal config.UnsealConfig
+	if *configfile != "" {
+		var cfg *config.Config
+		if file, err := os.Open(*configfile); err != nil {
+			fatal("Failed to read config file", err)
+		} else if err = json.NewDecoder(jcr.New(file)).Decode(&cfg); err != nil {
+			fatal("Failed to parse config file", err)
+		}
+		unseal = cfg.Unseal(cfg.UnsealConfig)
+	}
+	if *kekFile != "" || *kekEnv != "" {
+		unseal = config.UnsealConfig{File: *kekFile, Env: *kekEnv}
+	}
+
+	key := flags.Arg(0)
+	if key == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fatal("Failed to read key", err)
+		}
+		key = strings.TrimRight(line, "\r\n")
+	}
+
+	kek, err := broker.LoadKEK(unseal)
+	if err != nil {
+		fatal("Failed to load key-encryption key", err)
+	}
+	sealed, err := crypto.Seal(kek, []byte(key))
+	if err != nil {
+		fatal("Failed to seal key", err)
+	}
+	fmt.Println(sealed)
+}
+
+func fatal(msg string, err error) {
+	fmt.Fprintln(os.Stderr, msg+": "+err.Error())
+	os.Exit(1)
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/unit-io/unitd/pkg/hash"
+	"github.com/unit-io/unitd/pkg/log"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The payloads are sealed with the current storage key and prefixed with the version and the key identifier
+// "[version][key id][nonce][ciphertext]", so the payloads sealed with an earlier key are opened after the key is rotated.
+const (
+	// MQTT packets and encoded messages never start with a zero byte.
+	sealedVersion = 0x00
+	sealedHeader  = 5
+)
+
+var (
+	errUnknownStorageKey = errors.New("store: payload is sealed with an unknown storage key")
+	errInvalidSealed     = errors.New("store: invalid sealed payload")
+)
+
+// keyring holds the storage keys by the key identifier.
+type keyring struct {
+	current uint32
+	keys    map[uint32]cipher.AEAD
+}
+
+var storageKeys *keyring
+
+// SetEncryption enables the encryption of the payloads at rest. The keys are chacha20poly1305 keys by
+// identifier, the payloads are sealed with the key of the current identifier.
+func SetEncryption(keys map[string][]byte, current string) error {
+	if _, ok := keys[current]; !ok {
+		return errors.New("store: storage key '" + current + "' not found")
+	}
+	ring := &keyring{
+		current: keyID(current),
+		keys:    make(map[uint32]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return errors.New("store: storage key '" + id + "': " + err.Error())
+		}
+		ring.keys[keyID(id)] = aead
+	}
+	storageKeys = ring
+	return nil
+}
+
+func keyID(identifier string) uint32 {
+	return hash.New([]byte(identifier))
+}
+
+// seal encrypts the payload with the current storage key if the encryption is enabled.
+func seal(raw []byte) []byte {
+	if storageKeys == nil {
+		return raw
+	}
+	aead := storageKeys.keys[storageKeys.current]
+	buf := make([]byte, sealedHeader+aead.NonceSize(), sealedHeader+aead.NonceSize()+len(raw)+aead.Overhead())
+	buf[0] = sealedVersion
+	binary.LittleEndian.PutUint32(buf[1:sealedHeader], storageKeys.current)
+	nonce := buf[sealedHeader:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		log.Fatal("store.seal", "unable to generate nonce", err)
+	}
+	return aead.Seal(buf, nonce, raw, buf[:sealedHeader])
+}
+
+// unseal decrypts the payload sealed with a storage key, the payloads stored before the encryption
+// was enabled are returned as is.
+func unseal(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || raw[0] != sealedVersion {
+		return raw, nil
+	}
+	if len(raw) < sealedHeader {
+		return nil, errInvalidSealed
+	}
+	if storageKeys == nil {
+		return nil, errUnknownStorageKey
+	}
+	aead, ok := storageKeys.keys[binary.LittleEndian.Uint32(raw[1:sealedHeader])]
+	if !ok {
+		return nil, errUnknownStorageKey
+	}
+	n := sealedHeader + aead.NonceSize()
+	if len(raw) < n {
+		return nil, errInvalidSealed
+	}
+	return aead.Open(nil, raw[sealedHeader:n], raw[n:], raw[:sealedHeader])
+}
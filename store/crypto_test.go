@@ -0,0 +1,35 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealRotation(t *testing.T) {
+	defer func() { storageKeys = nil }()
+
+	plain := encodeMessage([]byte("id"), []byte("a.b"), 1, []byte("payload"))
+	assert.Nil(t, SetEncryption(map[string][]byte{"k1": []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")}, "k1"))
+	sealed := encodeMessage([]byte("id"), []byte("a.b"), 1, []byte("payload"))
+	assert.NotContains(t, string(sealed), "payload")
+
+	// The key is rotated, the payloads sealed with the earlier key are opened.
+	keys := map[string][]byte{
+		"k1": []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I"),
+		"k2": []byte("Xk1Gq3kPb2cSVjXo2Zl0w8vN6hYt4Rr9"),
+	}
+	assert.Nil(t, SetEncryption(keys, "k2"))
+	for _, raw := range [][]byte{plain, sealed, encodeMessage([]byte("id"), []byte("a.b"), 1, []byte("payload"))} {
+		_, msg, ok := decodeMessage(raw)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("payload"), msg.Payload)
+	}
+
+	// The payload sealed with an unknown key is not opened.
+	assert.Nil(t, SetEncryption(map[string][]byte{"k2": keys["k2"]}, "k2"))
+	_, _, ok := decodeMessage(sealed)
+	assert.False(t, ok)
+
+	assert.NotNil(t, SetEncryption(keys, "k3"))
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pagedTopic stores the entries of a topic in pages of at most max results entries, so that all the entries
+// are read back. The first page is the topic itself, the next pages are "<topic>.<page>", and the last page
+// is recorded on "<topic>.pages".
+type pagedTopic struct {
+	sync.Mutex
+	topic []byte
+	last  map[uint32]*topicPage // The last page of the contracts.
+}
+
+// topicPage is the last page of the topic and the number of entries put on the page.
+type topicPage struct {
+	page  int
+	count int
+}
+
+func newPagedTopic(topic string) *pagedTopic {
+	return &pagedTopic{
+		topic: []byte(topic),
+		last:  make(map[uint32]*topicPage),
+	}
+}
+
+// pageTopic returns the topic of the page.
+func (p *pagedTopic) pageTopic(page int) []byte {
+	if page == 0 {
+		return p.topic
+	}
+	return []byte(string(p.topic) + "." + strconv.Itoa(page))
+}
+
+func (p *pagedTopic) pagesTopic() []byte {
+	return []byte(string(p.topic) + ".pages")
+}
+
+// lastPage returns the last page of the contract, loading it from the store if not cached.
+func (p *pagedTopic) lastPage(contract uint32) (*topicPage, error) {
+	if last, ok := p.last[contract]; ok {
+		return last, nil
+	}
+	last := &topicPage{}
+	pages, err := adp.Get(contract, p.pagesTopic(), 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) > 0 {
+		if last.page, err = strconv.Atoi(string(pages[0])); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := adp.Get(contract, p.pageTopic(last.page), maxResults)
+	if err != nil {
+		return nil, err
+	}
+	last.count = len(entries)
+	p.last[contract] = last
+	return last, nil
+}
+
+// put puts the entry on the last page, a new page is started once the last page is full.
+// The entry expires after the ttl unless the ttl is zero.
+func (p *pagedTopic) put(contract uint32, messageId, payload []byte, ttl time.Duration) error {
+	p.Lock()
+	defer p.Unlock()
+	last, err := p.lastPage(contract)
+	if err != nil {
+		return err
+	}
+	if last.count >= maxResults {
+		pageId, err := adp.NewID()
+		if err != nil {
+			return err
+		}
+		if err := adp.PutWithID(contract, pageId, p.pagesTopic(), []byte(strconv.Itoa(last.page+1))); err != nil {
+			return err
+		}
+		last.page++
+		last.count = 0
+	}
+
+	topic := p.pageTopic(last.page)
+	if ttl > 0 {
+		topic = withTTL(topic, ttl)
+	}
+	if err := adp.PutWithID(contract, messageId, topic, payload); err != nil {
+		return err
+	}
+	last.count++
+	return nil
+}
+
+// topics returns the topics of all the pages of the contract.
+func (p *pagedTopic) topics(contract uint32) ([][]byte, error) {
+	p.Lock()
+	defer p.Unlock()
+	last, err := p.lastPage(contract)
+	if err != nil {
+		return nil, err
+	}
+	topics := make([][]byte, 0, last.page+1)
+	for page := 0; page <= last.page; page++ {
+		topics = append(topics, p.pageTopic(page))
+	}
+	return topics, nil
+}
+
+// get gets the entries of all the pages of the contract.
+func (p *pagedTopic) get(contract uint32) (entries [][]byte, err error) {
+	topics, err := p.topics(contract)
+	if err != nil {
+		return nil, err
+	}
+	for _, topic := range topics {
+		resp, err := adp.Get(contract, topic, maxResults)
+		if err != nil {
+			return entries, err
+		}
+		for _, entry := range resp {
+			if entry != nil {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"encoding/binary"
+	"time"
+
+	lp "github.com/unit-io/unitd/lineprotocol"
+)
+
+// The qos of the message is flagged if the MQTT 5 properties of the message are encoded after the qos.
+const propertiesFlag = 0x80
+
+// The MQTT 5 properties stored with the messages, the identifiers are the MQTT 5 property identifiers.
+const (
+	propPayloadFormat   = 0x01
+	propMessageExpiry   = 0x02
+	propContentType     = 0x03
+	propResponseTopic   = 0x08
+	propCorrelationData = 0x09
+	propUserProperty    = 0x26
+)
+
+// encodeProperties encodes the properties forwarded with the message. The message expiry interval
+// is encoded as the time the message expires so that the remaining interval is decoded.
+func encodeProperties(p *lp.Properties) []byte {
+	var buf []byte
+	if p.PayloadFormat != nil {
+		buf = append(buf, propPayloadFormat, *p.PayloadFormat)
+	}
+	if p.MessageExpiry != 0 {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(time.Now().Unix())+uint64(p.MessageExpiry))
+		buf = append(append(buf, propMessageExpiry), b[:]...)
+	}
+	if p.ContentType != nil {
+		buf = appendBytes(append(buf, propContentType), p.ContentType)
+	}
+	if p.ResponseTopic != nil {
+		buf = appendBytes(append(buf, propResponseTopic), p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		buf = appendBytes(append(buf, propCorrelationData), p.CorrelationData)
+	}
+	for _, u := range p.UserProperties {
+		buf = appendBytes(appendBytes(append(buf, propUserProperty), u.Key), u.Value)
+	}
+	return buf
+}
+
+// decodeProperties decodes the properties forwarded with the message. It returns false if the properties
+// are not valid or if the message has expired.
+func decodeProperties(raw []byte) (*lp.Properties, bool) {
+	p := &lp.Properties{}
+	for len(raw) > 0 {
+		id := raw[0]
+		raw = raw[1:]
+		var ok bool
+		switch id {
+		case propPayloadFormat:
+			if len(raw) < 1 {
+				return nil, false
+			}
+			format := raw[0]
+			p.PayloadFormat = &format
+			raw, ok = raw[1:], true
+		case propMessageExpiry:
+			if len(raw) < 8 {
+				return nil, false
+			}
+			remaining := int64(binary.LittleEndian.Uint64(raw[:8])) - time.Now().Unix()
+			if remaining <= 0 {
+				return nil, false
+			}
+			p.MessageExpiry = uint32(remaining)
+			raw, ok = raw[8:], true
+		case propContentType:
+			p.ContentType, raw, ok = readBytes(raw)
+		case propResponseTopic:
+			p.ResponseTopic, raw, ok = readBytes(raw)
+		case propCorrelationData:
+			p.CorrelationData, raw, ok = readBytes(raw)
+		case propUserProperty:
+			var u lp.UserProperty
+			if u.Key, raw, ok = readBytes(raw); ok {
+				u.Value, raw, ok = readBytes(raw)
+			}
+			p.UserProperties = append(p.UserProperties, u)
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return p, true
+}
+
+// appendBytes appends the bytes prefixed with the length.
+func appendBytes(buf, b []byte) []byte {
+	var l [2]byte
+	binary.LittleEndian.PutUint16(l[:], uint16(len(b)))
+	return append(append(buf, l[:]...), b...)
+}
+
+// readBytes reads the bytes prefixed with the length and returns the bytes remaining.
+func readBytes(raw []byte) (b, rest []byte, ok bool) {
+	if len(raw) < 2 {
+		return nil, nil, false
+	}
+	l := 2 + int(binary.LittleEndian.Uint16(raw[:2]))
+	if len(raw) < l {
+		return nil, nil, false
+	}
+	return raw[2:l], raw[l:], true
+}
@@ -3,21 +3,35 @@ package store
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	adapter "github.com/unit-io/unitd/db"
 	lp "github.com/unit-io/unitd/lineprotocol"
 	"github.com/unit-io/unitd/message"
+	"github.com/unit-io/unitd/pkg/hash"
 	"github.com/unit-io/unitd/pkg/log"
 )
 
 const (
 	// Maximum number of records to return
-	maxResults         = 1024
-	connStoreId uint32 = 4105991048 // hash("connectionstore")
+	maxResults             = 1024
+	connStoreId     uint32 = 4105991048 // hash("connectionstore")
+	retainedStoreId uint32 = 2035855306 // hash("retainedstore")
+	sessionStoreId  uint32 = 483311902  // hash("sessionstore")
+	inboundStoreId  uint32 = 3148144730 // hash("inbound")
+	revokedStoreId  uint32 = 1944250302 // hash("revocationstore")
+	clientIdStoreId uint32 = 2807858192 // hash("clientidstore")
+	quotaStoreId    uint32 = 3859775830 // hash("quotastore")
+
+	// The messages published until a time are searched back for a day if the since time is not given.
+	historyWindow = 24 * time.Hour
 )
 
 var adp adapter.Adapter
@@ -112,6 +126,14 @@ func RegisterAdapter(name string, a adapter.Adapter) {
 	adp = a
 }
 
+// SetAdapter replaces the adapter registered and returns the adapter replaced, so that the packages
+// using the store are tested with an adapter in memory.
+func SetAdapter(a adapter.Adapter) adapter.Adapter {
+	prev := adp
+	adp = a
+	return prev
+}
+
 // SubscriptionStore is a Subscription struct to hold methods for persistence mapping for the subscription.
 // Note, do not use same contract as messagestore
 type SubscriptionStore struct{}
@@ -123,8 +145,13 @@ func (s *SubscriptionStore) Put(contract uint32, messageId, topic, payload []byt
 	return adp.PutWithID(contract^connStoreId, messageId, topic, payload)
 }
 
+// PutWithTTL stores the subscription that expires after the ttl.
+func (s *SubscriptionStore) PutWithTTL(contract uint32, messageId, topic, payload []byte, ttl time.Duration) error {
+	return adp.PutWithID(contract^connStoreId, messageId, withTTL(topic, ttl), payload)
+}
+
 func (s *SubscriptionStore) Get(contract uint32, topic []byte) (matches [][]byte, err error) {
-	resp, err := adp.Get(contract^connStoreId, topic)
+	resp, err := adp.Get(contract^connStoreId, topic, maxResults)
 	for _, payload := range resp {
 		if payload == nil {
 			continue
@@ -149,23 +176,456 @@ type MessageStore struct{}
 // Message is the anchor for storing/retrieving Message objects
 var Message MessageStore
 
-func (m *MessageStore) Put(contract uint32, topic, payload []byte) error {
-	return adp.Put(contract, topic, payload)
+// Put stores the message published at the time with the MQTT 5 properties of the message if any,
+// the message expires after the ttl unless the ttl is zero.
+func (m *MessageStore) Put(contract uint32, topic []byte, qos uint8, payload []byte, props *lp.Properties, ttl time.Duration, published time.Time) error {
+	raw := encodeHistory(published, topic, qos, props, payload)
+	if ttl > 0 {
+		topic = withTTL(topic, ttl)
+	}
+	return adp.Put(contract, topic, raw)
 }
 
-func (m *MessageStore) Get(contract uint32, topic []byte) (matches []message.Message, err error) {
-	resp, err := adp.Get(contract, topic)
-	for _, payload := range resp {
-		msg := message.Message{
-			Topic:   topic,
-			Payload: payload,
+// Get returns the last messages stored for the topic in the time order. The messages published since
+// and until the time are returned if the time is not zero, and at most limit messages are returned.
+// The messages published until the time are filtered on the time published from the last max results
+// messages published since the since time, or since a day before the until time if since is not given.
+func (m *MessageStore) Get(contract uint32, topic []byte, since, until time.Time, limit int) (matches []message.Message, err error) {
+	if limit <= 0 || limit > maxResults {
+		limit = maxResults
+	}
+	// The messages published after until are filtered so the query is not limited.
+	queryLimit := limit
+	if !until.IsZero() {
+		queryLimit = maxResults
+		if since.IsZero() {
+			since = until.Add(-historyWindow)
+		}
+	}
+	query := topic
+	if !since.IsZero() {
+		query = withOption(query, "last", (time.Since(since).Round(time.Second) + time.Second).String())
+	}
+	resp, err := adp.Get(contract, query, queryLimit)
+	if !until.IsZero() && len(resp) == maxResults {
+		log.ErrLogger.Warn().Str("context", "messageStore.Get").Uint32("contract", contract).Time("since", since).Msg("history window exceeds the max results")
+	}
+
+	published := make([]int64, 0, len(resp))
+	for _, raw := range resp {
+		ts, msg, ok := decodeMessage(raw)
+		if !ok || len(ts) != 8 {
+			continue
+		}
+		t := int64(binary.LittleEndian.Uint64(ts))
+		if (!since.IsZero() && t < since.UnixNano()) || (!until.IsZero() && t > until.UnixNano()) {
+			continue
+		}
+		msg.Published = t
+		published = append(published, t)
+		matches = append(matches, msg)
+	}
+	sort.Sort(byPublished{published, matches})
+	if len(matches) > limit {
+		matches = matches[len(matches)-limit:]
+	}
+
+	return matches, err
+}
+
+// byPublished sorts the messages in the order those are published.
+type byPublished struct {
+	published []int64
+	msgs      []message.Message
+}
+
+func (b byPublished) Len() int           { return len(b.msgs) }
+func (b byPublished) Less(i, j int) bool { return b.published[i] < b.published[j] }
+func (b byPublished) Swap(i, j int) {
+	b.published[i], b.published[j] = b.published[j], b.published[i]
+	b.msgs[i], b.msgs[j] = b.msgs[j], b.msgs[i]
+}
+
+// encodeHistory encodes the message with the time it is published in place of the messageId.
+func encodeHistory(published time.Time, topic []byte, qos uint8, props *lp.Properties, payload []byte) []byte {
+	ts := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ts, uint64(published.UnixNano()))
+	return encodeMessageWithProperties(ts, topic, qos, props, payload)
+}
+
+// RetainedStore is a Retained struct to hold methods for persistence mapping for the retained messages.
+// Only one message is retained per topic for a contract.
+type RetainedStore struct {
+	sync.Mutex
+}
+
+// Retained is the anchor for storing/retrieving retained messages
+var Retained RetainedStore
+
+// Put retains the message for the topic replacing the message retained earlier, an empty payload clears the retained message.
+// The message is retained until the message expiry interval of the MQTT 5 properties has passed.
+func (r *RetainedStore) Put(contract uint32, topic []byte, qos uint8, payload []byte, props *lp.Properties) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.delete(contract, topic); err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	messageId, err := adp.NewID()
+	if err != nil {
+		return err
+	}
+	raw := encodeMessageWithProperties(messageId, topic, qos, props, payload)
+	if props != nil && props.MessageExpiry != 0 {
+		return adp.PutWithID(contract^retainedStoreId, messageId, withTTL(topic, time.Duration(props.MessageExpiry)*time.Second), raw)
+	}
+	return adp.PutWithID(contract^retainedStoreId, messageId, topic, raw)
+}
+
+// Get returns messages retained for the topic, the topic can be a wildcard topic.
+func (r *RetainedStore) Get(contract uint32, topic []byte) (matches []message.Message, err error) {
+	resp, err := adp.Get(contract^retainedStoreId, topic, maxResults)
+	for _, raw := range resp {
+		_, msg, ok := decodeMessage(raw)
+		if !ok {
+			continue
 		}
+		msg.Retain = true
 		matches = append(matches, msg)
 	}
 
 	return matches, err
 }
 
+// delete removes the message retained for the topic.
+func (r *RetainedStore) delete(contract uint32, topic []byte) error {
+	resp, err := adp.Get(contract^retainedStoreId, topic, maxResults)
+	if err != nil {
+		return err
+	}
+	for _, raw := range resp {
+		messageId, msg, _ := decodeMessage(raw)
+		if messageId == nil || !bytes.Equal(msg.Topic, topic) {
+			continue
+		}
+		if err := adp.Delete(contract^retainedStoreId, messageId, topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeMessage encodes message with the messageId and topic so that it can be deleted or delivered to wildcard subscriptions.
+func encodeMessage(messageId, topic []byte, qos uint8, payload []byte) []byte {
+	return encodeMessageWithProperties(messageId, topic, qos, nil, payload)
+}
+
+// encodeMessageWithProperties encodes the message with the MQTT 5 properties of the message, the properties
+// are encoded after the qos and the qos is flagged if the message has properties.
+func encodeMessageWithProperties(messageId, topic []byte, qos uint8, props *lp.Properties, payload []byte) []byte {
+	var encoded []byte
+	if props != nil {
+		encoded = encodeProperties(props)
+	}
+	buf := make([]byte, 2+len(messageId)+2+len(topic)+1, 2+len(messageId)+2+len(topic)+1+2+len(encoded)+len(payload))
+	binary.LittleEndian.PutUint16(buf[0:2], uint16(len(messageId)))
+	n := 2 + copy(buf[2:], messageId)
+	binary.LittleEndian.PutUint16(buf[n:n+2], uint16(len(topic)))
+	n += 2 + copy(buf[n+2:], topic)
+	buf[n] = qos
+	if len(encoded) > 0 {
+		buf[n] |= propertiesFlag
+		buf = appendBytes(buf, encoded)
+	}
+	return seal(append(buf, payload...))
+}
+
+// decodeMessage decodes the message, the messageId is returned if the message is not decoded as the message has expired.
+func decodeMessage(raw []byte) (messageId []byte, msg message.Message, ok bool) {
+	raw, err := unseal(raw)
+	if err != nil {
+		log.ErrLogger.Err(err).Str("context", "store.decodeMessage").Msg("unable to unseal message")
+		return nil, msg, false
+	}
+	if len(raw) < 2 {
+		return nil, msg, false
+	}
+	n := 2 + int(binary.LittleEndian.Uint16(raw[0:2]))
+	if len(raw) < n+2 {
+		return nil, msg, false
+	}
+	messageId = raw[2:n]
+	l := int(binary.LittleEndian.Uint16(raw[n : n+2]))
+	n += 2
+	if len(raw) < n+l+1 {
+		return nil, msg, false
+	}
+	msg.Topic = raw[n : n+l]
+	msg.Qos = raw[n+l] &^ propertiesFlag
+	msg.Payload = raw[n+l+1:]
+	if raw[n+l]&propertiesFlag != 0 {
+		encoded, payload, ok := readBytes(msg.Payload)
+		if !ok {
+			return messageId, msg, false
+		}
+		// The message whose message expiry interval has passed is not decoded.
+		if msg.Properties, ok = decodeProperties(encoded); !ok {
+			return messageId, msg, false
+		}
+		msg.Payload = payload
+	}
+	return messageId, msg, true
+}
+
+// RevocationStore is a store for the security keys revoked by the contract.
+type RevocationStore struct{}
+
+// Revocation is the anchor for storing/retrieving the revoked keys.
+var Revocation RevocationStore
+
+// revokedTopic is the topic the revoked keys of a contract are stored with.
+var revokedTopic = newPagedTopic("revoked")
+
+// Revoke stores the revoked key, the revocation expires after the ttl unless the ttl is zero.
+func (r *RevocationStore) Revoke(contract uint32, key []byte, ttl time.Duration) error {
+	messageId, err := adp.NewID()
+	if err != nil {
+		return err
+	}
+	return revokedTopic.put(contract^revokedStoreId, messageId, key, ttl)
+}
+
+// Revoked gets the keys revoked by the contract.
+func (r *RevocationStore) Revoked(contract uint32) (keys [][]byte, err error) {
+	return revokedTopic.get(contract ^ revokedStoreId)
+}
+
+// ClientIdStore is a store for the secondary client Ids, the client Ids are recorded under
+// the contract of the primary client Id that requested the client Id.
+type ClientIdStore struct{}
+
+// ClientId is the anchor for storing/retrieving the secondary client Ids.
+var ClientId ClientIdStore
+
+var (
+	clientIdTopic        = newPagedTopic("clientid")
+	revokedClientIdTopic = newPagedTopic("clientid.revoked")
+)
+
+// Put records the secondary client Id, the id is the client Id decoded and the client Id is encoded.
+func (s *ClientIdStore) Put(contract uint32, id, clientID []byte) error {
+	messageId, err := adp.NewID()
+	if err != nil {
+		return err
+	}
+	// The id is encoded in place of the topic of the message.
+	return clientIdTopic.put(contract^clientIdStoreId, messageId, encodeMessage(messageId, id, 0, clientID), 0)
+}
+
+// Get gets the secondary client Ids recorded for the contract.
+func (s *ClientIdStore) Get(contract uint32) (clientIDs [][]byte, err error) {
+	resp, err := clientIdTopic.get(contract ^ clientIdStoreId)
+	for _, raw := range resp {
+		if _, msg, ok := decodeMessage(raw); ok {
+			clientIDs = append(clientIDs, msg.Payload)
+		}
+	}
+
+	return clientIDs, err
+}
+
+// Revoke removes the secondary client Id recorded for the contract and records the client Id
+// as revoked. It returns false if the client Id is not recorded for the contract.
+func (s *ClientIdStore) Revoke(contract uint32, id []byte) (ok bool, err error) {
+	topics, err := clientIdTopic.topics(contract ^ clientIdStoreId)
+	if err != nil {
+		return false, err
+	}
+	for _, topic := range topics {
+		resp, err := adp.Get(contract^clientIdStoreId, topic, maxResults)
+		if err != nil {
+			return false, err
+		}
+		for _, raw := range resp {
+			messageId, msg, decoded := decodeMessage(raw)
+			if !decoded || !bytes.Equal(msg.Topic, id) {
+				continue
+			}
+			if err := adp.Delete(contract^clientIdStoreId, messageId, topic); err != nil {
+				return false, err
+			}
+			ok = true
+		}
+	}
+	if !ok {
+		return false, nil
+	}
+	return true, s.PutRevoked(contract, id)
+}
+
+// PutRevoked records the client Id revoked by the contract.
+func (s *ClientIdStore) PutRevoked(contract uint32, id []byte) error {
+	messageId, err := adp.NewID()
+	if err != nil {
+		return err
+	}
+	return revokedClientIdTopic.put(contract^clientIdStoreId, messageId, id, 0)
+}
+
+// Revoked gets the client Ids revoked by the contract.
+func (s *ClientIdStore) Revoked(contract uint32) ([][]byte, error) {
+	return revokedClientIdTopic.get(contract ^ clientIdStoreId)
+}
+
+// QuotaStore is a store for the payload bytes stored against the quota of the contract.
+type QuotaStore struct{}
+
+// Quota is the anchor for storing/retrieving the stored payload bytes.
+var Quota QuotaStore
+
+// storedTopic is the topic the stored payload bytes of a contract are recorded with.
+var storedTopic = newPagedTopic("quota.stored")
+
+// StoredBytes is the size of the payloads stored those expire at the time.
+type StoredBytes struct {
+	Expiry time.Time
+	Size   int64
+}
+
+// PutStored records the payload bytes stored by the contract those expire at the time, the record expires
+// with the payloads. The bytes are added to the bytes recorded earlier with the same expiry.
+func (q *QuotaStore) PutStored(contract uint32, stored StoredBytes) error {
+	ttl := time.Until(stored.Expiry)
+	if ttl <= 0 {
+		return nil
+	}
+	messageId, err := adp.NewID()
+	if err != nil {
+		return err
+	}
+	value := make([]byte, 16)
+	binary.LittleEndian.PutUint64(value[0:8], uint64(stored.Expiry.UnixNano()))
+	binary.LittleEndian.PutUint64(value[8:16], uint64(stored.Size))
+	return storedTopic.put(contract^quotaStoreId, messageId, value, ttl)
+}
+
+// Stored gets the payload bytes stored by the contract those are not expired, in the order of the expiry.
+func (q *QuotaStore) Stored(contract uint32) (stored []StoredBytes, err error) {
+	resp, err := storedTopic.get(contract ^ quotaStoreId)
+	now := time.Now().UnixNano()
+	sizes := make(map[int64]int64)
+	for _, value := range resp {
+		if len(value) != 16 {
+			continue
+		}
+		expiry := int64(binary.LittleEndian.Uint64(value[0:8]))
+		if expiry > now {
+			sizes[expiry] += int64(binary.LittleEndian.Uint64(value[8:16]))
+		}
+	}
+	for expiry, size := range sizes {
+		stored = append(stored, StoredBytes{Expiry: time.Unix(0, expiry), Size: size})
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Expiry.Before(stored[j].Expiry) })
+	return stored, err
+}
+
+// SessionStore is a Session struct to hold methods for persistence mapping for the persistent sessions.
+// A session holds the subscriptions and the messages queued while the client is offline, those expire
+// with the session expiry interval.
+type SessionStore struct{}
+
+// Session is the anchor for storing/retrieving persistent sessions
+var Session SessionStore
+
+// SessionSubscription represents a subscription stored in the session.
+type SessionSubscription struct {
+	ID      []byte // The Id of the offline subscription in the subscription store.
+	Topic   []byte // The topic including the key as requested by the client.
+	Qos     uint8
+	Options uint8 // The MQTT 5 subscription options.
+}
+
+func sessionTopic(prefix string, sessid uint32) []byte {
+	return []byte(prefix + "." + strconv.FormatUint(uint64(sessid), 10))
+}
+
+// withTTL appends the ttl option to the topic so that the entry expires after the ttl.
+func withTTL(topic []byte, ttl time.Duration) []byte {
+	return withOption(topic, "ttl", ttl.String())
+}
+
+// withOption appends the option to the topic.
+func withOption(topic []byte, name, value string) []byte {
+	if bytes.IndexByte(topic, '?') >= 0 {
+		return []byte(string(topic) + "&" + name + "=" + value)
+	}
+	return []byte(string(topic) + "?" + name + "=" + value)
+}
+
+// PutSubscription stores the subscription in the session.
+func (s *SessionStore) PutSubscription(contract, sessid uint32, sub SessionSubscription, ttl time.Duration) error {
+	messageId, err := adp.NewID()
+	if err != nil {
+		return err
+	}
+	topic := sessionTopic("subscriptions", sessid)
+	return adp.PutWithID(contract^sessionStoreId, messageId, withTTL(topic, ttl), encodeMessage(messageId, sub.Topic, sub.Qos|sub.Options, sub.ID))
+}
+
+// Subscriptions returns the subscriptions stored in the session and removes them from the session.
+func (s *SessionStore) Subscriptions(contract, sessid uint32) (subs []SessionSubscription, err error) {
+	topic := sessionTopic("subscriptions", sessid)
+	resp, err := adp.Get(contract^sessionStoreId, topic, maxResults)
+	for _, raw := range resp {
+		messageId, msg, ok := decodeMessage(raw)
+		if !ok {
+			continue
+		}
+		if err := adp.Delete(contract^sessionStoreId, messageId, topic); err != nil {
+			return subs, err
+		}
+		subs = append(subs, SessionSubscription{ID: msg.Payload, Topic: msg.Topic, Qos: msg.Qos & 0x03, Options: msg.Qos &^ 0x03})
+	}
+
+	return subs, err
+}
+
+// Enqueue queues the message for the offline session.
+func (s *SessionStore) Enqueue(contract, sessid uint32, msg *message.Message, ttl time.Duration) error {
+	messageId, err := adp.NewID()
+	if err != nil {
+		return err
+	}
+	topic := sessionTopic("queue", sessid)
+	return adp.PutWithID(contract^sessionStoreId, messageId, withTTL(topic, ttl), encodeMessageWithProperties(messageId, msg.Topic, msg.Qos, msg.Properties, msg.Payload))
+}
+
+// Dequeue returns the messages queued for the session and removes them from the queue.
+func (s *SessionStore) Dequeue(contract, sessid uint32) (msgs []message.Message, err error) {
+	topic := sessionTopic("queue", sessid)
+	resp, err := adp.Get(contract^sessionStoreId, topic, maxResults)
+	for _, raw := range resp {
+		// The messages expired in the queue are also removed.
+		messageId, msg, ok := decodeMessage(raw)
+		if messageId == nil {
+			continue
+		}
+		if err := adp.Delete(contract^sessionStoreId, messageId, topic); err != nil {
+			return msgs, err
+		}
+		if ok {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs, err
+}
+
 // MessageLog is a Message struct to hold methods for persistence mapping for the Message object.
 type MessageLog struct{}
 
@@ -217,8 +677,9 @@ func (l *MessageLog) PersistOutbound(proto lp.ProtoAdapter, blockId, key uint64,
 				log.ErrLogger.Err(err).Str("context", "store.PersistOutbound")
 				return
 			}
-			adp.PutMessage(blockId, key, m.Bytes())
-			adp.Append(false, key, m.Bytes())
+			raw := seal(m.Bytes())
+			adp.PutMessage(blockId, key, raw)
+			adp.Append(false, key, raw)
 		default:
 		}
 	case 2:
@@ -231,8 +692,9 @@ func (l *MessageLog) PersistOutbound(proto lp.ProtoAdapter, blockId, key uint64,
 				log.ErrLogger.Err(err).Str("context", "store.PersistOutbound")
 				return
 			}
-			adp.PutMessage(blockId, key, m.Bytes())
-			adp.Append(false, key, m.Bytes())
+			raw := seal(m.Bytes())
+			adp.PutMessage(blockId, key, raw)
+			adp.Append(false, key, raw)
 		default:
 		}
 	}
@@ -261,8 +723,9 @@ func (l *MessageLog) PersistInbound(proto lp.ProtoAdapter, blockId, key uint64,
 				log.ErrLogger.Err(err).Str("context", "store.PersistOutbound")
 				return
 			}
-			adp.PutMessage(blockId, key, m.Bytes())
-			adp.Append(false, key, m.Bytes())
+			raw := seal(m.Bytes())
+			adp.PutMessage(blockId, key, raw)
+			adp.Append(false, key, raw)
 		default:
 		}
 	case 2:
@@ -275,8 +738,9 @@ func (l *MessageLog) PersistInbound(proto lp.ProtoAdapter, blockId, key uint64,
 				log.ErrLogger.Err(err).Str("context", "store.PersistOutbound")
 				return
 			}
-			adp.PutMessage(blockId, key, m.Bytes())
-			adp.Append(false, key, m.Bytes())
+			raw := seal(m.Bytes())
+			adp.PutMessage(blockId, key, raw)
+			adp.Append(false, key, raw)
 		default:
 		}
 	}
@@ -286,6 +750,10 @@ func (l *MessageLog) PersistInbound(proto lp.ProtoAdapter, blockId, key uint64,
 func (l *MessageLog) Get(proto lp.ProtoAdapter, key uint64) lp.Packet {
 	blockId := key & 0xFFFFFFFF
 	if raw, err := adp.GetMessage(blockId, key); raw != nil && err == nil {
+		if raw, err = unseal(raw); err != nil {
+			log.ErrLogger.Err(err).Str("context", "store.Get").Msg("unable to unseal message")
+			return nil
+		}
 		r := bytes.NewReader(raw)
 		if msg, err := lp.ReadPacket(proto, r); err == nil {
 			return msg
@@ -295,6 +763,53 @@ func (l *MessageLog) Get(proto lp.ProtoAdapter, key uint64) lp.Packet {
 	return nil
 }
 
+// inboundKey returns the key of the inbound QoS 2 message of the session, and the value stored for the key
+// to identify the session and the message id.
+func inboundKey(contract, sessid uint32, messageID uint16) (blockId, key uint64, value []byte) {
+	value = make([]byte, 6)
+	binary.LittleEndian.PutUint32(value[0:4], sessid)
+	binary.LittleEndian.PutUint16(value[4:6], messageID)
+	blockId = uint64(contract ^ inboundStoreId)
+	key = uint64(hash.WithSalt(value, contract))<<32 + blockId
+	return blockId, key, value
+}
+
+// Received records the inbound QoS 2 message of the session until the message is released. It returns
+// false if the message is already recorded, the message is a duplicate and it is not delivered again.
+// The record is written to the log so the duplicates are detected after a restart.
+func (l *MessageLog) Received(contract, sessid uint32, messageID uint16) (first bool) {
+	blockId, key, value := inboundKey(contract, sessid, messageID)
+	if raw, err := adp.GetMessage(blockId, key); err == nil && bytes.Equal(raw, value) {
+		return false
+	}
+	if err := adp.PutMessage(blockId, key, value); err != nil {
+		log.ErrLogger.Err(err).Str("context", "store.Received").Msg("unable to record inbound message")
+	}
+	adp.Append(false, key, value)
+	return true
+}
+
+// Released removes the inbound QoS 2 message of the session as the message is released by the client.
+func (l *MessageLog) Released(contract, sessid uint32, messageID uint16) {
+	blockId, key, _ := inboundKey(contract, sessid, messageID)
+	adp.DeleteMessage(blockId, key)
+	adp.Append(true, key, nil)
+}
+
+// ResetInbound removes the inbound QoS 2 messages of the session as the client requested a clean session.
+func (l *MessageLog) ResetInbound(contract, sessid uint32) {
+	blockId := uint64(contract ^ inboundStoreId)
+	for _, k := range adp.Keys(blockId) {
+		if k&0xFFFFFFFF != blockId {
+			continue
+		}
+		if raw, err := adp.GetMessage(blockId, k); err == nil && len(raw) == 6 && binary.LittleEndian.Uint32(raw[0:4]) == sessid {
+			adp.DeleteMessage(blockId, k)
+			adp.Append(true, k, nil)
+		}
+	}
+}
+
 // Keys performs a query and attempts to fetch all keys for given blockId and key prefix.
 func (l *MessageLog) Keys(prefix uint32) []uint64 {
 	matches := make([]uint64, 0)
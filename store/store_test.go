@@ -0,0 +1,214 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	adapter "github.com/unit-io/unitd/db"
+	lp "github.com/unit-io/unitd/lineprotocol"
+	"github.com/unit-io/unitd/message"
+)
+
+// memAdapter stores the entries in memory, the entries of a topic are returned newest first up to the limit.
+type memAdapter struct {
+	adapter.Adapter
+	entries map[string][]memEntry
+	nextID  int
+}
+
+type memEntry struct {
+	id      string
+	payload []byte
+}
+
+func newMemAdapter() *memAdapter {
+	return &memAdapter{entries: make(map[string][]memEntry)}
+}
+
+func memKey(contract uint32, topic []byte) string {
+	if i := bytes.IndexByte(topic, '?'); i >= 0 {
+		topic = topic[:i]
+	}
+	return strconv.FormatUint(uint64(contract), 10) + "/" + string(topic)
+}
+
+func (a *memAdapter) Put(contract uint32, topic, payload []byte) error {
+	id, _ := a.NewID()
+	return a.PutWithID(contract, id, topic, payload)
+}
+
+func (a *memAdapter) PutWithID(contract uint32, messageId, topic, payload []byte) error {
+	key := memKey(contract, topic)
+	a.entries[key] = append(a.entries[key], memEntry{id: string(messageId), payload: payload})
+	return nil
+}
+
+func (a *memAdapter) Get(contract uint32, topic []byte, limit int) (matches [][]byte, err error) {
+	entries := a.entries[memKey(contract, topic)]
+	for i := len(entries) - 1; i >= 0 && len(matches) < limit; i-- {
+		matches = append(matches, entries[i].payload)
+	}
+	return matches, nil
+}
+
+func (a *memAdapter) NewID() ([]byte, error) {
+	a.nextID++
+	return []byte(strconv.Itoa(a.nextID)), nil
+}
+
+func (a *memAdapter) Delete(contract uint32, messageId, topic []byte) error {
+	key := memKey(contract, topic)
+	for i, e := range a.entries[key] {
+		if e.id == string(messageId) {
+			a.entries[key] = append(a.entries[key][:i], a.entries[key][i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func withMemAdapter(t *testing.T) {
+	prev := adp
+	adp = newMemAdapter()
+	// The pages cached are of the previous adapter.
+	revokedTopic = newPagedTopic("revoked")
+	clientIdTopic = newPagedTopic("clientid")
+	revokedClientIdTopic = newPagedTopic("clientid.revoked")
+	storedTopic = newPagedTopic("quota.stored")
+	t.Cleanup(func() { adp = prev })
+}
+
+func TestMessageGetUntil(t *testing.T) {
+	withMemAdapter(t)
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 100; i++ {
+		published := start.Add(time.Duration(i) * time.Second)
+		assert.NoError(t, Message.Put(1, []byte("a.b"), 0, []byte(strconv.Itoa(i)), nil, 0, published))
+	}
+	// The messages are stored once.
+	assert.Equal(t, 1, len(adp.(*memAdapter).entries))
+	assert.Equal(t, 100, len(adp.(*memAdapter).entries[memKey(1, []byte("a.b"))]))
+
+	msgs, err := Message.Get(1, []byte("a.b"), time.Time{}, start.Add(9*time.Second), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(msgs))
+	for i, msg := range msgs {
+		assert.Equal(t, strconv.Itoa(5+i), string(msg.Payload))
+	}
+
+	msgs, err = Message.Get(1, []byte("a.b"), start.Add(2*time.Second), start.Add(4*time.Second), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(msgs))
+	assert.Equal(t, "2", string(msgs[0].Payload))
+	assert.Equal(t, start.Add(4*time.Second).UnixNano(), msgs[2].Published)
+}
+
+func TestRevokedPages(t *testing.T) {
+	withMemAdapter(t)
+	for i := 0; i < 2*maxResults+10; i++ {
+		assert.NoError(t, Revocation.Revoke(1, []byte(strconv.Itoa(i)), 0))
+	}
+	keys, err := Revocation.Revoked(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*maxResults+10, len(keys))
+
+	// The last page is loaded from the store after a restart.
+	revokedTopic = newPagedTopic("revoked")
+	assert.NoError(t, Revocation.Revoke(1, []byte("last"), 0))
+	keys, err = Revocation.Revoked(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*maxResults+11, len(keys))
+	assert.Contains(t, keys, []byte("0"))
+	assert.Contains(t, keys, []byte("last"))
+}
+
+func TestClientIdRevoke(t *testing.T) {
+	withMemAdapter(t)
+	for i := 0; i < maxResults+10; i++ {
+		assert.NoError(t, ClientId.Put(1, []byte("id"+strconv.Itoa(i)), []byte("cid"+strconv.Itoa(i))))
+	}
+	clientIDs, err := ClientId.Get(1)
+	assert.NoError(t, err)
+	assert.Equal(t, maxResults+10, len(clientIDs))
+
+	// The client Id on the first page is revoked by the id.
+	ok, err := ClientId.Revoke(1, []byte("id0"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = ClientId.Revoke(1, []byte("id0"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = ClientId.Revoke(2, []byte("id1"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	clientIDs, err = ClientId.Get(1)
+	assert.NoError(t, err)
+	assert.Equal(t, maxResults+9, len(clientIDs))
+	assert.NotContains(t, clientIDs, []byte("cid0"))
+	revoked, err := ClientId.Revoked(1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("id0")}, revoked)
+}
+
+func TestQuotaStored(t *testing.T) {
+	withMemAdapter(t)
+	expiry := time.Now().Add(time.Hour)
+	assert.NoError(t, Quota.PutStored(1, StoredBytes{Expiry: expiry.Add(time.Minute), Size: 5}))
+	assert.NoError(t, Quota.PutStored(1, StoredBytes{Expiry: expiry, Size: 10}))
+	assert.NoError(t, Quota.PutStored(1, StoredBytes{Expiry: time.Now().Add(-time.Second), Size: 20}))
+	assert.NoError(t, Quota.PutStored(1, StoredBytes{Expiry: expiry, Size: 15}))
+	assert.NoError(t, Quota.PutStored(2, StoredBytes{Expiry: expiry, Size: 30}))
+
+	// The bytes recorded with the same expiry are added.
+	stored, err := Quota.Stored(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(stored))
+	assert.Equal(t, int64(25), stored[0].Size)
+	assert.True(t, expiry.Equal(stored[0].Expiry))
+	assert.Equal(t, int64(5), stored[1].Size)
+}
+
+func TestMessageProperties(t *testing.T) {
+	withMemAdapter(t)
+	format := uint8(1)
+	props := &lp.Properties{
+		PayloadFormat:   &format,
+		MessageExpiry:   60,
+		ContentType:     []byte("text/plain"),
+		ResponseTopic:   []byte("a.reply"),
+		CorrelationData: []byte{1, 2},
+		UserProperties:  []lp.UserProperty{{Key: []byte("k"), Value: []byte("v")}},
+	}
+	assert.NoError(t, Retained.Put(1, []byte("a.b"), 1, []byte("hi"), props))
+	assert.NoError(t, Session.Enqueue(1, 7, &message.Message{Topic: []byte("a.b"), Qos: 1, Payload: []byte("hi"), Properties: props}, time.Minute))
+
+	retained, err := Retained.Get(1, []byte("a.b"))
+	assert.NoError(t, err)
+	queued, err := Session.Dequeue(1, 7)
+	assert.NoError(t, err)
+	for _, msgs := range [][]message.Message{retained, queued} {
+		assert.Equal(t, 1, len(msgs))
+		assert.Equal(t, uint8(1), msgs[0].Qos)
+		assert.Equal(t, "hi", string(msgs[0].Payload))
+		// The remaining message expiry interval is decoded.
+		assert.InDelta(t, 60, msgs[0].Properties.MessageExpiry, 1)
+		msgs[0].Properties.MessageExpiry = props.MessageExpiry
+		assert.Equal(t, props, msgs[0].Properties)
+	}
+
+	// The message whose message expiry interval has passed is not decoded.
+	raw := encodeMessageWithProperties([]byte("id"), []byte("a.b"), 1, &lp.Properties{MessageExpiry: 1}, []byte("hi"))
+	messageId, _, ok := decodeMessage(raw)
+	assert.True(t, ok)
+	plain, _ := unseal(raw)
+	encoded, _, _ := readBytes(plain[2+2+2+3+1:])
+	binary.LittleEndian.PutUint64(encoded[1:9], uint64(time.Now().Add(-time.Second).Unix()))
+	messageId, _, ok = decodeMessage(seal(plain))
+	assert.False(t, ok)
+	assert.Equal(t, []byte("id"), messageId)
+}
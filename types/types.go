@@ -28,11 +28,20 @@ var (
 	ErrServerError       = &Error{Status: 500, Message: "An unexpected condition was encountered."}
 	ErrNotImplemented    = &Error{Status: 501, Message: "The server does not recognize the request method."}
 	ErrTargetTooLong     = &Error{Status: 400, Message: "Topic can not have more than 23 parts."}
+	ErrGroupFull         = &Error{Status: 403, Message: "The shared subscription group has reached the maximum number of subscribers."}
+	ErrKeyExpired        = &Error{Status: 401, Message: "The security key provided has expired."}
+	ErrKeyRevoked        = &Error{Status: 401, Message: "The security key provided has been revoked."}
+	ErrRevokeForbidden   = &Error{Status: 403, Message: "The request was invalid, use primary client Id to revoke a key."}
+	ErrClientIdRevoked   = &Error{Status: 401, Message: "The client Id provided has been revoked."}
+	ErrTooManyRequests   = &Error{Status: 429, Message: "The contract has exceeded its rate limit or quota."}
+	ErrExtendForbidden   = &Error{Status: 403, Message: "The parent key is not allowed to generate the key requested."}
 )
 
 type KeyGenRequest struct {
+	Key   string `json:"key,omitempty"` // The parent key to generate the key for a sub-topic of the parent key topic.
 	Topic string `json:"topic"`
 	Type  string `json:"type"`
+	TTL   string `json:"ttl,omitempty"` // The key expires after the ttl, e.g. "24h". The key does not expire if not set.
 }
 
 func (m *KeyGenRequest) Access() uint32 {
@@ -44,6 +53,12 @@ func (m *KeyGenRequest) Access() uint32 {
 			required |= security.AllowRead
 		case 'w':
 			required |= security.AllowWrite
+		case 'p':
+			required |= security.AllowPresence
+		case 'l', 'h':
+			required |= security.AllowHistory
+		case 'e':
+			required |= security.AllowExtend
 		}
 	}
 
@@ -56,7 +71,54 @@ type KeyGenResponse struct {
 	Topic  string `json:"topic"`
 }
 
+type KeyRevokeRequest struct {
+	Key string `json:"key"`
+}
+
+type KeyRevokeResponse struct {
+	Status int    `json:"status"`
+	Key    string `json:"key"`
+}
+
+type PresenceRequest struct {
+	Key   string `json:"key"`
+	Topic string `json:"topic"`
+}
+
+type PresenceInfo struct {
+	ID       string `json:"id"`
+	Username string `json:"username,omitempty"`
+}
+
+type PresenceResponse struct {
+	Status int            `json:"status"`
+	Topic  string         `json:"topic"`
+	Who    []PresenceInfo `json:"who"`
+}
+
+// PresenceEvent is sent to the presence subscribers of the topic, the event is "join", "leave" or "status".
+type PresenceEvent struct {
+	Event string         `json:"event"`
+	Topic string         `json:"topic"`
+	Time  int64          `json:"time"`
+	Who   []PresenceInfo `json:"who"`
+}
+
 type ClientIdResponse struct {
 	Status   int    `json:"status"`
 	ClientId string `json:"key"`
 }
+
+type ClientIdListResponse struct {
+	Status    int      `json:"status"`
+	ClientIds []string `json:"clientids"`
+}
+
+type ClientIdRevokeRequest struct {
+	ClientId string `json:"clientid"`
+}
+
+type ClientIdRevokeResponse struct {
+	Status   int    `json:"status"`
+	ClientId string `json:"clientid"`
+}